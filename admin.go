@@ -0,0 +1,328 @@
+package project02
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJobErrors caps how many page errors a crawl job keeps.
+const maxJobErrors = 100
+
+// AdminConfig configures the admin endpoints served with WithAdmin.
+type AdminConfig struct {
+	// Token must be sent as "Authorization: Bearer <token>". Admin
+	// endpoints are not served when it is empty, unless WithAccess
+	// provides admin-scoped keys.
+	Token string
+
+	// Extract selects the extraction mode for submitted documents and for
+	// crawl jobs.
+	Extract ExtractOptions
+}
+
+// WithAdmin serves the admin API under /admin/: adding and deleting
+// documents and running crawl jobs into the mux's indexer.
+func WithAdmin(c AdminConfig) MuxOption {
+	return func(cfg *muxConfig) { cfg.admin = &c }
+}
+
+// AdminDocument is the body of POST /admin/documents. Exactly one of Text
+// and HTML is used; HTML goes through the same extraction as crawled pages.
+type AdminDocument struct {
+	URL  string `json:"url"`
+	Text string `json:"text,omitempty"`
+	HTML string `json:"html,omitempty"`
+	Lang string `json:"lang,omitempty"` // overrides the detected language
+}
+
+// AdminCrawl is the body of POST /admin/crawl.
+type AdminCrawl struct {
+	Start    string `json:"start"`
+	Max      int    `json:"max"`
+	Sitemaps bool   `json:"sitemaps,omitempty"`
+}
+
+// Crawl job states.
+const (
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled" // stopped by server shutdown
+)
+
+// CrawlJob is the progress of a crawl started with POST /admin/crawl.
+type CrawlJob struct {
+	ID       string     `json:"id"`
+	Start    string     `json:"start"`
+	Max      int        `json:"max"`
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Visited  int        `json:"visited"`
+	Stats    CrawlStats `json:"stats"`
+	Errors   []string   `json:"errors,omitempty"` // "url: error", at most maxJobErrors
+	Error    string     `json:"error,omitempty"`  // why the job failed
+}
+
+// crawlJobs tracks the crawl jobs of one mux.
+type crawlJobs struct {
+	mu   sync.Mutex
+	next int
+	jobs map[string]*CrawlJob
+}
+
+// start runs a crawl in the background until it ends or ctx is done.
+// done is called when it ends.
+func (js *crawlJobs) start(ctx context.Context, req AdminCrawl, cfg CrawlConfig, done func()) CrawlJob {
+	js.mu.Lock()
+	js.next++
+	job := &CrawlJob{
+		ID:      strconv.Itoa(js.next),
+		Start:   req.Start,
+		Max:     req.Max,
+		State:   JobRunning,
+		Started: time.Now().UTC(),
+	}
+	js.jobs[job.ID] = job
+	snapshot := *job
+	js.mu.Unlock()
+
+	cfg.Progress = func(u string, err error, st CrawlStats) {
+		st.Skipped = maps.Clone(st.Skipped)
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		job.Visited++
+		job.Stats = st
+		if err != nil && len(job.Errors) < maxJobErrors {
+			job.Errors = append(job.Errors, u+": "+err.Error())
+		}
+	}
+	go func() {
+		defer done()
+		_, err := CrawlWithContext(ctx, req.Start, cfg)
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		now := time.Now().UTC()
+		job.Finished = &now
+		switch {
+		case err == nil:
+			job.State = JobDone
+		case errors.Is(err, context.Canceled):
+			job.State = JobCanceled
+		default:
+			job.State, job.Error = JobFailed, err.Error()
+		}
+	}()
+	return snapshot
+}
+
+// get returns a copy of job id that is safe to encode while it runs.
+func (js *crawlJobs) get(id string) (CrawlJob, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	job, ok := js.jobs[id]
+	if !ok {
+		return CrawlJob{}, false
+	}
+	out := *job
+	out.Errors = append([]string(nil), job.Errors...)
+	return out, true
+}
+
+// list returns every job, oldest first.
+func (js *crawlJobs) list() []CrawlJob {
+	js.mu.Lock()
+	ids := make([]int, 0, len(js.jobs))
+	for id := range js.jobs {
+		n, _ := strconv.Atoi(id)
+		ids = append(ids, n)
+	}
+	js.mu.Unlock()
+	sort.Ints(ids)
+	out := make([]CrawlJob, 0, len(ids))
+	for _, n := range ids {
+		if job, ok := js.get(strconv.Itoa(n)); ok {
+			out = append(out, job)
+		}
+	}
+	return out
+}
+
+// registerAdmin adds the admin endpoints of one index to mux under its
+// prefix.
+func registerAdmin(mux *http.ServeMux, m mountedIndex) {
+	prefix, indexer, cfg := m.prefix(), m.indexer, m.cfg
+	ac := cfg.admin
+	jobs := &crawlJobs{jobs: make(map[string]*CrawlJob)}
+	auth := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if cfg.access != nil {
+				// The access middleware has already checked the key.
+				if c, _ := ClientFromContext(r.Context()); !c.canAdmin(m.name) {
+					http.Error(w, "admin scope required for this collection", http.StatusForbidden)
+					return
+				}
+				h(w, r)
+				return
+			}
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(ac.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	// POST /admin/documents {url, text|html, lang} -> index or replace one document
+	mux.HandleFunc("POST "+prefix+"/admin/documents", auth(func(w http.ResponseWriter, r *http.Request) {
+		var req AdminDocument
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		key := Canonicalize(req.URL)
+		if key == "" || (req.Text == "") == (req.HTML == "") {
+			http.Error(w, "url and exactly one of text or html are required", http.StatusBadRequest)
+			return
+		}
+		var d *Document
+		if req.HTML != "" {
+			d = ExtractDocumentWith([]byte(req.HTML), ac.Extract)
+		} else {
+			d = textDocument(req.Text, nil, ac.Extract)
+		}
+		if d == nil {
+			http.Error(w, "no content extracted", http.StatusUnprocessableEntity)
+			return
+		}
+		if req.Lang != "" {
+			d.Lang = NormalizeLang(req.Lang)
+		}
+		// Add ignores documents that are already indexed, so replace them.
+		replaced, err := ReplaceDocument(indexer, key, d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{"url": key, "words": len(d.Words), "replaced": replaced})
+	}))
+
+	// DELETE /admin/documents?url=u -> remove one document
+	mux.HandleFunc("DELETE "+prefix+"/admin/documents", auth(func(w http.ResponseWriter, r *http.Request) {
+		di, ok := indexer.(DeleteIndexer)
+		if !ok {
+			http.Error(w, "index does not support deletion", http.StatusNotImplemented)
+			return
+		}
+		key := Canonicalize(r.URL.Query().Get("url"))
+		if key == "" {
+			http.Error(w, "url is required", http.StatusBadRequest)
+			return
+		}
+		switch ok, err := di.Delete(key); {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		case !ok:
+			http.Error(w, "document not found", http.StatusNotFound)
+			return
+		}
+		cfg.dedup.Forget(key)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// POST /admin/crawl {start, max, sitemaps} -> 202 with the new job
+	mux.HandleFunc("POST "+prefix+"/admin/crawl", auth(func(w http.ResponseWriter, r *http.Request) {
+		var req AdminCrawl
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if !strings.HasPrefix(req.Start, "http://") && !strings.HasPrefix(req.Start, "https://") {
+			http.Error(w, "start must be an http(s) URL", http.StatusBadRequest)
+			return
+		}
+		if req.Max <= 0 {
+			http.Error(w, "max must be positive", http.StatusBadRequest)
+			return
+		}
+		cc := CrawlConfig{
+			Max:      req.Max,
+			Indexer:  indexer,
+			Dedup:    cfg.dedup,
+			Sitemaps: req.Sitemaps,
+			Metrics:  cfg.metrics,
+			Extract:  ac.Extract,
+		}
+		if gi, ok := indexer.(GraphIndexer); ok {
+			cc.Graph = gi
+		}
+		ctx, done := startTask(r)
+		job := jobs.start(ctx, req, cc, done)
+		w.Header().Set("Location", fmt.Sprintf("%s/admin/jobs/%s", prefix, job.ID))
+		writeJSON(w, http.StatusAccepted, job)
+	}))
+
+	// GET /admin/jobs -> every crawl job; GET /admin/jobs/{id} -> one job
+	mux.HandleFunc("GET "+prefix+"/admin/jobs", auth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jobs.list())
+	}))
+	mux.HandleFunc("GET "+prefix+"/admin/jobs/{id}", auth(func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	}))
+
+	// GET /admin/queries[?n=20] -> query analytics over this index's searches
+	if cfg.queryLog != nil {
+		mux.HandleFunc("GET "+prefix+"/admin/queries", auth(func(w http.ResponseWriter, r *http.Request) {
+			n, err := strconv.Atoi(r.URL.Query().Get("n"))
+			if err != nil || n <= 0 {
+				n = 20
+			}
+			var events []QueryEvent
+			for _, e := range cfg.queryLog.Events() {
+				if e.Collection == m.name {
+					events = append(events, e)
+				}
+			}
+			writeJSON(w, http.StatusOK, AnalyzeQueries(events, n))
+		}))
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// decodeJSON decodes the request body into v, answering 413 when the body
+// exceeds the access limit and 400 when it is not valid JSON.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+	return false
+}
@@ -0,0 +1,219 @@
+package project02
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strings"
+)
+
+// anchorBoost weighs the anchor-text field against the page body when the
+// two scores are summed for a document.
+const anchorBoost = 0.5
+
+// AnchorIndexer is implemented by indexers that keep the anchor text of
+// incoming links as a separate field of the target document. Anchors may
+// be added before the target itself is indexed; they count once it is.
+type AnchorIndexer interface {
+	// AddAnchor indexes words (from a link on source pointing at target)
+	// with the stopwords and stemmer for lang. Deleting source removes
+	// them again.
+	AddAnchor(source, target, lang string, words []string)
+}
+
+// ExtractLinks returns the links of an HTML page with their anchor text.
+func ExtractLinks(body []byte) []Link {
+	d := ExtractDocument(body)
+	if d == nil {
+		return nil
+	}
+	return d.Links
+}
+
+// indexAnchors attaches the anchor text of d's links to their targets,
+// keyed by their Canonicalize form. Self-links, links without text and
+// links the page asks not to follow are skipped.
+func indexAnchors(ai AnchorIndexer, url string, d *Document) {
+	if d.NoFollow {
+		return
+	}
+	for _, l := range d.Links {
+		if l.NoFollow() {
+			continue
+		}
+		target := Canonicalize(CleanHref(url, l.Href))
+		if target == "" || target == url {
+			continue
+		}
+		words := Tokenize(l.Text, true)
+		if len(words) == 0 {
+			continue
+		}
+		ai.AddAnchor(url, target, d.Lang, words)
+	}
+}
+
+// anchorStems runs the index pipeline (lower -> stop filter -> stem) on anchor words.
+func anchorStems(stop map[string]struct{}, lang string, words []string) []string {
+	var out []string
+	for _, w := range words {
+		lw := strings.ToLower(w)
+		if lw == "" {
+			continue
+		}
+		if _, bad := stop[lw]; bad {
+			continue
+		}
+		if s := stemLang(lang, lw); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// mergeAnchorHits adds anchorBoost times the anchor-field scores to the
+// body scores and returns the combined hits sorted by lessHit.
+func mergeAnchorHits(body, anchor []Hit) []Hit {
+	if len(anchor) == 0 {
+		return body
+	}
+	scores := make(map[string]float64, len(body)+len(anchor))
+	for _, h := range body {
+		scores[h.URL] += h.Score
+	}
+	for _, h := range anchor {
+		scores[h.URL] += anchorBoost * h.Score
+	}
+	return sortedHits(scores)
+}
+
+// createAnchorTables creates the anchor-text field tables shared by the SQLite indexers.
+func createAnchorTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS anchors (
+			target TEXT NOT NULL,
+			term TEXT NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (target, term)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_anchors_term ON anchors(term);
+
+		CREATE TABLE IF NOT EXISTS anchor_len (
+			target TEXT PRIMARY KEY,
+			len INTEGER NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE IF NOT EXISTS anchor_sources (
+			source TEXT NOT NULL,
+			target TEXT NOT NULL,
+			term TEXT NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (source, target, term)
+		);
+	`)
+	return err
+}
+
+func sqlAddAnchor(db *sql.DB, source, target string, stems []string) {
+	if len(stems) == 0 {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	for _, s := range stems {
+		_, err = tx.Exec(`
+			INSERT INTO anchors (target, term, count) VALUES (?, ?, 1)
+			ON CONFLICT(target, term) DO UPDATE SET count = count + 1`, target, s)
+		if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO anchor_sources (source, target, term, count) VALUES (?, ?, ?, 1)
+				ON CONFLICT(source, target, term) DO UPDATE SET count = count + 1`, source, target, s)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO anchor_len (target, len) VALUES (?, ?)
+		ON CONFLICT(target) DO UPDATE SET len = len + ?`, target, len(stems), len(stems))
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	tx.Commit()
+}
+
+// sqlDeleteAnchors removes the anchors added from links on source, as part
+// of deleting it in tx.
+func sqlDeleteAnchors(tx *sql.Tx, source string) error {
+	for _, stmt := range []string{
+		`UPDATE anchors SET count = count - (
+			SELECT s.count FROM anchor_sources s
+			WHERE s.source = ?1 AND s.target = anchors.target AND s.term = anchors.term)
+		WHERE EXISTS (
+			SELECT 1 FROM anchor_sources s
+			WHERE s.source = ?1 AND s.target = anchors.target AND s.term = anchors.term)`,
+		`UPDATE anchor_len SET len = len - (
+			SELECT SUM(s.count) FROM anchor_sources s
+			WHERE s.source = ?1 AND s.target = anchor_len.target)
+		WHERE target IN (SELECT target FROM anchor_sources WHERE source = ?1)`,
+		"DELETE FROM anchor_sources WHERE source = ?1",
+		"DELETE FROM anchors WHERE count <= 0",
+		"DELETE FROM anchor_len WHERE len <= 0",
+	} {
+		if _, err := tx.Exec(stmt, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anchorIDF is the IDF of the anchor field. It takes the larger of the body
+// and anchor document frequencies, so a word common on pages does not count
+// as rare just because few links carry it.
+func anchorIDF(n, bodyDF, anchorDF int) float64 {
+	return math.Log(float64(n) / float64(max(bodyDF, anchorDF)))
+}
+
+// sqlAnchorHits scores the anchor field for stem s, whose body document
+// frequency is bodyDF. Only targets present in docTable (which must have
+// url and lang columns) are returned and counted.
+func sqlAnchorHits(ctx context.Context, db *sql.DB, docTable string, n, bodyDF int, s, lang string) []Hit {
+	if n == 0 {
+		return nil
+	}
+	var df int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM anchors a
+		JOIN `+docTable+` d ON d.url = a.target
+		WHERE a.term = ?`, s).Scan(&df)
+	if err != nil || df == 0 {
+		return nil
+	}
+	idf := anchorIDF(n, bodyDF, df)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.target, a.count, l.len FROM anchors a
+		JOIN anchor_len l ON l.target = a.target
+		JOIN `+docTable+` d ON d.url = a.target
+		WHERE a.term = ? AND (? = '' OR d.lang = ?)`, s, lang, lang)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var hits []Hit
+	for rows.Next() {
+		var target string
+		var count, l int
+		if err := rows.Scan(&target, &count, &l); err != nil || l == 0 {
+			continue
+		}
+		hits = append(hits, Hit{URL: target, Score: float64(count) / float64(l) * idf})
+	}
+	return hits
+}
@@ -0,0 +1,266 @@
+package project02
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API key scopes. Admin keys may also read.
+const (
+	ScopeRead  = "read"
+	ScopeAdmin = "admin"
+)
+
+// maxBuckets is how many rate limit buckets are kept before idle, full
+// ones are dropped.
+const maxBuckets = 10000
+
+// APIKey is one client credential.
+type APIKey struct {
+	Key   string
+	Scope string // ScopeRead or ScopeAdmin
+	Name  string // identifies the client in logs and rate limits
+
+	// Collections limits an admin key to the named collections, "" being
+	// the default index; nil lets it administer all of them.
+	Collections []string
+}
+
+// Client is the caller of a request as identified by the access middleware.
+type Client struct {
+	ID    string // "key:<name>" or "ip:<address>", the rate limit bucket
+	Name  string // key name; empty for anonymous clients
+	Scope string
+
+	Collections []string // see APIKey.Collections
+}
+
+// canAdmin reports whether c may use the admin routes of collection.
+func (c Client) canAdmin(collection string) bool {
+	return c.Scope == ScopeAdmin && (c.Collections == nil || slices.Contains(c.Collections, collection))
+}
+
+// ParseAPIKeys reads "key scope name" lines. Blank lines and lines starting
+// with '#' are skipped.
+func ParseAPIKeys(r io.Reader) ([]APIKey, error) {
+	var out []APIKey
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if len(f) != 3 {
+			return nil, fmt.Errorf("keys line %d: want 3 fields, got %d", line, len(f))
+		}
+		if f[1] != ScopeRead && f[1] != ScopeAdmin {
+			return nil, fmt.Errorf("keys line %d: unknown scope %q", line, f[1])
+		}
+		out = append(out, APIKey{Key: f[0], Scope: f[1], Name: f[2]})
+	}
+	return out, sc.Err()
+}
+
+// LoadAPIKeys reads an API key file; see ParseAPIKeys.
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseAPIKeys(f)
+}
+
+// AccessConfig configures the access middleware installed by WithAccess.
+type AccessConfig struct {
+	// Keys are accepted as "Authorization: Bearer <key>" or "X-API-Key".
+	// An unknown key is rejected even when Anonymous is set.
+	Keys []APIKey
+
+	// Anonymous lets requests without a key read, rate limited per IP.
+	Anonymous bool
+
+	// Rate is the sustained requests per second allowed per client and
+	// Burst the bucket size; Rate 0 disables rate limiting.
+	Rate  float64
+	Burst int
+
+	// MaxBodyBytes limits request bodies; 0 means no limit.
+	MaxBodyBytes int64
+
+	// TrustProxy takes the client IP from the last X-Forwarded-For entry,
+	// the one added by the proxy; earlier entries come from the client and
+	// can be forged. Only enable it behind a proxy that appends the header.
+	TrustProxy bool
+}
+
+// WithAccess requires API keys (or allows anonymous reads), rate limits
+// clients and bounds request bodies. /healthz and /readyz stay open.
+// Admin endpoints then need an admin-scoped key; AdminConfig.Token is
+// accepted as one for its own collection only.
+func WithAccess(c AccessConfig) MuxOption {
+	return func(cfg *muxConfig) {
+		c := c // each mux adds admin tokens to its own copy
+		c.Keys = slices.Clone(c.Keys)
+		cfg.access = &c
+	}
+}
+
+type clientKey struct{}
+
+// ClientFromContext returns the client the access middleware identified
+// for the request carrying ctx.
+func ClientFromContext(ctx context.Context) (Client, bool) {
+	c, ok := ctx.Value(clientKey{}).(Client)
+	return c, ok
+}
+
+// accessControl is the middleware built from an AccessConfig.
+type accessControl struct {
+	cfg     AccessConfig
+	limiter *rateLimiter
+}
+
+func newAccessControl(cfg AccessConfig) *accessControl {
+	a := &accessControl{cfg: cfg}
+	if cfg.Rate > 0 {
+		a.limiter = newRateLimiter(cfg.Rate, cfg.Burst)
+	}
+	return a
+}
+
+// lookup finds key, comparing every entry in constant time.
+func (a *accessControl) lookup(key string) (APIKey, bool) {
+	var found APIKey
+	ok := false
+	for _, k := range a.cfg.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+func (a *accessControl) clientIP(r *http.Request) string {
+	if a.cfg.TrustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(xff[strings.LastIndex(xff, ",")+1:])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *accessControl) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = bearer
+		}
+		var c Client
+		switch k, ok := a.lookup(key); {
+		case ok:
+			c = Client{ID: "key:" + k.Name, Name: k.Name, Scope: k.Scope, Collections: k.Collections}
+		case key == "" && a.cfg.Anonymous:
+			c = Client{ID: "ip:" + a.clientIP(r), Scope: ScopeRead}
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="search"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if slot, ok := r.Context().Value(clientSlot{}).(*Client); ok {
+			*slot = c
+		}
+		if ok, wait := a.limiter.take(c.ID); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if max := a.cfg.MaxBodyBytes; max > 0 {
+			if r.ContentLength > max {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, c)))
+	})
+}
+
+// rateLimiter is a set of token buckets keyed by client ID.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   math.Max(float64(burst), 1),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take spends a token of client's bucket. When none is left it reports
+// how long until one is. A nil limiter allows everything.
+func (l *rateLimiter) take(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b := l.buckets[client]
+	if b == nil {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune drops buckets that have refilled, which behave like new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, id)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package project02
+
+import (
+	"container/list"
+	"sync"
+)
+
+// GenerationIndexer is implemented by indexers that count their writes, so
+// caches can tell when results computed earlier are stale.
+type GenerationIndexer interface {
+	// Generation returns a counter that increases whenever a write (Add,
+	// AddAnchor, ...) may change search results. Writes made to the same
+	// database by another process are not counted.
+	Generation() uint64
+}
+
+// CacheStats are the counters of a QueryCache.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // entries dropped for space or staleness
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"` // estimated size of the cached results
+}
+
+// QueryCache is an LRU cache of search results keyed by normalized query.
+// Every entry belongs to the index generation it was computed at; a newer
+// generation empties the cache.
+type QueryCache struct {
+	maxEntries int   // 0 means no entry limit
+	maxBytes   int64 // 0 means no size limit
+
+	mu    sync.Mutex
+	ll    *list.List // front is most recently used
+	items map[string]*list.Element
+	bytes int64
+	gen   uint64
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	key        string
+	hits       []Hit
+	suggestion string
+	size       int64
+}
+
+// NewQueryCache creates a cache holding at most maxEntries results and
+// about maxBytes of them; a zero limit is not enforced.
+func NewQueryCache(maxEntries int, maxBytes int64) *QueryCache {
+	return &QueryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// CacheKey normalizes a query for use as a cache key: case and spacing do
+// not change results, the language does.
+func CacheKey(q, lang string) string {
+	return lang + "\x00" + NormalizeQuery(q)
+}
+
+// Get returns the cached results for key if they were computed at gen.
+// The returned slice is a copy the caller may modify.
+func (c *QueryCache) Get(key string, gen uint64) ([]Hit, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(gen)
+	el, ok := c.items[key]
+	if !ok || gen != c.gen {
+		c.stats.Misses++
+		return nil, "", false
+	}
+	c.stats.Hits++
+	c.ll.MoveToFront(el)
+	e := el.Value.(*cacheEntry)
+	return append([]Hit(nil), e.hits...), e.suggestion, true
+}
+
+// Put stores results computed at gen. Results from an older generation
+// than the cache has seen, or larger than the byte limit, are not stored.
+func (c *QueryCache) Put(key string, gen uint64, hits []Hit, suggestion string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(gen)
+	if gen != c.gen {
+		return
+	}
+	e := &cacheEntry{key: key, hits: append([]Hit(nil), hits...), suggestion: suggestion}
+	e.size = entrySize(e)
+	if c.maxBytes > 0 && e.size > c.maxBytes {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.bytes += e.size
+	for (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *QueryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Entries = c.ll.Len()
+	st.Bytes = c.bytes
+	return st
+}
+
+// advance empties the cache when the index has moved past its generation.
+func (c *QueryCache) advance(gen uint64) {
+	if gen <= c.gen {
+		return
+	}
+	c.stats.Evictions += uint64(c.ll.Len())
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	c.gen = gen
+}
+
+func (c *QueryCache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
+
+// entrySize estimates the memory held by e: string bytes plus headers.
+func entrySize(e *cacheEntry) int64 {
+	size := int64(64 + len(e.key) + len(e.suggestion))
+	for _, h := range e.hits {
+		size += int64(24 + len(h.URL))
+	}
+	return size
+}
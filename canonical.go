@@ -0,0 +1,171 @@
+package project02
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CanonicalOptions tunes CanonicalizeWith.
+type CanonicalOptions struct {
+	// StripParams lists query parameters to drop. A trailing '*' matches
+	// every parameter with that prefix, e.g. "utm_*".
+	StripParams []string
+}
+
+// DefaultTrackingParams returns common analytics parameters that never
+// change the content of a page.
+// No globals: caller injects or uses this helper.
+func DefaultTrackingParams() []string {
+	return []string{"utm_*", "fbclid", "gclid", "mc_cid", "mc_eid", "_ga", "yclid", "msclkid"}
+}
+
+// Canonicalize normalizes an absolute http(s) URL so that equivalent
+// spellings compare equal, stripping DefaultTrackingParams.
+func Canonicalize(raw string) string {
+	return CanonicalizeWith(raw, CanonicalOptions{StripParams: DefaultTrackingParams()})
+}
+
+// CanonicalizeWith lowercases scheme and host, drops the default port and
+// the fragment, removes dot segments from the path, normalizes
+// percent-encoding and sorts the query parameters. Strings that are not
+// absolute http(s) URLs are returned unchanged.
+func CanonicalizeWith(raw string, opts CanonicalOptions) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return raw
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") { // IPv6 literal
+		host = "[" + host + "]"
+	}
+	if p := u.Port(); p != "" && !(scheme == "http" && p == "80") && !(scheme == "https" && p == "443") {
+		host += ":" + p
+	}
+
+	var sb strings.Builder
+	sb.WriteString(scheme)
+	sb.WriteString("://")
+	if u.User != nil {
+		sb.WriteString(u.User.String())
+		sb.WriteByte('@')
+	}
+	sb.WriteString(host)
+	sb.WriteString(cleanPath(normalizeEscapes(u.EscapedPath())))
+
+	if q := canonicalQuery(u.RawQuery, opts.StripParams); q != "" {
+		sb.WriteByte('?')
+		sb.WriteString(q)
+	}
+	return sb.String()
+}
+
+// cleanPath removes "." and ".." segments, keeping a trailing slash.
+// An empty path becomes "/".
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	trailing := strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")
+	p = path.Clean("/" + p)
+	if trailing && p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+// normalizeEscapes decodes percent-escapes of unreserved characters and
+// upper-cases the hex digits of every other escape.
+func normalizeEscapes(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		b := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(b) {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteString(strings.ToUpper(s[i+1 : i+3]))
+		}
+		i += 2
+	}
+	return sb.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// isUnreserved reports whether c is an RFC 3986 unreserved character.
+func isUnreserved(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// canonicalQuery drops stripped parameters and sorts the rest by key, then
+// value. Escapes are normalized but not otherwise re-encoded.
+func canonicalQuery(raw string, strip []string) string {
+	if raw == "" {
+		return ""
+	}
+	type pair struct{ k, v, s string }
+	var pairs []pair
+	for _, part := range strings.Split(raw, "&") {
+		if part == "" {
+			continue
+		}
+		part = normalizeEscapes(part)
+		k, v, _ := strings.Cut(part, "=")
+		if stripParam(k, strip) {
+			continue
+		}
+		pairs = append(pairs, pair{k, v, part})
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].k != pairs[j].k {
+			return pairs[i].k < pairs[j].k
+		}
+		return pairs[i].v < pairs[j].v
+	})
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = p.s
+	}
+	return strings.Join(parts, "&")
+}
+
+// stripParam reports whether key matches one of the strip patterns.
+func stripParam(key string, strip []string) bool {
+	key = strings.ToLower(key)
+	for _, p := range strip {
+		p = strings.ToLower(p)
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == p {
+			return true
+		}
+	}
+	return false
+}
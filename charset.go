@@ -0,0 +1,84 @@
+package project02
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// xmlDeclRe matches the encoding of an XML declaration.
+var xmlDeclRe = regexp.MustCompile(`^<\?xml[^>]*\sencoding=["']([A-Za-z0-9._:-]+)["']`)
+
+// metaCharsetRe matches a <meta> tag that declares a charset, either as
+// <meta charset> or <meta http-equiv content="...; charset=...">.
+var metaCharsetRe = regexp.MustCompile(`(?i)<meta[^>]+charset`)
+
+// ToUTF8 transcodes body to UTF-8. The encoding is taken from a byte order
+// mark, the charset parameter of contentType, an XML declaration, or a
+// <meta charset> in the first KB of the document, in that order. When
+// nothing declares one, a body that is valid UTF-8 is taken as UTF-8 and
+// anything else as windows-1252, as browsers do. JSON is always UTF-8
+// (RFC 8259) and is returned untouched. It returns the converted bytes and
+// the name of the detected encoding.
+func ToUTF8(body []byte, contentType string) ([]byte, string) {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil && isJSONType(mt) {
+		return body, "utf-8"
+	}
+	enc, name, certain := charset.DetermineEncoding(body, contentType)
+	if !certain {
+		if m := xmlDeclRe.FindSubmatch(body); m != nil {
+			if e, n := charset.Lookup(string(m[1])); e != nil {
+				enc, name = e, n
+			}
+		} else if !metaCharsetRe.Match(body[:min(len(body), 1024)]) && utf8.Valid(body) {
+			name = "utf-8"
+		}
+	}
+	if name == "utf-8" {
+		return bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")), name
+	}
+	out, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return body, name
+	}
+	return out, name
+}
+
+// isTextual reports whether a Content-Type names a text format whose
+// charset can be transcoded: text/*, XML and JSON types. Binary formats
+// (gzip, images) must be left alone.
+func isTextual(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "text/") ||
+		mt == "application/xml" || strings.HasSuffix(mt, "+xml") ||
+		isJSONType(mt)
+}
+
+// isJSONType reports whether the media type mt is JSON.
+func isJSONType(mt string) bool {
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// newXMLDecoder returns a decoder for body that accepts any declared
+// encoding. A body that is already valid UTF-8, as Download returns it, is
+// read as is whatever its declaration says; others are decoded by it.
+func newXMLDecoder(body []byte) *xml.Decoder {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	valid := utf8.Valid(body)
+	dec.CharsetReader = func(label string, r io.Reader) (io.Reader, error) {
+		if valid {
+			return r, nil
+		}
+		return charset.NewReaderLabel(label, r)
+	}
+	return dec
+}
@@ -0,0 +1,156 @@
+package project02
+
+import (
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// clickEvent marks click lines in a query log; search lines have no event.
+const clickEvent = "click"
+
+// Click-through rates are smoothed towards ctrPrior as if every (query, URL)
+// pair had been shown ctrPriorWeight extra times, so a single click on a
+// rare query does not outrank an established answer.
+const (
+	ctrPrior       = 0.05
+	ctrPriorWeight = 10
+)
+
+// clickWindow is how long repeated clicks by one client on the same result
+// of the same query count as one, so a client cannot inflate a CTR.
+const clickWindow = 30 * time.Minute
+
+// ClickEvent is one result followed from a search, recorded by /click.
+type ClickEvent struct {
+	Event      string    `json:"event"` // always "click"
+	Time       time.Time `json:"time"`
+	Query      string    `json:"query"` // NormalizeQuery form
+	URL        string    `json:"url"`
+	Pos        int       `json:"pos,omitempty"` // 1-based rank of the clicked hit
+	Collection string    `json:"collection,omitempty"`
+	Client     string    `json:"client"`
+}
+
+// RecordClick adds c to the log like Record. A click by the same client on
+// the same URL for the same query within clickWindow of one already counted
+// is dropped. A nil log records nothing.
+func (l *QueryLog) RecordClick(c ClickEvent) error {
+	if l == nil {
+		return nil
+	}
+	c.Event = clickEvent
+	l.mu.Lock()
+	if !l.firstClick(c) {
+		l.mu.Unlock()
+		return nil
+	}
+	l.addClick(c)
+	l.mu.Unlock()
+	return l.write(c)
+}
+
+// firstClick reports whether c is the first click of its client on its
+// result within clickWindow, and remembers it if so. Expired entries are
+// swept once there are as many as the clicks kept in memory.
+func (l *QueryLog) firstClick(c ClickEvent) bool {
+	k := ctrKey(c.Collection, c.Client, c.Query, c.URL)
+	if t, ok := l.lastClick[k]; ok && c.Time.Sub(t) < clickWindow {
+		return false
+	}
+	if len(l.lastClick) >= l.clicks.max {
+		for k, t := range l.lastClick {
+			if c.Time.Sub(t) >= clickWindow {
+				delete(l.lastClick, k)
+			}
+		}
+	}
+	l.lastClick[k] = c.Time
+	return true
+}
+
+func (l *QueryLog) addClick(c ClickEvent) {
+	l.clicked[ctrKey(c.Collection, c.Query, c.URL)]++
+	if old, ok := l.clicks.push(c); ok {
+		decrement(l.clicked, ctrKey(old.Collection, old.Query, old.URL))
+	}
+}
+
+// Clicks returns the clicks kept in memory, oldest first.
+func (l *QueryLog) Clicks() []ClickEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clicks.all()
+}
+
+// CTR returns the smoothed click-through rate of url for query (in
+// NormalizeQuery form) over the searches and clicks in memory. Every search
+// of the query counts as an impression of url; position is not corrected.
+func (l *QueryLog) CTR(collection, query, url string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ctr(collection, query, url)
+}
+
+func (l *QueryLog) ctr(collection, query, url string) float64 {
+	clicks := float64(l.clicked[ctrKey(collection, query, url)])
+	shown := math.Max(float64(l.searches[ctrKey(collection, query)]), clicks)
+	return (clicks + ctrPriorWeight*ctrPrior) / (shown + ctrPriorWeight)
+}
+
+// BlendClicks mixes click-through rates into hit scores, like BlendPageRank:
+// scores are scaled to [0,1] by their maximum and combined as
+// (1-weight)*tfidf + weight*ctr. When every score is 0 (a term found in all
+// documents) the CTR alone orders the hits. Hits are re-sorted; weight <= 0
+// or a nil log leaves them as is.
+func (l *QueryLog) BlendClicks(collection, query string, hits []Hit, weight float64) []Hit {
+	if l == nil || weight <= 0 || len(hits) == 0 {
+		return hits
+	}
+	var maxScore float64
+	for _, h := range hits {
+		maxScore = math.Max(maxScore, h.Score)
+	}
+	l.mu.Lock()
+	out := make([]Hit, len(hits))
+	for i, h := range hits {
+		var text float64
+		if maxScore > 0 {
+			text = h.Score / maxScore
+		}
+		out[i] = Hit{
+			URL:   h.URL,
+			Score: (1-weight)*text + weight*l.ctr(collection, query, h.URL),
+		}
+	}
+	l.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		return lessHit(out[i], out[j])
+	})
+	return out
+}
+
+// ReadClicks parses the clicks of the JSON lines written by a QueryLog.
+func ReadClicks(r io.Reader) ([]ClickEvent, error) {
+	var out []ClickEvent
+	err := scanLog(r, nil, func(c ClickEvent) { out = append(out, c) })
+	return out, err
+}
+
+// LoadClicks reads the clicks of a query log file; see ReadClicks.
+func LoadClicks(path string) ([]ClickEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadClicks(f)
+}
+
+// ctrKey joins collection, query and optionally URL into a count key.
+func ctrKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
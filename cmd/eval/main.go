@@ -0,0 +1,131 @@
+// Command eval scores search quality offline against judged queries.
+//
+//	go run ./cmd/eval -dir top10 -queries queries.txt -qrels qrels.txt
+//	go run ./cmd/eval -dir top10 -queries queries.txt -qrels qrels.txt -a inmem -b sqlite
+//
+// A configuration is a backend (inmem, sqlite or sqlitev2), optionally
+// followed by ":path" to a stopword file, e.g. "inmem:stop.txt", or to a
+// directory of per-language lists named <lang>.txt, e.g. "inmem:stopwords/".
+// With -b, the two configurations are compared instead of reported.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"project02"
+)
+
+func main() {
+	dir := flag.String("dir", "top10", "corpus directory; documents are keyed by relative path")
+	queriesPath := flag.String("queries", "", `query file, one "qid query text" per line`)
+	qrelsPath := flag.String("qrels", "", `TREC qrels file, "qid 0 docpath grade" per line`)
+	k := flag.Int("k", 10, "rank cutoff for P@k, R@k and nDCG@k")
+	a := flag.String("a", "inmem", "configuration to evaluate")
+	b := flag.String("b", "", "second configuration to compare against -a")
+	flag.Parse()
+
+	if *queriesPath == "" || *qrelsPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*dir, *queriesPath, *qrelsPath, *k, *a, *b); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run evaluates configuration a, or compares it with b, and writes the
+// report to stdout. It returns errors rather than exiting so the temporary
+// databases are always removed.
+func run(dir, queriesPath, qrelsPath string, k int, a, b string) error {
+	queries, err := project02.LoadQueries(queriesPath)
+	if err != nil {
+		return err
+	}
+	qrels, err := project02.LoadQrels(qrelsPath)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp("", "eval")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	runs := 0
+	evaluate := func(conf string) (project02.EvalReport, error) {
+		runs++
+		idx, err := openIndex(conf, filepath.Join(tmp, fmt.Sprintf("run%d.db", runs)))
+		if err != nil {
+			return project02.EvalReport{}, fmt.Errorf("%s: %v", conf, err)
+		}
+		defer idx.Close()
+		n, err := project02.IndexDir(idx, dir, project02.ExtractOptions{})
+		if err != nil {
+			return project02.EvalReport{}, fmt.Errorf("%s: %v", conf, err)
+		}
+		log.Printf("%s: indexed %d files from %s", conf, n, dir)
+		return project02.Evaluate(idx, queries, qrels, k), nil
+	}
+
+	ra, err := evaluate(a)
+	if err != nil {
+		return err
+	}
+	if b == "" {
+		return project02.WriteReport(os.Stdout, ra)
+	}
+	rb, err := evaluate(b)
+	if err != nil {
+		return err
+	}
+	return project02.WriteDiff(os.Stdout, a, ra, b, rb)
+}
+
+// openIndex builds the indexer described by conf ("backend[:stopwords]").
+// stopwords is either a file replacing the default list or a directory of
+// <lang>.txt files, one list per language.
+func openIndex(conf, dbPath string) (project02.Indexer, error) {
+	backend, stopPath, _ := strings.Cut(conf, ":")
+	var stop map[string]struct{}
+	stopDir := ""
+	if stopPath != "" {
+		fi, err := os.Stat(stopPath)
+		switch {
+		case err != nil:
+			return nil, err
+		case fi.IsDir():
+			stopDir = stopPath
+		default:
+			if stop, err = project02.LoadStopwords(stopPath); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var idx project02.Indexer
+	var err error
+	switch backend {
+	case "inmem":
+		idx = project02.NewInMemIndex(stop)
+	case "sqlite":
+		idx, err = project02.NewSQLiteIndex(dbPath, stop)
+	case "sqlitev2":
+		idx, err = project02.NewSQLiteIndexV2(dbPath, stop)
+	default:
+		return nil, fmt.Errorf("unknown backend %q (want inmem, sqlite or sqlitev2)", backend)
+	}
+	if err != nil || stopDir == "" {
+		return idx, err
+	}
+	langs, err := project02.ApplyStopwordsDir(idx, stopDir)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	log.Printf("%s: stopwords for %s from %s", conf, strings.Join(langs, ", "), stopDir)
+	return idx, nil
+}
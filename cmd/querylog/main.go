@@ -0,0 +1,43 @@
+// Command querylog reports the top, zero-result and slowest queries of a
+// query log written by a server using WithQueryLog.
+//
+//	go run ./cmd/querylog -log queries.jsonl
+//	go run ./cmd/querylog -log queries.jsonl -n 50 -collection docs
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"project02"
+)
+
+func main() {
+	path := flag.String("log", "", "query log file, one JSON event per line")
+	n := flag.Int("n", 20, "entries per list")
+	collection := flag.String("collection", "", `only report searches of this collection ("" is the default index)`)
+	all := flag.Bool("all", false, "report every collection together")
+	flag.Parse()
+
+	if *path == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	events, err := project02.LoadQueryLog(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*all {
+		kept := events[:0]
+		for _, e := range events {
+			if e.Collection == *collection {
+				kept = append(kept, e)
+			}
+		}
+		events = kept
+	}
+	if err := project02.WriteQueryReport(os.Stdout, project02.AnalyzeQueries(events, *n)); err != nil {
+		log.Fatal(err)
+	}
+}
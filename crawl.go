@@ -1,14 +1,145 @@
 package project02
 
 import (
+	"context"
+	"mime"
+	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
+// Reasons a fetched page is not indexed, as counted in CrawlStats.Skipped.
+const (
+	SkipNoIndex     = "noindex"      // meta robots or X-Robots-Tag noindex
+	SkipDuplicate   = "duplicate"    // near-duplicate dropped by the Deduper
+	SkipUnchanged   = "unchanged"    // sitemap lastmod not newer than LastCrawled
+	SkipUnsupported = "unsupported"  // no extractor for the Content-Type
+	SkipCanonical   = "canonical"    // rel=canonical names another URL, which is queued
+	SkipUnparsable  = "unparsable"   // the extractor could not parse the body
+	SkipWriteFailed = "write_failed" // the indexer failed to store the page
+	SkipOffHost     = "off_host"     // feed item linking outside the crawled host
+)
+
+// CrawlStats counts what a crawl did.
+type CrawlStats struct {
+	Fetched int            `json:"fetched"` // pages downloaded successfully
+	Failed  int            `json:"failed"`  // pages whose download failed
+	Indexed int            `json:"indexed"` // pages handed to the Indexer
+	Skipped map[string]int `json:"skipped"` // pages not fetched or not indexed, by reason
+	Bytes   int64          `json:"bytes"`   // response body bytes downloaded
+
+	NoFollowPages int `json:"nofollow_pages"` // pages whose links were not followed (meta/header nofollow)
+	NoFollowLinks int `json:"nofollow_links"` // links not followed because of rel=nofollow or rel=ugc
+}
+
+func (st *CrawlStats) skip(reason string) {
+	if st.Skipped == nil {
+		st.Skipped = make(map[string]int)
+	}
+	st.Skipped[reason]++
+}
+
+// CrawlConfig customises CrawlWith. The zero value of every optional field
+// keeps the behaviour of Crawl.
+type CrawlConfig struct {
+	Max int // maximum number of pages to visit
+
+	// Indexer, when set, receives every successfully fetched page.
+	Indexer Indexer
+
+	// Graph, when set, records every same-host link as an Edge.
+	Graph GraphIndexer
+
+	// Dedup, when set, decides whether near-duplicate pages are indexed.
+	// Their links are followed either way.
+	Dedup *Deduper
+
+	// Canonical overrides the URL canonicalization options used for the
+	// visited set and index keys; nil means Canonicalize's defaults.
+	Canonical *CanonicalOptions
+
+	// Sitemaps also crawls the URLs listed in the site's sitemaps (see
+	// FetchSitemaps), taking them in turn with links found on pages.
+	Sitemaps bool
+
+	// LastCrawled holds when each canonical URL was last fetched. Sitemap
+	// entries whose lastmod is not newer are treated as unchanged and are
+	// not fetched again. When non-nil it is updated with the time of every
+	// successful fetch, so it can be kept for the next crawl.
+	LastCrawled map[string]time.Time
+
+	// Stats, when set, is filled in with counters as the crawl proceeds.
+	Stats *CrawlStats
+
+	// Extract selects the extraction mode for fetched pages, e.g. to drop
+	// boilerplate.
+	Extract ExtractOptions
+
+	// Extractors picks the extractor for each response by Content-Type;
+	// nil means DefaultExtractors.
+	Extractors *ExtractorRegistry
+
+	// Metrics, when set, accumulates the crawl counters across crawls so
+	// they can be served at /metrics while a crawl runs.
+	Metrics *Metrics
+
+	// Progress, when set, is called after each visited page with the
+	// download error, if any, and the counters so far. It runs on the
+	// crawling goroutine; st.Skipped must be copied to be kept.
+	Progress func(url string, err error, st CrawlStats)
+}
+
 func Crawl(start string, max int) ([]string, error) {
+	return CrawlWith(start, CrawlConfig{Max: max})
+}
+
+// CrawlWith crawls breadth-first from start, staying on the start host,
+// and returns the visited URLs in visit order. URLs are canonicalized
+// before they are compared. A page whose <link rel=canonical> names another
+// URL on the host is not indexed; that URL is queued instead and its links
+// are recorded as the canonical URL's. Robots directives from
+// <meta name="robots"> and X-Robots-Tag are honoured: noindex pages are
+// crawled for links but not indexed, and nofollow pages or links
+// (rel=nofollow, rel=ugc) are not followed. Non-HTML responses go through
+// the extractor registered for their Content-Type. Feed items on the host
+// are indexed from the feed under their item URL, and that URL is queued so
+// the item page, once fetched, replaces the feed version; items whose page
+// was already fetched are left alone, and off-host items are skipped.
+func CrawlWith(start string, cfg CrawlConfig) ([]string, error) {
+	return CrawlWithContext(context.Background(), start, cfg)
+}
+
+// CrawlWithContext is CrawlWith that stops once ctx is done: downloads in
+// flight are abandoned and the URLs visited so far are returned with ctx's
+// error.
+func CrawlWithContext(ctx context.Context, start string, cfg CrawlConfig) ([]string, error) {
+	max := cfg.Max
 	if max <= 0 {
 		return []string{}, nil
 	}
+	st := cfg.Stats
+	if st == nil {
+		st = &CrawlStats{}
+	}
+	canon := Canonicalize
+	if cfg.Canonical != nil {
+		canon = func(u string) string { return CanonicalizeWith(u, *cfg.Canonical) }
+	}
+	start = canon(start)
+	reg := cfg.Extractors
+	if reg == nil {
+		reg = DefaultExtractors()
+	}
+	skip := func(reason string) {
+		st.skip(reason)
+		cfg.Metrics.crawlSkipped(reason)
+	}
+	progress := func(u string, err error) {
+		if cfg.Progress != nil {
+			cfg.Progress(u, err, *st)
+		}
+	}
 
 	startURL, err := url.Parse(start)
 	if err != nil {
@@ -19,12 +150,36 @@ func Crawl(start string, max int) ([]string, error) {
 
 	visited := make(map[string]bool)
 	queue := []string{start}
+	var listed []string // sitemap URLs, alternated with queue
 	order := make([]string, 0, max)
+	fromFeed := make(map[string]bool) // URLs indexed from a feed item, not their page
+
+	if cfg.Sitemaps {
+		for _, e := range fetchSitemaps(ctx, hostBase) {
+			u := canon(e.Loc)
+			if !strings.HasPrefix(u, hostBase) {
+				continue
+			}
+			if last, ok := cfg.LastCrawled[u]; ok && !e.LastMod.IsZero() && !e.LastMod.After(last) {
+				visited[u] = true
+				skip(SkipUnchanged)
+				continue
+			}
+			listed = append(listed, u)
+		}
+	}
 
-	for len(queue) > 0 && len(order) < max {
-		// FIFO queue → BFS
-		cur := queue[0]
-		queue = queue[1:]
+	for (len(queue) > 0 || len(listed) > 0) && len(order) < max {
+		if err := ctx.Err(); err != nil {
+			return order, err
+		}
+		// FIFO queue → BFS, every other page taken from the sitemaps
+		var cur string
+		if len(listed) > 0 && (len(queue) == 0 || len(order)%2 == 1) {
+			cur, listed = listed[0], listed[1:]
+		} else {
+			cur, queue = queue[0], queue[1:]
+		}
 
 		if visited[cur] {
 			continue
@@ -33,29 +188,131 @@ func Crawl(start string, max int) ([]string, error) {
 		order = append(order, cur)
 
 		// Download the current page
-		body, err := Download(cur)
+		body, header, err := DownloadWithHeaderContext(ctx, cur)
+		if err != nil && ctx.Err() != nil {
+			return order, ctx.Err()
+		}
 		if err != nil {
 			// Skip transient errors; keep crawling the rest
+			st.Failed++
+			cfg.Metrics.crawlFailed()
+			progress(cur, err)
 			continue
 		}
+		if cfg.LastCrawled != nil {
+			cfg.LastCrawled[cur] = time.Now()
+		}
+		st.Fetched++
+		st.Bytes += int64(len(body))
+		cfg.Metrics.crawlFetched(len(body))
 
 		// Extract words/links from the page
-		_, hrefs := Extract(body)
-		for _, h := range hrefs {
-
-			abs := CleanHref(cur, h)
-			if abs == "" {
-				continue
+		ct := header.Get("Content-Type")
+		if strings.TrimSpace(ct) == "" {
+			ct = http.DetectContentType(body)
+		}
+		ex := reg.For(ct, body)
+		if ex == nil {
+			skip(SkipUnsupported)
+			progress(cur, nil)
+			continue
+		}
+		mt, _, _ := mime.ParseMediaType(ct)
+		docs := ex.Extract(cur, body, cfg.Extract)
+		if docs == nil {
+			skip(SkipUnparsable)
+		}
+		for _, doc := range docs {
+			doc.Meta.ContentType = mt
+			for _, v := range header.Values("X-Robots-Tag") {
+				ni, nf := ParseRobots(v)
+				doc.NoIndex = doc.NoIndex || ni
+				doc.NoFollow = doc.NoFollow || nf
 			}
-
-			if !strings.HasPrefix(abs, hostBase) {
+			key := cur
+			item := doc.URL != ""
+			if item {
+				key = canon(CleanHref(cur, doc.URL))
+				if strings.HasPrefix(key, hostBase) && !doc.NoFollow {
+					if cfg.Graph != nil {
+						cfg.Graph.AddEdge(Edge{Source: cur, Target: key})
+					}
+					if !visited[key] {
+						queue = append(queue, key)
+					}
+				}
+			}
+			alias := false
+			if doc.Canonical != "" {
+				if c := canon(CleanHref(cur, doc.Canonical)); c != "" && c != key && strings.HasPrefix(c, hostBase) {
+					key, alias = c, true
+					if !visited[c] {
+						queue = append(queue, c)
+					}
+				}
+			}
+			switch {
+			case item && !strings.HasPrefix(key, hostBase):
+				skip(SkipOffHost)
+			case item && visited[key]:
+				// Its own page was fetched and indexed already.
+			case doc.NoIndex:
+				skip(SkipNoIndex)
+			case alias:
+				skip(SkipCanonical)
+			case cfg.Indexer != nil:
+				if ok, _ := cfg.Dedup.Observe(key, doc.Words); ok {
+					var err error
+					replace := fromFeed[key] && !item
+					if replace {
+						_, err = ReplaceDocument(cfg.Indexer, key, doc)
+						delete(fromFeed, key)
+					} else {
+						err = IndexDocument(cfg.Indexer, key, doc)
+					}
+					if err != nil {
+						skip(SkipWriteFailed)
+					} else {
+						if item {
+							fromFeed[key] = true
+						}
+						if !replace {
+							st.Indexed++
+							cfg.Metrics.crawlIndexed()
+						}
+					}
+				} else {
+					skip(SkipDuplicate)
+				}
+			}
+			if doc.NoFollow {
+				st.NoFollowPages++
 				continue
 			}
+			for _, l := range doc.Links {
+				if l.NoFollow() {
+					st.NoFollowLinks++
+					continue
+				}
+
+				abs := canon(CleanHref(cur, l.Href))
+				if abs == "" {
+					continue
+				}
+
+				if !strings.HasPrefix(abs, hostBase) {
+					continue
+				}
+				if cfg.Graph != nil {
+					cfg.Graph.AddEdge(Edge{Source: key, Target: abs, Anchor: l.Text})
+				}
 
-			if !visited[abs] {
-				queue = append(queue, abs)
+				if !visited[abs] {
+					queue = append(queue, abs)
+				}
 			}
 		}
+		progress(cur, nil)
 	}
 	return order, nil
 }
@@ -0,0 +1,377 @@
+package project02
+
+import (
+	"database/sql"
+	"hash/fnv"
+	"math/bits"
+	"slices"
+	"sync"
+)
+
+// DedupMode selects what happens to a page whose content is a near-duplicate
+// of a page seen earlier.
+type DedupMode int
+
+const (
+	// DedupOff indexes every page.
+	DedupOff DedupMode = iota
+	// DedupSkip drops near-duplicates without recording them.
+	DedupSkip
+	// DedupMerge drops near-duplicates from the index but records their URL
+	// in the group of the first page seen with that content.
+	DedupMerge
+	// DedupCluster indexes near-duplicates and groups them, so search
+	// results can be collapsed to one hit per group.
+	DedupCluster
+)
+
+// SimHash returns a 64-bit SimHash fingerprint of a token stream. Pages with
+// similar token distributions get fingerprints with a small Hamming distance.
+func SimHash(words []string) uint64 {
+	var v [64]int
+	for _, w := range words {
+		h := fnv.New64a()
+		h.Write([]byte(w))
+		x := h.Sum64()
+		for i := 0; i < 64; i++ {
+			if x&(1<<uint(i)) != 0 {
+				v[i]++
+			} else {
+				v[i]--
+			}
+		}
+	}
+	var fp uint64
+	for i := 0; i < 64; i++ {
+		if v[i] > 0 {
+			fp |= 1 << uint(i)
+		}
+	}
+	return fp
+}
+
+// Deduper detects near-duplicate pages by SimHash and tracks duplicate groups.
+// Each group is keyed by its canonical URL, the first page seen with the content.
+type Deduper struct {
+	Mode DedupMode
+	// Threshold is the largest Hamming distance between two fingerprints
+	// that still counts as a near-duplicate. It must not change once pages
+	// have been observed.
+	Threshold int
+
+	mu        sync.Mutex
+	canonical []string          // canonical URLs in first-seen order
+	fps       map[string]uint64 // canonical URL -> fingerprint
+	groupOf   map[string]string // any grouped URL -> canonical URL
+	members   map[string][]string
+	store     DedupIndexer // nil keeps groups in memory only
+
+	// Fingerprints within Threshold of each other agree on at least one of
+	// Threshold+1 bands, so only pages sharing a band value are compared.
+	bands []map[uint64][]int // band value -> indexes into canonical
+}
+
+// DedupRecord is one page a Deduper made canonical or grouped.
+type DedupRecord struct {
+	URL       string
+	Canonical string // URL itself for a canonical page
+	FP        uint64 // fingerprint of a canonical page
+}
+
+// DedupIndexer is implemented by indexers that store duplicate groups, so
+// they survive restarts.
+type DedupIndexer interface {
+	// AddDedup stores r; a URL already stored is ignored.
+	AddDedup(r DedupRecord)
+
+	// DedupRecords returns the stored records in the order they were added.
+	DedupRecords() []DedupRecord
+}
+
+// DedupDeleteIndexer is implemented by DedupIndexers that can drop a URL
+// from the stored groups.
+type DedupDeleteIndexer interface {
+	// DeleteDedup removes url's record. When url is canonical, its earliest
+	// member becomes the canonical page and takes over its fingerprint.
+	DeleteDedup(url string)
+}
+
+// NewDeduper creates a Deduper with the given mode and Hamming threshold
+// (3 is a common choice for 64-bit SimHash).
+func NewDeduper(mode DedupMode, threshold int) *Deduper {
+	return &Deduper{
+		Mode:      mode,
+		Threshold: threshold,
+		fps:       make(map[string]uint64),
+		groupOf:   make(map[string]string),
+		members:   make(map[string][]string),
+	}
+}
+
+// Persist loads the groups stored in s and stores the ones observed from
+// now on there. Call it before the first Observe.
+func (d *Deduper) Persist(s DedupIndexer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range s.DedupRecords() {
+		if r.Canonical == r.URL {
+			d.addCanonical(r.URL, r.FP)
+		} else {
+			d.join(r.URL, r.Canonical)
+		}
+	}
+	d.store = s
+}
+
+// Observe fingerprints the page at url and reports whether it should be
+// indexed under the current mode, along with its group's canonical URL.
+// Pages without words are always indexed and never grouped, as they would
+// all share the same fingerprint.
+func (d *Deduper) Observe(url string, words []string) (index bool, canonical string) {
+	if d == nil || d.Mode == DedupOff || len(words) == 0 {
+		return true, url
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if c, ok := d.groupOf[url]; ok {
+		return c == url, c
+	}
+	fp := SimHash(words)
+	if c, ok := d.find(fp); ok {
+		switch d.Mode {
+		case DedupSkip:
+			return false, c
+		case DedupMerge:
+			d.join(url, c)
+			d.save(DedupRecord{URL: url, Canonical: c})
+			return false, c
+		default: // DedupCluster
+			d.join(url, c)
+			d.save(DedupRecord{URL: url, Canonical: c})
+			return true, c
+		}
+	}
+	d.addCanonical(url, fp)
+	d.save(DedupRecord{URL: url, Canonical: url, FP: fp})
+	return true, url
+}
+
+// Forget removes url from its duplicate group, as when its document is
+// deleted, so Group, Groups and Collapse no longer report it. When url is
+// a group's canonical page, its earliest member takes its place.
+func (d *Deduper) Forget(url string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.groupOf[url]
+	if !ok {
+		return
+	}
+	delete(d.groupOf, url)
+	if c != url {
+		d.members[c] = slices.DeleteFunc(d.members[c], func(m string) bool { return m == url })
+		if len(d.members[c]) == 0 {
+			delete(d.members, c)
+		}
+	} else {
+		next := "" // an empty slot in canonical never matches
+		if ms := d.members[url]; len(ms) > 0 {
+			next = ms[0]
+			d.fps[next] = d.fps[url]
+			d.groupOf[next] = next
+			for _, m := range ms[1:] {
+				d.groupOf[m] = next
+			}
+			if len(ms) > 1 {
+				d.members[next] = ms[1:]
+			}
+		}
+		delete(d.members, url)
+		delete(d.fps, url)
+		d.canonical[slices.Index(d.canonical, url)] = next
+	}
+	if s, ok := d.store.(DedupDeleteIndexer); ok {
+		s.DeleteDedup(url)
+	}
+}
+
+// find returns the first-seen canonical URL within Threshold of fp.
+func (d *Deduper) find(fp uint64) (string, bool) {
+	best := -1
+	for i, band := range d.bandTables() {
+		for _, j := range band[bandOf(fp, i, len(d.bands))] {
+			if (best < 0 || j < best) && d.canonical[j] != "" && bits.OnesCount64(fp^d.fps[d.canonical[j]]) <= d.Threshold {
+				best = j
+			}
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return d.canonical[best], true
+}
+
+func (d *Deduper) addCanonical(url string, fp uint64) {
+	for i, band := range d.bandTables() {
+		b := bandOf(fp, i, len(d.bands))
+		band[b] = append(band[b], len(d.canonical))
+	}
+	d.canonical = append(d.canonical, url)
+	d.fps[url] = fp
+	d.groupOf[url] = url
+}
+
+// bandTables returns the band lookup tables, creating Threshold+1 of them
+// (between 1 and 64) on first use.
+func (d *Deduper) bandTables() []map[uint64][]int {
+	if d.bands == nil {
+		d.bands = make([]map[uint64][]int, min(max(d.Threshold+1, 1), 64))
+		for i := range d.bands {
+			d.bands[i] = make(map[uint64][]int)
+		}
+	}
+	return d.bands
+}
+
+// bandOf returns band i of fp split into n bands; the last band takes the
+// bits left over.
+func bandOf(fp uint64, i, n int) uint64 {
+	w := 64 / n
+	if i == n-1 {
+		return fp >> (i * w)
+	}
+	return fp >> (i * w) & (1<<w - 1)
+}
+
+func (d *Deduper) join(url, canonical string) {
+	d.groupOf[url] = canonical
+	d.members[canonical] = append(d.members[canonical], url)
+}
+
+func (d *Deduper) save(r DedupRecord) {
+	if d.store != nil {
+		d.store.AddDedup(r)
+	}
+}
+
+// Group returns the canonical URL of url's group followed by the other
+// members, or nil if url has no duplicates.
+func (d *Deduper) Group(url string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.groupOf[url]
+	if !ok || len(d.members[c]) == 0 {
+		return nil
+	}
+	return append([]string{c}, d.members[c]...)
+}
+
+// Groups returns every group with at least one duplicate, keyed by canonical URL.
+func (d *Deduper) Groups() map[string][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string][]string, len(d.members))
+	for c, m := range d.members {
+		out[c] = append([]string(nil), m...)
+	}
+	return out
+}
+
+// Collapse keeps only the best-ranked hit of each duplicate group.
+// hits must already be sorted; the order of the survivors is preserved.
+func (d *Deduper) Collapse(hits []Hit) []Hit {
+	if d == nil {
+		return hits
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seen := make(map[string]bool)
+	out := make([]Hit, 0, len(hits))
+	for _, h := range hits {
+		key := h.URL
+		if c, ok := d.groupOf[h.URL]; ok {
+			key = c
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, h)
+	}
+	return out
+}
+
+// createDedupTables creates the duplicate group table shared by the SQLite indexers.
+func createDedupTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS dedup (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL UNIQUE,
+			canonical TEXT NOT NULL,
+			fp INTEGER NOT NULL DEFAULT 0
+		);
+	`)
+	return err
+}
+
+func sqlAddDedup(db *sql.DB, r DedupRecord) {
+	// SQLite integers are signed; the fingerprint's bits are kept as is.
+	_, _ = db.Exec("INSERT OR IGNORE INTO dedup (url, canonical, fp) VALUES (?, ?, ?)",
+		r.URL, r.Canonical, int64(r.FP))
+}
+
+func sqlDedupRecords(db *sql.DB) []DedupRecord {
+	rows, err := db.Query("SELECT url, canonical, fp FROM dedup ORDER BY seq")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var out []DedupRecord
+	for rows.Next() {
+		var r DedupRecord
+		var fp int64
+		if err := rows.Scan(&r.URL, &r.Canonical, &fp); err != nil {
+			continue
+		}
+		r.FP = uint64(fp)
+		out = append(out, r)
+	}
+	return out
+}
+
+// sqlDeleteDedup removes url's record and, when url was canonical, makes
+// its earliest member canonical with url's fingerprint, as Forget does.
+func sqlDeleteDedup(db *sql.DB, url string) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	var canonical string
+	var fp int64
+	if err := tx.QueryRow("SELECT canonical, fp FROM dedup WHERE url = ?", url).Scan(&canonical, &fp); err != nil {
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM dedup WHERE url = ?", url); err != nil {
+		return
+	}
+	if canonical == url {
+		var next string
+		err := tx.QueryRow("SELECT url FROM dedup WHERE canonical = ? ORDER BY seq LIMIT 1", url).Scan(&next)
+		if err == nil {
+			if _, err := tx.Exec("UPDATE dedup SET canonical = ? WHERE canonical = ?", next, url); err != nil {
+				return
+			}
+			if _, err := tx.Exec("UPDATE dedup SET fp = ? WHERE url = ?", fp, next); err != nil {
+				return
+			}
+		} else if err != sql.ErrNoRows {
+			return
+		}
+	}
+	tx.Commit()
+}
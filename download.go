@@ -1,21 +1,47 @@
 package project02
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
 )
 
 func Download(u string) ([]byte, error) {
-	resp, err := http.Get(u)
+	b, _, err := DownloadWithHeader(u)
+	return b, err
+}
+
+// DownloadWithHeader is Download that also returns the response headers,
+// e.g. for Content-Type or X-Robots-Tag. Text responses are transcoded to
+// UTF-8 (see ToUTF8); other content is returned as is.
+func DownloadWithHeader(u string) ([]byte, http.Header, error) {
+	return DownloadWithHeaderContext(context.Background(), u)
+}
+
+// DownloadWithHeaderContext is DownloadWithHeader that abandons the
+// request once ctx is done.
+func DownloadWithHeaderContext(ctx context.Context, u string) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
+		return nil, nil, errors.New(resp.Status)
 	}
 
-	return io.ReadAll(resp.Body)
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ct := resp.Header.Get("Content-Type"); isTextual(ct) {
+		b, _ = ToUTF8(b, ct)
+	}
+	return b, resp.Header, nil
 }
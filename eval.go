@@ -0,0 +1,307 @@
+package project02
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Qrels holds graded relevance judgments: query ID -> document -> grade.
+// Grades above zero are relevant.
+type Qrels map[string]map[string]int
+
+// EvalQuery is one judged query.
+type EvalQuery struct {
+	ID   string
+	Text string
+}
+
+// ParseQrels reads TREC qrels lines ("qid iter docno grade"). Blank lines
+// and lines starting with '#' are skipped.
+func ParseQrels(r io.Reader) (Qrels, error) {
+	q := make(Qrels)
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if len(f) != 4 {
+			return nil, fmt.Errorf("qrels line %d: want 4 fields, got %d", line, len(f))
+		}
+		grade, err := strconv.Atoi(f[3])
+		if err != nil {
+			return nil, fmt.Errorf("qrels line %d: %v", line, err)
+		}
+		if q[f[0]] == nil {
+			q[f[0]] = make(map[string]int)
+		}
+		q[f[0]][f[2]] = grade
+	}
+	return q, sc.Err()
+}
+
+// ParseQueries reads "qid query text" lines. Blank lines and lines starting
+// with '#' are skipped.
+func ParseQueries(r io.Reader) ([]EvalQuery, error) {
+	var out []EvalQuery
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		i := strings.IndexAny(s, " \t")
+		if i < 0 || strings.TrimSpace(s[i+1:]) == "" {
+			return nil, fmt.Errorf("queries line %d: want \"qid query\"", line)
+		}
+		id, text := s[:i], s[i+1:]
+		out = append(out, EvalQuery{ID: id, Text: strings.TrimSpace(text)})
+	}
+	return out, sc.Err()
+}
+
+// LoadQrels reads a qrels file; see ParseQrels.
+func LoadQrels(path string) (Qrels, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseQrels(f)
+}
+
+// LoadQueries reads a query file; see ParseQueries.
+func LoadQueries(path string) ([]EvalQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseQueries(f)
+}
+
+// IndexDir indexes every file under dir that DefaultExtractors supports,
+// choosing the extractor by file extension. Documents are keyed by their
+// slash-separated path relative to dir ("Dracula/link2H_4.html"), which
+// is the document ID qrels should use. It returns the number of files indexed.
+func IndexDir(indexer Indexer, dir string, opts ExtractOptions) (int, error) {
+	reg := DefaultExtractors()
+	var n int
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		ct := mime.TypeByExtension(filepath.Ext(p))
+		if strings.EqualFold(filepath.Ext(p), ".md") {
+			ct = "text/markdown"
+		}
+		body, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		ex := reg.For(ct, body)
+		if ex == nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		for _, doc := range ex.Extract(key, body, opts) {
+			if doc.URL == "" {
+				IndexDocument(indexer, key, doc)
+			}
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// QueryMetrics are the scores of one query. Precision, Recall and NDCG are
+// cut off at the report's K; AP and RR use the whole ranking.
+type QueryMetrics struct {
+	ID        string
+	Precision float64
+	Recall    float64
+	AP        float64
+	RR        float64
+	NDCG      float64
+	Retrieved int // hits returned
+	Relevant  int // documents judged relevant
+}
+
+// EvalReport holds per-query metrics and their means. Queries without any
+// relevant judgment are not scored and are listed in Unjudged.
+type EvalReport struct {
+	K        int
+	Queries  []QueryMetrics
+	Mean     QueryMetrics
+	Unjudged []string
+}
+
+// Evaluate runs every query through SearchQuery on indexer and scores the
+// rankings against qrels with cutoff k.
+func Evaluate(indexer Indexer, queries []EvalQuery, qrels Qrels, k int) EvalReport {
+	return EvaluateFunc(func(q string) []Hit { return SearchQuery(indexer, q, "") }, queries, qrels, k)
+}
+
+// EvaluateFunc is Evaluate for an arbitrary search function, e.g. one that
+// blends PageRank or uses a FuzzySearcher.
+func EvaluateFunc(search func(q string) []Hit, queries []EvalQuery, qrels Qrels, k int) EvalReport {
+	if k <= 0 {
+		k = 10
+	}
+	r := EvalReport{K: k, Mean: QueryMetrics{ID: "all"}}
+	for _, q := range queries {
+		judged := qrels[q.ID]
+		m := scoreRanking(q.ID, search(q.Text), judged, k)
+		if m.Relevant == 0 {
+			r.Unjudged = append(r.Unjudged, q.ID)
+			continue
+		}
+		r.Queries = append(r.Queries, m)
+		r.Mean.Precision += m.Precision
+		r.Mean.Recall += m.Recall
+		r.Mean.AP += m.AP
+		r.Mean.RR += m.RR
+		r.Mean.NDCG += m.NDCG
+		r.Mean.Retrieved += m.Retrieved
+		r.Mean.Relevant += m.Relevant
+	}
+	if n := float64(len(r.Queries)); n > 0 {
+		r.Mean.Precision /= n
+		r.Mean.Recall /= n
+		r.Mean.AP /= n
+		r.Mean.RR /= n
+		r.Mean.NDCG /= n
+	}
+	return r
+}
+
+// scoreRanking computes the metrics of one ranking. nDCG uses the gain
+// 2^grade - 1 and a log2(rank+1) discount.
+func scoreRanking(id string, hits []Hit, judged map[string]int, k int) QueryMetrics {
+	m := QueryMetrics{ID: id, Retrieved: len(hits)}
+	var grades []int
+	for _, g := range judged {
+		if g > 0 {
+			m.Relevant++
+			grades = append(grades, g)
+		}
+	}
+	if m.Relevant == 0 {
+		return m
+	}
+
+	var found, foundAtK int
+	var dcg float64
+	for i, h := range hits {
+		g := judged[h.URL]
+		if g <= 0 {
+			continue
+		}
+		found++
+		m.AP += float64(found) / float64(i+1)
+		if m.RR == 0 {
+			m.RR = 1 / float64(i+1)
+		}
+		if i < k {
+			foundAtK++
+			dcg += (math.Pow(2, float64(g)) - 1) / math.Log2(float64(i+2))
+		}
+	}
+	m.AP /= float64(m.Relevant)
+	m.Precision = float64(foundAtK) / float64(k)
+	m.Recall = float64(foundAtK) / float64(m.Relevant)
+
+	sort.Sort(sort.Reverse(sort.IntSlice(grades)))
+	var idcg float64
+	for i, g := range grades {
+		if i == k {
+			break
+		}
+		idcg += (math.Pow(2, float64(g)) - 1) / math.Log2(float64(i+2))
+	}
+	m.NDCG = dcg / idcg
+	return m
+}
+
+// WriteReport prints r as a table, one row per query followed by the means.
+func WriteReport(w io.Writer, r EvalReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "query\tP@%d\tR@%d\tAP\tRR\tnDCG@%d\t\n", r.K, r.K, r.K)
+	rows := append(append([]QueryMetrics(nil), r.Queries...), r.Mean)
+	for _, m := range rows {
+		fmt.Fprintf(tw, "%s\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f\t\n", m.ID, m.Precision, m.Recall, m.AP, m.RR, m.NDCG)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(r.Unjudged) > 0 {
+		_, err := fmt.Fprintf(w, "unjudged queries: %s\n", strings.Join(r.Unjudged, " "))
+		return err
+	}
+	return nil
+}
+
+// WriteDiff prints the mean metrics of two runs side by side with their
+// difference (b - a), then the queries whose AP changed, largest change first.
+func WriteDiff(w io.Writer, nameA string, a EvalReport, nameB string, b EvalReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "metric\t%s\t%s\tdelta\t\n", nameA, nameB)
+	rows := []struct {
+		name string
+		a, b float64
+	}{
+		{fmt.Sprintf("P@%d", a.K), a.Mean.Precision, b.Mean.Precision},
+		{fmt.Sprintf("R@%d", a.K), a.Mean.Recall, b.Mean.Recall},
+		{"MAP", a.Mean.AP, b.Mean.AP},
+		{"MRR", a.Mean.RR, b.Mean.RR},
+		{fmt.Sprintf("nDCG@%d", a.K), a.Mean.NDCG, b.Mean.NDCG},
+	}
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%.4f\t%.4f\t%+.4f\t\n", r.name, r.a, r.b, r.b-r.a)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	apA := make(map[string]float64, len(a.Queries))
+	for _, m := range a.Queries {
+		apA[m.ID] = m.AP
+	}
+	type change struct {
+		id    string
+		delta float64
+	}
+	var changes []change
+	for _, m := range b.Queries {
+		if d := m.AP - apA[m.ID]; math.Abs(d) > 1e-9 {
+			changes = append(changes, change{m.ID, d})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if math.Abs(changes[i].delta) != math.Abs(changes[j].delta) {
+			return math.Abs(changes[i].delta) > math.Abs(changes[j].delta)
+		}
+		return changes[i].id < changes[j].id
+	})
+	for _, c := range changes {
+		if _, err := fmt.Fprintf(w, "%s\tAP %+.4f\n", c.id, c.delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
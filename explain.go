@@ -0,0 +1,158 @@
+package project02
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+)
+
+// Explanation breaks the score of one document for a query down by term
+// and field, like Lucene's explain output.
+type Explanation struct {
+	URL   string            `json:"url"`
+	Score float64           `json:"score"` // sum of the term contributions
+	Terms []TermExplanation `json:"terms"`
+	Note  string            `json:"note,omitempty"`
+}
+
+// TermExplanation is the contribution of one stem in one field. The score
+// is TF/DocLen * IDF * Boost, with IDF = ln(N/DF). The anchor field uses
+// the larger of the body and anchor DF.
+type TermExplanation struct {
+	Term   string  `json:"term"`           // query term as typed
+	Stem   string  `json:"stem,omitempty"` // stem looked up in the index
+	Field  string  `json:"field,omitempty"`
+	TF     int     `json:"tf"`     // occurrences of the stem in the field
+	DocLen int     `json:"docLen"` // tokens in the field after stop+stem
+	DF     int     `json:"df"`     // documents with the stem in the field
+	N      int     `json:"n"`      // documents in the index
+	IDF    float64 `json:"idf"`
+	Boost  float64 `json:"boost"` // field weight times any fuzzy penalty
+	Score  float64 `json:"score"`
+	Note   string  `json:"note,omitempty"`
+}
+
+// ExplainIndexer is implemented by indexers that can explain their scores.
+type ExplainIndexer interface {
+	// Explain breaks down how url scores for query with SearchQuery.
+	Explain(query, url string) Explanation
+
+	// ExplainLang is Explain for a search restricted to lang.
+	ExplainLang(query, url, lang string) Explanation
+}
+
+// stemStats are the raw counts behind the score of one stem for one document.
+type stemStats struct {
+	Indexed bool   // the document is in the index
+	Lang    string // the document's language
+	N       int    // documents in the index, read as searches read it
+
+	TF, DocLen, DF      int // body field
+	ATF, AnchorLen, ADF int // anchor field; ADF counts indexed targets only
+}
+
+// statsIndexer is what the explain helpers need from a backend.
+type statsIndexer interface {
+	Indexer
+	TermIndexer
+	PrefixIndexer
+	stemStats(stem, url string) stemStats
+}
+
+// queryStem is one stem a query term is scored with. Weight is below 1 for
+// fuzzy expansions; note says why a term contributes nothing.
+type queryStem struct {
+	term, stem string
+	weight     float64
+	note       string
+}
+
+// queryStems resolves the terms of q to stems the way SearchQuery does:
+// metadata filters are dropped, stopwords contribute nothing and wildcard
+// terms expand through PrefixTerms.
+func queryStems(idx statsIndexer, q, lang string) []queryStem {
+	q, _ = ParseFilters(q)
+	var out []queryStem
+	for _, t := range ParseQuery(q) {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			out = append(out, wildcardStems(idx, t, prefix)...)
+			continue
+		}
+		if idx.Stopword(t, lang) {
+			out = append(out, queryStem{term: t, note: "stopword"})
+			continue
+		}
+		out = append(out, queryStem{term: t, stem: stemLang(lang, strings.ToLower(t)), weight: 1})
+	}
+	return out
+}
+
+func wildcardStems(idx statsIndexer, term, prefix string) []queryStem {
+	var out []queryStem
+	if prefix != "" {
+		for _, ts := range idx.PrefixTerms(prefix, maxWildcardTerms) {
+			out = append(out, queryStem{term: term, stem: ts.Term, weight: 1})
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, queryStem{term: term, note: "no expansion"})
+	}
+	return out
+}
+
+// explainStems scores url against stems, one entry per stem and field.
+func explainStems(idx statsIndexer, url, lang string, stems []queryStem) Explanation {
+	ex := Explanation{URL: url, Terms: []TermExplanation{}}
+	doc := idx.stemStats("", url)
+	if !doc.Indexed {
+		ex.Note = "document not indexed"
+		return ex
+	}
+	n := doc.N
+	for _, qs := range stems {
+		if qs.stem == "" {
+			ex.Terms = append(ex.Terms, TermExplanation{Term: qs.term, N: n, Note: qs.note})
+			continue
+		}
+		st := idx.stemStats(qs.stem, url)
+		body := fieldExplanation(qs, "body", st.TF, st.DocLen, st.DF, n, qs.weight)
+		anchor := fieldExplanation(qs, "anchor", st.ATF, st.AnchorLen, max(st.DF, st.ADF), n, anchorBoost*qs.weight)
+		if lang != "" && st.Lang != lang {
+			body.Score, anchor.Score = 0, 0
+			body.Note = "document language " + st.Lang + " is not " + lang
+		}
+		ex.Terms = append(ex.Terms, body)
+		ex.Score += body.Score
+		if st.ATF > 0 {
+			ex.Terms = append(ex.Terms, anchor)
+			ex.Score += anchor.Score
+		}
+	}
+	return ex
+}
+
+func fieldExplanation(qs queryStem, field string, tf, docLen, df, n int, boost float64) TermExplanation {
+	te := TermExplanation{
+		Term: qs.term, Stem: qs.stem, Field: field,
+		TF: tf, DocLen: docLen, DF: df, N: n, Boost: boost, Note: qs.note,
+	}
+	if df > 0 && n > 0 {
+		te.IDF = math.Log(float64(n) / float64(df))
+	}
+	if tf > 0 && docLen > 0 {
+		te.Score = float64(tf) / float64(docLen) * te.IDF * boost
+	}
+	return te
+}
+
+// sqlAnchorStats returns the anchor-field counts of stem s for target,
+// counting df over targets present in docTable like sqlAnchorHits.
+func sqlAnchorStats(db *sql.DB, docTable, s, target string) (count, length, df int) {
+	_ = db.QueryRow("SELECT count FROM anchors WHERE target = ? AND term = ?", target, s).Scan(&count)
+	_ = db.QueryRow("SELECT len FROM anchor_len WHERE target = ?", target).Scan(&length)
+	_ = db.QueryRow(`
+		SELECT COUNT(*) FROM anchors a
+		JOIN `+docTable+` d ON d.url = a.target
+		WHERE a.term = ?`, s).Scan(&df)
+	return count, length, df
+}
@@ -4,23 +4,132 @@ import (
 	"bytes"
 	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/net/html"
+	"golang.org/x/text/unicode/norm"
 )
 
+// Document is the parsed form of a fetched page.
+type Document struct {
+	URL   string   // set when one response yields several documents (feed items)
+	Words []string // lower-cased tokens of the visible text
+	Hrefs []string // raw href values of <a> elements
+	Links []Link   // the same links with their anchor text
+	Lang  string   // normalized language code, "" if unknown
+
+	Canonical string   // raw href of <link rel="canonical">, "" if absent
+	Meta      Metadata // JSON-LD, microdata and OpenGraph metadata
+
+	NoIndex  bool // <meta name="robots"> asks not to index the page
+	NoFollow bool // <meta name="robots"> asks not to follow its links
+}
+
+// Link is an <a href> found on a page.
+type Link struct {
+	Href string // raw href value, not cleaned
+	Text string // visible anchor text, whitespace-collapsed
+	Rel  string // raw rel attribute
+}
+
+// NoFollow reports whether the link's rel asks crawlers not to follow it.
+func (l Link) NoFollow() bool {
+	return hasToken(l.Rel, "nofollow") || hasToken(l.Rel, "ugc")
+}
+
+// robotsValueDirectives take a value after a colon, which must not be
+// mistaken for a user agent prefix.
+var robotsValueDirectives = map[string]bool{
+	"unavailable_after": true,
+	"max-snippet":       true,
+	"max-image-preview": true,
+	"max-video-preview": true,
+}
+
+// ParseRobots parses a robots directive list such as the content of
+// <meta name="robots"> or an X-Robots-Tag header value. A user agent prefix
+// ("otherbot: noindex, nofollow") scopes every directive after it up to the
+// next prefix; directives scoped to a named user agent are ignored.
+func ParseRobots(s string) (noindex, nofollow bool) {
+	apply := true
+	for _, d := range strings.Split(s, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if ua, rest, ok := strings.Cut(d, ":"); ok && !robotsValueDirectives[strings.TrimSpace(ua)] {
+			apply = strings.TrimSpace(ua) == "*"
+			d = strings.TrimSpace(rest)
+		}
+		if !apply {
+			continue
+		}
+		switch d {
+		case "noindex":
+			noindex = true
+		case "nofollow":
+			nofollow = true
+		case "none":
+			noindex, nofollow = true, true
+		}
+	}
+	return noindex, nofollow
+}
+
 func Extract(body []byte) ([]string, []string) {
+	d := ExtractDocument(body)
+	if d == nil {
+		return nil, nil
+	}
+	return d.Words, d.Hrefs
+}
+
+// ExtractOptions selects optional extraction behaviour.
+// The zero value matches Extract.
+type ExtractOptions struct {
+	// Boilerplate drops the words of site chrome: <nav>, <header>,
+	// <footer>, <aside>, <noscript>, hidden elements and the matching ARIA
+	// landmarks. A <header> or <footer> inside <article> or <main> belongs
+	// to the content and is kept. Links inside chrome are still collected
+	// for crawling.
+	Boilerplate bool
+
+	// MaxLinkDensity, when > 0 and Boilerplate is set, also drops block
+	// containers whose share of text inside links exceeds this ratio
+	// (menus and link farms usually sit well above 0.5).
+	MaxLinkDensity float64
+}
+
+// ExtractDocument parses body and returns its words, links and language.
+// The language comes from <html lang> and falls back to DetectLanguage.
+func ExtractDocument(body []byte) *Document {
+	return ExtractDocumentWith(body, ExtractOptions{})
+}
+
+// ExtractDocumentWith is ExtractDocument with explicit options.
+// Bodies that are not valid UTF-8 are transcoded using their BOM or
+// <meta charset> first; Download output is already UTF-8.
+func ExtractDocumentWith(body []byte, opts ExtractOptions) *Document {
+	if !utf8.Valid(body) {
+		body, _ = ToUTF8(body, "")
+	}
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
 	root, err := html.Parse(bytes.NewReader(body))
 	if err != nil {
-		return nil, nil
+		return nil
 	}
-	// Match sequences of letters or digits as "words"
-	wordRe := regexp.MustCompile(`[\p{L}\p{N}]+`)
 
-	var words []string
-	var hrefs []string
+	d := &Document{}
 
 	//track a "skip depth" to ignore text under <script> or <style>
 	var skipDepth int
+	// and a "boilerplate depth" to ignore words (not links) of site chrome
+	var boilerDepth int
+	// inside <article> or <main>, headers and footers are content
+	var contentDepth int
+	var counts map[*html.Node]textCount
+	if opts.Boilerplate && opts.MaxLinkDensity > 0 {
+		counts = countLinkText(root)
+	}
+	var meta metaCollector
 
 	var walk func(*html.Node)
 	walk = func(n *html.Node) {
@@ -28,15 +137,32 @@ func Extract(body []byte) ([]string, []string) {
 		if n.Type == html.ElementNode && (strings.EqualFold(n.Data, "script") || strings.EqualFold(n.Data, "style")) {
 			skipDepth++
 		}
+		boiler := opts.Boilerplate && isBoilerplate(n, contentDepth > 0, opts.MaxLinkDensity, counts)
+		if boiler {
+			boilerDepth++
+		}
+		content := isMainContent(n)
+		if content {
+			contentDepth++
+		}
+		if n.Type == html.ElementNode && strings.EqualFold(n.Data, "html") && d.Lang == "" {
+			d.Lang = NormalizeLang(attr(n, "lang"))
+		}
+		if n.Type == html.ElementNode && strings.EqualFold(n.Data, "link") && d.Canonical == "" && hasToken(attr(n, "rel"), "canonical") {
+			d.Canonical = strings.TrimSpace(attr(n, "href"))
+		}
+		if n.Type == html.ElementNode && strings.EqualFold(n.Data, "meta") && strings.EqualFold(attr(n, "name"), "robots") {
+			ni, nf := ParseRobots(attr(n, "content"))
+			d.NoIndex = d.NoIndex || ni
+			d.NoFollow = d.NoFollow || nf
+		}
+
+		meta.enter(n)
 
 		if skipDepth == 0 {
 			// Collect words from text nodes
-			if n.Type == html.TextNode {
-				for _, tok := range wordRe.FindAllString(n.Data, -1) {
-					if tok != "" {
-						words = append(words, strings.ToLower(tok))
-					}
-				}
+			if n.Type == html.TextNode && boilerDepth == 0 {
+				d.Words = append(d.Words, Tokenize(n.Data, true)...)
 			}
 			// Collect hrefs from <a> elements
 			if n.Type == html.ElementNode && strings.EqualFold(n.Data, "a") {
@@ -44,7 +170,8 @@ func Extract(body []byte) ([]string, []string) {
 					if strings.EqualFold(a.Key, "href") {
 						val := strings.TrimSpace(a.Val)
 						if val != "" {
-							hrefs = append(hrefs, val)
+							d.Hrefs = append(d.Hrefs, val)
+							d.Links = append(d.Links, Link{Href: val, Text: nodeText(n), Rel: attr(n, "rel")})
 						}
 					}
 				}
@@ -53,11 +180,224 @@ func Extract(body []byte) ([]string, []string) {
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
 			walk(c)
 		}
+		meta.leave(n)
 		// Leaving a script/style element: decrease skip depth.
 		if n.Type == html.ElementNode && (strings.EqualFold(n.Data, "script") || strings.EqualFold(n.Data, "style")) {
 			skipDepth--
 		}
+		if boiler {
+			boilerDepth--
+		}
+		if content {
+			contentDepth--
+		}
 	}
 	walk(root)
-	return words, hrefs
+	d.Meta = meta.result()
+
+	if d.Lang == "" {
+		d.Lang = DetectLanguage(d.Words)
+	}
+	return d
+}
+
+// isBoilerplate reports whether element n is site chrome rather than content.
+// inContent is set under <article> or <main>, where headers and footers
+// belong to the content. counts holds the link text of every element when
+// maxLinkDensity > 0.
+func isBoilerplate(n *html.Node, inContent bool, maxLinkDensity float64, counts map[*html.Node]textCount) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch strings.ToLower(n.Data) {
+	case "nav", "aside", "noscript":
+		return true
+	case "header", "footer":
+		return !inContent
+	}
+	switch strings.ToLower(strings.TrimSpace(attr(n, "role"))) {
+	case "navigation", "banner", "contentinfo", "complementary", "search":
+		return true
+	}
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, "hidden") {
+			return true
+		}
+	}
+	if strings.EqualFold(strings.TrimSpace(attr(n, "aria-hidden")), "true") {
+		return true
+	}
+	style := strings.ToLower(strings.ReplaceAll(attr(n, "style"), " ", ""))
+	if strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") {
+		return true
+	}
+	if maxLinkDensity > 0 {
+		switch strings.ToLower(n.Data) {
+		case "div", "ul", "ol", "table", "section":
+			return counts[n].density() > maxLinkDensity
+		}
+	}
+	return false
+}
+
+// isMainContent reports whether n is an <article>, <main> or role=main element.
+func isMainContent(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch strings.ToLower(n.Data) {
+	case "article", "main":
+		return true
+	}
+	return strings.EqualFold(strings.TrimSpace(attr(n, "role")), "main")
+}
+
+// textCount is how many text characters an element holds and how many of
+// them sit inside <a> elements.
+type textCount struct {
+	total, linked int
+}
+
+// density returns the share of linked characters; 0 without text.
+func (tc textCount) density() float64 {
+	if tc.total == 0 {
+		return 0
+	}
+	return float64(tc.linked) / float64(tc.total)
+}
+
+// countLinkText returns the textCount of every element under root, summed
+// bottom-up in a single walk.
+func countLinkText(root *html.Node) map[*html.Node]textCount {
+	counts := make(map[*html.Node]textCount)
+	var walk func(*html.Node, bool) textCount
+	walk = func(n *html.Node, inLink bool) textCount {
+		if n.Type == html.ElementNode && strings.EqualFold(n.Data, "a") {
+			inLink = true
+		}
+		var tc textCount
+		if n.Type == html.TextNode {
+			tc.total = len(strings.Join(strings.Fields(n.Data), " "))
+			if inLink {
+				tc.linked = tc.total
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			sub := walk(c, inLink)
+			tc.total += sub.total
+			tc.linked += sub.linked
+		}
+		if n.Type == html.ElementNode {
+			counts[n] = tc
+		}
+		return tc
+	}
+	walk(root, false)
+	return counts
+}
+
+// attr returns the value of the named attribute of n, or "".
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// wordRe matches sequences of letters or digits as "words".
+var wordRe = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// Tokenize splits text into lower-cased runs of letters or digits after
+// Unicode NFC normalization, so composed and decomposed accents match. With
+// cjkBigrams set, CJK runs inside a token become overlapping bigrams
+// ("中文字" -> "中文", "文字") while Latin text is left untouched. Indexing
+// and ParseQuery always set it so queries match indexed text.
+func Tokenize(text string, cjkBigrams bool) []string {
+	text = norm.NFC.String(text)
+
+	var out []string
+	for _, tok := range wordRe.FindAllString(text, -1) {
+		tok = strings.ToLower(tok)
+		if !cjkBigrams {
+			out = append(out, tok)
+			continue
+		}
+		out = append(out, splitCJK(tok)...)
+	}
+	return out
+}
+
+// isCJK reports whether r is a Han, Hiragana, Katakana or Hangul character.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// splitCJK separates tok into non-CJK runs (kept whole) and CJK runs
+// (emitted as overlapping bigrams; a lone CJK character is kept as is).
+func splitCJK(tok string) []string {
+	var out []string
+	var latin []rune
+	var cjk []rune
+	flushLatin := func() {
+		if len(latin) > 0 {
+			out = append(out, string(latin))
+			latin = latin[:0]
+		}
+	}
+	flushCJK := func() {
+		switch {
+		case len(cjk) == 1:
+			out = append(out, string(cjk))
+		case len(cjk) > 1:
+			for i := 0; i+1 < len(cjk); i++ {
+				out = append(out, string(cjk[i:i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range tok {
+		if isCJK(r) {
+			flushLatin()
+			cjk = append(cjk, r)
+		} else {
+			flushCJK()
+			latin = append(latin, r)
+		}
+	}
+	flushLatin()
+	flushCJK()
+	return out
+}
+
+// hasToken reports whether the space-separated list s contains tok, ignoring case.
+func hasToken(s, tok string) bool {
+	for _, f := range strings.Fields(s) {
+		if strings.EqualFold(f, tok) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeText returns the whitespace-collapsed text under n, skipping
+// <script> and <style> content.
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && (strings.EqualFold(n.Data, "script") || strings.EqualFold(n.Data, "style")) {
+			return
+		}
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+			sb.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(sb.String()), " ")
 }
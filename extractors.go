@@ -0,0 +1,273 @@
+package project02
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Extractor turns a fetched response body into documents. Most formats
+// yield a single document; feeds yield one per item, each with its own URL.
+// A nil result means the body could not be parsed.
+type Extractor interface {
+	Extract(url string, body []byte, opts ExtractOptions) []*Document
+}
+
+// ExtractorFunc adapts a function to the Extractor interface.
+type ExtractorFunc func(url string, body []byte, opts ExtractOptions) []*Document
+
+// Extract calls f.
+func (f ExtractorFunc) Extract(url string, body []byte, opts ExtractOptions) []*Document {
+	return f(url, body, opts)
+}
+
+// ExtractorRegistry selects an Extractor by MIME type.
+type ExtractorRegistry struct {
+	byType map[string]Extractor
+}
+
+// NewExtractorRegistry returns an empty registry.
+func NewExtractorRegistry() *ExtractorRegistry {
+	return &ExtractorRegistry{byType: make(map[string]Extractor)}
+}
+
+// DefaultExtractors returns a registry with the built-in extractors for
+// HTML, plain text, Markdown, RSS/Atom feeds and JSON.
+// No globals: caller injects or uses this helper.
+func DefaultExtractors() *ExtractorRegistry {
+	r := NewExtractorRegistry()
+	r.Register("text/html", ExtractorFunc(extractHTML))
+	r.Register("application/xhtml+xml", ExtractorFunc(extractHTML))
+	r.Register("text/plain", ExtractorFunc(extractText))
+	r.Register("text/markdown", ExtractorFunc(extractMarkdown))
+	r.Register("text/x-markdown", ExtractorFunc(extractMarkdown))
+	r.Register("application/rss+xml", ExtractorFunc(extractFeed))
+	r.Register("application/atom+xml", ExtractorFunc(extractFeed))
+	r.Register("application/xml", ExtractorFunc(extractFeed))
+	r.Register("text/xml", ExtractorFunc(extractFeed))
+	r.Register("application/json", ExtractorFunc(extractJSON))
+	return r
+}
+
+// Register sets the extractor for a media type such as "text/markdown".
+func (r *ExtractorRegistry) Register(mediaType string, e Extractor) {
+	r.byType[strings.ToLower(mediaType)] = e
+}
+
+// For returns the extractor for a Content-Type header value. Structured
+// suffixes ("+xml", "+json") fall back to the XML and JSON extractors, and
+// an empty Content-Type is sniffed from body. Returns nil for unsupported types.
+func (r *ExtractorRegistry) For(contentType string, body []byte) Extractor {
+	if strings.TrimSpace(contentType) == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	if e, ok := r.byType[mt]; ok {
+		return e
+	}
+	switch {
+	case strings.HasSuffix(mt, "+xml"):
+		return r.byType["application/xml"]
+	case strings.HasSuffix(mt, "+json"):
+		return r.byType["application/json"]
+	}
+	return nil
+}
+
+func extractHTML(url string, body []byte, opts ExtractOptions) []*Document {
+	d := ExtractDocumentWith(body, opts)
+	if d == nil {
+		return nil
+	}
+	return []*Document{d}
+}
+
+// textDocument builds a Document from plain text and links.
+func textDocument(text string, links []Link, opts ExtractOptions) *Document {
+	d := &Document{Words: Tokenize(text, true), Links: links}
+	for _, l := range links {
+		d.Hrefs = append(d.Hrefs, l.Href)
+	}
+	d.Lang = DetectLanguage(d.Words)
+	return d
+}
+
+func extractText(url string, body []byte, opts ExtractOptions) []*Document {
+	return []*Document{textDocument(string(body), nil, opts)}
+}
+
+var (
+	// Inline links and images: [text](href "title") / ![alt](src).
+	mdLinkRe = regexp.MustCompile(`(!?)\[([^\]]*)\]\(\s*<?([^)\s>]+)>?(?:\s+"[^"]*")?\s*\)`)
+	// Autolinks: <https://example.com>.
+	mdAutoLinkRe = regexp.MustCompile(`<(https?://[^>\s]+)>`)
+)
+
+func extractMarkdown(url string, body []byte, opts ExtractOptions) []*Document {
+	text := string(body)
+	var links []Link
+	text = mdLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mdLinkRe.FindStringSubmatch(m)
+		if sub[1] == "" { // images are not links
+			links = append(links, Link{Href: sub[3], Text: strings.Join(strings.Fields(sub[2]), " ")})
+		}
+		return sub[2]
+	})
+	text = mdAutoLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+		href := mdAutoLinkRe.FindStringSubmatch(m)[1]
+		links = append(links, Link{Href: href, Text: href})
+		return " "
+	})
+	return []*Document{textDocument(text, links, opts)}
+}
+
+// xmlFeed covers both RSS 2.0 (<rss><channel><item>) and Atom (<feed><entry>).
+type xmlFeed struct {
+	XMLName xml.Name
+	Items   []struct {
+		Title       string `xml:"title"`
+		Link        string `xml:"link"`
+		GUID        string `xml:"guid"`
+		Description string `xml:"description"`
+		Content     string `xml:"encoded"` // content:encoded
+	} `xml:"channel>item"`
+	Entries []struct {
+		Title string `xml:"title"`
+		ID    string `xml:"id"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Summary string `xml:"summary"`
+		Content string `xml:"content"`
+	} `xml:"entry"`
+}
+
+// extractFeed returns one document per RSS item or Atom entry, keyed by the
+// item link, or by its GUID or Atom id when that is an http(s) URL. Items
+// with neither are dropped rather than keyed by the feed URL. Item bodies
+// are HTML fragments and go through the HTML extractor. Other XML is
+// indexed as a single text document.
+func extractFeed(url string, body []byte, opts ExtractOptions) []*Document {
+	var f xmlFeed
+	if err := newXMLDecoder(body).Decode(&f); err != nil {
+		return nil
+	}
+	item := func(link, id, title, html string) *Document {
+		link, id = strings.TrimSpace(link), strings.TrimSpace(id)
+		if link == "" && (strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://")) {
+			link = id
+		}
+		if link == "" {
+			return nil
+		}
+		d := ExtractDocumentWith([]byte("<p>"+xmlEscape(title)+"</p>"+html), opts)
+		if d == nil {
+			return nil
+		}
+		d.URL = link
+		return d
+	}
+
+	out := []*Document{}
+	for _, it := range f.Items {
+		html := it.Description
+		if it.Content != "" {
+			html = it.Content
+		}
+		if d := item(it.Link, it.GUID, it.Title, html); d != nil {
+			out = append(out, d)
+		}
+	}
+	for _, e := range f.Entries {
+		var link string
+		for _, l := range e.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				link = l.Href
+				break
+			}
+		}
+		html := e.Summary
+		if e.Content != "" {
+			html = e.Content
+		}
+		if d := item(link, e.ID, e.Title, html); d != nil {
+			out = append(out, d)
+		}
+	}
+	if len(f.Items) > 0 || len(f.Entries) > 0 {
+		return out
+	}
+	return []*Document{textDocument(xmlText(body), nil, opts)}
+}
+
+// xmlEscape escapes s for inclusion in HTML text.
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xmlText concatenates the character data of an XML document.
+func xmlText(body []byte) string {
+	var sb strings.Builder
+	dec := newXMLDecoder(body)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		if cd, ok := tok.(xml.CharData); ok {
+			sb.Write(cd)
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+// extractJSON indexes every string value of a JSON document (object keys
+// are skipped); string values that are http(s) URLs become links.
+func extractJSON(url string, body []byte, opts ExtractOptions) []*Document {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	var sb strings.Builder
+	var links []Link
+	var walk func(any)
+	walk = func(v any) {
+		switch x := v.(type) {
+		case map[string]any:
+			// Visit keys in order so word and link order are stable.
+			keys := make([]string, 0, len(x))
+			for k := range x {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(x[k])
+			}
+		case []any:
+			for _, c := range x {
+				walk(c)
+			}
+		case string:
+			if strings.HasPrefix(x, "http://") || strings.HasPrefix(x, "https://") {
+				links = append(links, Link{Href: x})
+				return
+			}
+			sb.WriteString(x)
+			sb.WriteByte(' ')
+		}
+	}
+	walk(v)
+	return []*Document{textDocument(sb.String(), links, opts)}
+}
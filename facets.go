@@ -0,0 +1,130 @@
+package project02
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SearchFilter narrows search hits by URL and stored document metadata.
+// Zero-valued fields do not filter.
+type SearchFilter struct {
+	Host       string    // exact host, case-insensitive, e.g. "example.com"
+	PathPrefix string    // URL path prefix, e.g. "/blog/"
+	Lang       string    // normalized language code
+	From, To   time.Time // inclusive range on Metadata.DatePublished
+}
+
+// IsZero reports whether f filters nothing.
+func (f SearchFilter) IsZero() bool { return f == SearchFilter{} }
+
+// Match reports whether the document at u with metadata m passes f.
+// Documents without a parsable publication date fail any date range.
+func (f SearchFilter) Match(u string, m Metadata) bool {
+	if f.Host != "" || f.PathPrefix != "" {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return false
+		}
+		if f.Host != "" && !strings.EqualFold(pu.Hostname(), f.Host) {
+			return false
+		}
+		if f.PathPrefix != "" && !strings.HasPrefix(pu.Path, f.PathPrefix) {
+			return false
+		}
+	}
+	if f.Lang != "" && m.Lang != f.Lang {
+		return false
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		t := parseW3CDate(m.DatePublished)
+		if t.IsZero() || (!f.From.IsZero() && t.Before(f.From)) || (!f.To.IsZero() && t.After(f.To)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseDateBound parses a date_from/date_to value. A bare date used as an
+// upper bound covers the whole day.
+func ParseDateBound(s string, upper bool) time.Time {
+	t := parseW3CDate(s)
+	if upper && !t.IsZero() && len(strings.TrimSpace(s)) == len("2006-01-02") {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t
+}
+
+// ApplyFilter keeps the hits that pass f, given their metadata by URL (see
+// LoadMeta). Hits without metadata only pass filters on the URL.
+func ApplyFilter(hits []Hit, meta map[string]Metadata, f SearchFilter) []Hit {
+	if f.IsZero() {
+		return hits
+	}
+	var out []Hit
+	for _, h := range hits {
+		if f.Match(h.URL, meta[h.URL]) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// FacetCount is one value of a facet and the number of hits with it.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets summarizes a hit list by host, content type and language.
+type Facets struct {
+	Hosts        []FacetCount `json:"hosts"`
+	ContentTypes []FacetCount `json:"contentTypes"`
+	Langs        []FacetCount `json:"langs"`
+}
+
+// CountFacets counts hosts, content types and languages over hits, given
+// their metadata by URL (see LoadMeta), keeping the n most frequent values
+// of each (all of them if n <= 0). Hits without a value for a facet are not
+// counted in it.
+func CountFacets(hits []Hit, meta map[string]Metadata, n int) Facets {
+	hosts := make(map[string]int)
+	types := make(map[string]int)
+	langs := make(map[string]int)
+	for _, h := range hits {
+		if pu, err := url.Parse(h.URL); err == nil && pu.Host != "" {
+			hosts[strings.ToLower(pu.Hostname())]++
+		}
+		m := meta[h.URL]
+		if m.ContentType != "" {
+			types[m.ContentType]++
+		}
+		if m.Lang != "" {
+			langs[m.Lang]++
+		}
+	}
+	return Facets{
+		Hosts:        topFacets(hosts, n),
+		ContentTypes: topFacets(types, n),
+		Langs:        topFacets(langs, n),
+	}
+}
+
+// topFacets orders counts by count descending, then value ascending.
+func topFacets(counts map[string]int, n int) []FacetCount {
+	out := make([]FacetCount, 0, len(counts))
+	for v, c := range counts {
+		out = append(out, FacetCount{Value: v, Count: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Value < out[j].Value
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
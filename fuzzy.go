@@ -0,0 +1,338 @@
+package project02
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// levenshtein returns the edit distance between a and b, counted in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// bkNode is a node of a BK-tree; children are keyed by their distance to term.
+type bkNode struct {
+	term     string
+	children map[int]*bkNode
+}
+
+// bkTree indexes terms by edit distance so that all terms within k edits of
+// a query can be found without scanning the whole dictionary.
+type bkTree struct {
+	root *bkNode
+}
+
+func (t *bkTree) add(term string) {
+	if t.root == nil {
+		t.root = &bkNode{term: term, children: make(map[int]*bkNode)}
+		return
+	}
+	n := t.root
+	for {
+		d := levenshtein(term, n.term)
+		if d == 0 {
+			return
+		}
+		c, ok := n.children[d]
+		if !ok {
+			n.children[d] = &bkNode{term: term, children: make(map[int]*bkNode)}
+			return
+		}
+		n = c
+	}
+}
+
+// search returns every term within k edits of term.
+func (t *bkTree) search(term string, k int) []string {
+	if t.root == nil {
+		return nil
+	}
+	var out []string
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := levenshtein(term, n.term)
+		if d <= k {
+			out = append(out, n.term)
+		}
+		// Triangle inequality: only children at distance d-k..d+k can match.
+		for cd, c := range n.children {
+			if cd >= d-k && cd <= d+k {
+				stack = append(stack, c)
+			}
+		}
+	}
+	return out
+}
+
+// maxEdits is the number of typos tolerated for a term of this length.
+func maxEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n < 4:
+		return 0
+	case n <= 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// suggestRatio is how many times more documents a nearby term must match
+// before it is suggested in place of a term that has hits as typed.
+const suggestRatio = 5
+
+// FuzzySearcher runs queries with typo tolerance: terms missing from the
+// dictionary are expanded to nearby terms, and a respelled query is
+// suggested when it would match more documents.
+type FuzzySearcher struct {
+	indexer Indexer
+
+	// Penalty multiplies the score of an expanded term once per edit.
+	Penalty float64
+
+	// RebuildInterval is the minimum time between dictionary rebuilds.
+	// Rebuilds run in the background; searches keep using the previous
+	// dictionary until the new one is swapped in.
+	RebuildInterval time.Duration
+
+	mu         sync.Mutex
+	n          int64 // indexVersion() when the tree was built
+	tree       *bkTree
+	terms      map[string]TermStat
+	built      time.Time // when the last rebuild started
+	rebuilding bool
+}
+
+// defaultRebuildInterval bounds how often a busy index rebuilds the
+// fuzzy dictionary.
+const defaultRebuildInterval = 5 * time.Second
+
+// NewFuzzySearcher creates a fuzzy searcher over indexer with a 0.5 penalty
+// per edit that rebuilds its dictionary at most every 5 seconds.
+func NewFuzzySearcher(indexer Indexer) *FuzzySearcher {
+	return &FuzzySearcher{indexer: indexer, Penalty: 0.5, RebuildInterval: defaultRebuildInterval, n: -1}
+}
+
+// dictionary returns the BK-tree and term stats. The first call builds
+// them; later calls start a background rebuild when the index has changed
+// and RebuildInterval has passed, and return the current ones meanwhile.
+func (f *FuzzySearcher) dictionary(ti TermIndexer) (*bkTree, map[string]TermStat) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tree == nil {
+		n := f.indexVersion()
+		f.tree, f.terms = buildDictionary(ti)
+		f.n, f.built = n, time.Now()
+		return f.tree, f.terms
+	}
+	if !f.rebuilding && time.Since(f.built) >= f.RebuildInterval {
+		if n := f.indexVersion(); n != f.n {
+			f.rebuilding, f.built = true, time.Now()
+			go f.rebuild(ti, n)
+		}
+	}
+	return f.tree, f.terms
+}
+
+// rebuild builds a new dictionary for index version n without holding f.mu
+// and swaps it in.
+func (f *FuzzySearcher) rebuild(ti TermIndexer, n int64) {
+	tree, terms := buildDictionary(ti)
+	f.mu.Lock()
+	f.tree, f.terms, f.n = tree, terms, n
+	f.rebuilding = false
+	f.mu.Unlock()
+}
+
+// buildDictionary indexes every term of ti in a BK-tree.
+func buildDictionary(ti TermIndexer) (*bkTree, map[string]TermStat) {
+	tree := &bkTree{}
+	terms := make(map[string]TermStat)
+	for _, ts := range ti.Terms() {
+		tree.add(ts.Term)
+		terms[ts.Term] = ts
+	}
+	return tree, terms
+}
+
+// indexVersion changes whenever the dictionary may have: the write
+// generation when the indexer counts writes, the document count otherwise.
+func (f *FuzzySearcher) indexVersion() int64 {
+	if gi, ok := f.indexer.(GenerationIndexer); ok {
+		return int64(gi.Generation())
+	}
+	return int64(f.indexer.GetN())
+}
+
+// candidates returns the dictionary terms other than s within maxEdits(s)
+// edits of it, sorted.
+func candidates(tree *bkTree, s string) []string {
+	k := maxEdits(s)
+	if k == 0 {
+		return nil
+	}
+	var out []string
+	for _, c := range tree.search(s, k) {
+		if c != s {
+			out = append(out, c)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Search ranks documents for q like SearchQuery, expanding unknown terms to
+// dictionary terms within a bounded edit distance. The second result is a
+// respelled query, or "" when the query as typed is the best spelling.
+// Indexers that do not implement TermIndexer get plain SearchQuery results.
+func (f *FuzzySearcher) Search(q, lang string) ([]Hit, string) {
+	hits, suggestion, _ := f.SearchContext(context.Background(), q, lang)
+	return hits, suggestion
+}
+
+// SearchContext is Search that gives up with ctx's error once ctx is done.
+// The context is checked before every term and bounds each term and fuzzy
+// expansion lookup (see ContextIndexer), so a deadline bounds the work of
+// long queries.
+func (f *FuzzySearcher) SearchContext(ctx context.Context, q, lang string) ([]Hit, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	ti, ok := f.indexer.(TermIndexer)
+	if !ok {
+		return SearchQuery(f.indexer, q, lang), "", nil
+	}
+	tree, dict := f.dictionary(ti)
+
+	q, filters := ParseFilters(q)
+	terms := ParseQuery(q)
+	scores := make(map[string]float64)
+	typed := make(map[string]float64) // scores without fuzzy expansion
+	suggest := make([]string, len(terms))
+	changed := false
+
+	for i, t := range terms {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		suggest[i] = t
+		if strings.HasSuffix(t, "*") {
+			for _, h := range searchTerm(f.indexer, t, lang) {
+				scores[h.URL] += h.Score
+				typed[h.URL] += h.Score
+			}
+			continue
+		}
+		if ti.Stopword(t, lang) {
+			continue
+		}
+		s := stemLang(lang, t)
+		exact := dict[s]
+		found, err := searchStem(ctx, ti, s, lang)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, h := range found {
+			scores[h.URL] += h.Score
+			typed[h.URL] += h.Score
+		}
+
+		best := exact
+		for _, c := range candidates(tree, s) {
+			st := dict[c]
+			// A term with hits is only respelled to a clearly more common one.
+			if st.DF > best.DF && (exact.DF == 0 || st.DF >= suggestRatio*exact.DF) {
+				best = st
+			}
+			// Only expand terms that match nothing as typed.
+			if exact.DF > 0 {
+				continue
+			}
+			found, err := searchStem(ctx, ti, c, lang)
+			if err != nil {
+				return nil, "", err
+			}
+			w := math.Pow(f.Penalty, float64(levenshtein(s, c)))
+			for _, h := range found {
+				scores[h.URL] += h.Score * w
+			}
+		}
+		if best.Term != exact.Term {
+			suggest[i] = best.Form
+			if suggest[i] == "" {
+				suggest[i] = best.Term
+			}
+			changed = true
+		}
+	}
+
+	hits := FilterHits(f.indexer, sortedHits(scores), filters)
+	if !changed {
+		return hits, "", nil
+	}
+	for _, fl := range filters {
+		suggest = append(suggest, fl.String())
+	}
+	// Only suggest a respelling that finds more than the query as typed.
+	respelled := strings.Join(suggest, " ")
+	if len(SearchQuery(f.indexer, respelled, lang)) <= len(FilterHits(f.indexer, sortedHits(typed), filters)) {
+		return hits, "", nil
+	}
+	return hits, respelled, nil
+}
+
+// Explain breaks down how url scores for q with Search, including the
+// penalized expansions of misspelled terms. ok is false when the indexer
+// cannot explain its scores.
+func (f *FuzzySearcher) Explain(q, url, lang string) (ex Explanation, ok bool) {
+	si, ok := f.indexer.(statsIndexer)
+	if !ok {
+		if ei, ok := f.indexer.(ExplainIndexer); ok {
+			return ei.ExplainLang(q, url, lang), true
+		}
+		return Explanation{}, false
+	}
+	tree, dict := f.dictionary(si)
+
+	var stems []queryStem
+	for _, qs := range queryStems(si, q, lang) {
+		stems = append(stems, qs)
+		if qs.stem == "" || strings.HasSuffix(qs.term, "*") || dict[qs.stem].DF > 0 {
+			continue
+		}
+		for _, c := range candidates(tree, qs.stem) {
+			d := levenshtein(qs.stem, c)
+			stems = append(stems, queryStem{
+				term:   qs.term,
+				stem:   c,
+				weight: math.Pow(f.Penalty, float64(d)),
+				note:   fmt.Sprintf("fuzzy match, %d edit(s)", d),
+			})
+		}
+	}
+	return explainStems(si, url, lang, stems), true
+}
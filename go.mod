@@ -8,6 +8,7 @@ require (
 	github.com/glebarez/sqlite v1.11.0
 	github.com/kljensen/snowball v0.10.0
 	golang.org/x/net v0.44.0
+	golang.org/x/text v0.29.0
 )
 
 require (
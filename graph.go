@@ -0,0 +1,251 @@
+package project02
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Edge is a directed link from one page to another.
+type Edge struct {
+	Source string
+	Target string
+	Anchor string // anchor text of the link
+}
+
+// GraphIndexer is implemented by indexers that store the crawl link graph
+// and PageRank scores next to the term index.
+type GraphIndexer interface {
+	// AddEdge records a link; duplicates are ignored.
+	AddEdge(e Edge)
+
+	// Edges returns every stored link.
+	Edges() []Edge
+
+	// SetPageRank replaces the stored PageRank scores.
+	SetPageRank(ranks map[string]float64)
+
+	// PageRanks returns the stored PageRank scores by URL.
+	PageRanks() map[string]float64
+}
+
+// PageRankIndexer is implemented by graph indexers that can look up the
+// PageRank of a few documents without loading the whole table.
+type PageRankIndexer interface {
+	// PageRank returns the stored scores of those of urls that have one.
+	PageRank(urls []string) map[string]float64
+}
+
+// LoadPageRank returns the stored PageRank of hits by URL, reading only
+// their rows when g supports it.
+func LoadPageRank(g GraphIndexer, hits []Hit) map[string]float64 {
+	pi, ok := g.(PageRankIndexer)
+	if !ok {
+		return g.PageRanks()
+	}
+	urls := make([]string, len(hits))
+	for i, h := range hits {
+		urls[i] = h.URL
+	}
+	return pi.PageRank(urls)
+}
+
+// PageRank computes PageRank over edges with the given damping factor
+// (0.85 is customary). Parallel edges and self-links count once and zero.
+// Rank from pages without out-links is spread evenly over all pages, so
+// the scores always sum to 1.
+func PageRank(edges []Edge, damping float64, iterations int) map[string]float64 {
+	out := make(map[string]map[string]bool)
+	nodes := make(map[string]bool)
+	for _, e := range edges {
+		nodes[e.Source] = true
+		nodes[e.Target] = true
+		if e.Source == e.Target {
+			continue
+		}
+		if out[e.Source] == nil {
+			out[e.Source] = make(map[string]bool)
+		}
+		out[e.Source][e.Target] = true
+	}
+	n := float64(len(nodes))
+	if n == 0 {
+		return map[string]float64{}
+	}
+
+	rank := make(map[string]float64, len(nodes))
+	for u := range nodes {
+		rank[u] = 1 / n
+	}
+	for it := 0; it < iterations; it++ {
+		var dangling float64
+		for u := range nodes {
+			if len(out[u]) == 0 {
+				dangling += rank[u]
+			}
+		}
+		next := make(map[string]float64, len(nodes))
+		base := (1-damping)/n + damping*dangling/n
+		for u := range nodes {
+			next[u] = base
+		}
+		for u, targets := range out {
+			share := damping * rank[u] / float64(len(targets))
+			for v := range targets {
+				next[v] += share
+			}
+		}
+		var delta float64
+		for u := range nodes {
+			delta += math.Abs(next[u] - rank[u])
+		}
+		rank = next
+		if delta < 1e-9 {
+			break
+		}
+	}
+	return rank
+}
+
+// UpdatePageRank recomputes PageRank from the graph stored in g and saves it.
+func UpdatePageRank(g GraphIndexer) map[string]float64 {
+	ranks := PageRank(g.Edges(), 0.85, 100)
+	g.SetPageRank(ranks)
+	return ranks
+}
+
+// BlendPageRank mixes PageRank into hit scores: both signals are scaled to
+// [0,1] by their maximum and combined as (1-weight)*tfidf + weight*pagerank.
+// Hits are re-sorted; weight <= 0 or an empty rank table leaves them as is.
+func BlendPageRank(hits []Hit, ranks map[string]float64, weight float64) []Hit {
+	if weight <= 0 || len(hits) == 0 {
+		return hits
+	}
+	var maxScore, maxRank float64
+	for _, h := range hits {
+		maxScore = math.Max(maxScore, h.Score)
+		maxRank = math.Max(maxRank, ranks[h.URL])
+	}
+	if maxScore == 0 || maxRank == 0 {
+		return hits
+	}
+	out := make([]Hit, len(hits))
+	for i, h := range hits {
+		out[i] = Hit{
+			URL:   h.URL,
+			Score: (1-weight)*h.Score/maxScore + weight*ranks[h.URL]/maxRank,
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return lessHit(out[i], out[j])
+	})
+	return out
+}
+
+// createGraphTables creates the link graph tables shared by the SQLite indexers.
+func createGraphTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS links (
+			source TEXT NOT NULL,
+			target TEXT NOT NULL,
+			anchor TEXT NOT NULL DEFAULT '',
+			UNIQUE(source, target, anchor)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_links_target ON links(target);
+
+		CREATE TABLE IF NOT EXISTS pagerank (
+			url TEXT PRIMARY KEY,
+			rank REAL NOT NULL
+		);
+	`)
+	return err
+}
+
+func sqlAddEdge(db *sql.DB, e Edge) {
+	_, _ = db.Exec("INSERT OR IGNORE INTO links (source, target, anchor) VALUES (?, ?, ?)",
+		e.Source, e.Target, e.Anchor)
+}
+
+func sqlEdges(db *sql.DB) []Edge {
+	rows, err := db.Query("SELECT source, target, anchor FROM links")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var out []Edge
+	for rows.Next() {
+		var e Edge
+		if err := rows.Scan(&e.Source, &e.Target, &e.Anchor); err != nil {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func sqlSetPageRank(db *sql.DB, ranks map[string]float64) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM pagerank"); err != nil {
+		tx.Rollback()
+		return
+	}
+	for u, r := range ranks {
+		if _, err := tx.Exec("INSERT INTO pagerank (url, rank) VALUES (?, ?)", u, r); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	tx.Commit()
+}
+
+func sqlPageRanks(db *sql.DB) map[string]float64 {
+	out := make(map[string]float64)
+	rows, err := db.Query("SELECT url, rank FROM pagerank")
+	if err != nil {
+		return out
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u string
+		var r float64
+		if err := rows.Scan(&u, &r); err != nil {
+			continue
+		}
+		out[u] = r
+	}
+	return out
+}
+
+// sqlPageRank looks up the PageRank of urls, sqlMetaChunk at a time like
+// sqlMetaBatch.
+func sqlPageRank(db *sql.DB, urls []string) map[string]float64 {
+	out := make(map[string]float64)
+	for len(urls) > 0 {
+		chunk := urls[:min(len(urls), sqlMetaChunk)]
+		urls = urls[len(chunk):]
+		args := make([]any, len(chunk))
+		for i, u := range chunk {
+			args[i] = u
+		}
+		rows, err := db.Query("SELECT url, rank FROM pagerank WHERE url IN (?"+strings.Repeat(", ?", len(chunk)-1)+")", args...)
+		if err != nil {
+			return out
+		}
+		for rows.Next() {
+			var u string
+			var r float64
+			if err := rows.Scan(&u, &r); err != nil {
+				continue
+			}
+			out[u] = r
+		}
+		rows.Close()
+	}
+	return out
+}
@@ -1,6 +1,10 @@
 package project02
 
 import (
+	"context"
+	"errors"
+	"sort"
+
 	"github.com/kljensen/snowball/english"
 )
 
@@ -18,13 +22,193 @@ type Indexer interface {
 	// SearchTFIDF ranks a single-term query using TF-IDF.
 	SearchTFIDF(term string) []Hit
 
-	// GetN returns the total number of documents
+	// GetN returns the total number of documents. It is the only safe way
+	// to read the count while other goroutines write to the index.
 	GetN() int
 
 	// Close closes the indexer resources
 	Close() error
 }
 
+// LangIndexer is implemented by indexers that pick stopwords and stemmer
+// per document language. An empty lang means the default (English) pipeline.
+type LangIndexer interface {
+	// AddLang indexes doc using the stopwords and stemmer for lang.
+	AddLang(doc, lang string, words []string)
+
+	// SearchTFIDFLang stems term for lang and only returns documents in lang.
+	SearchTFIDFLang(term, lang string) []Hit
+}
+
+// LangStopwordIndexer is implemented by indexers with a stopword list per
+// document language.
+type LangStopwordIndexer interface {
+	// SetLangStopwords sets the stopword list used for documents and
+	// queries in lang.
+	SetLangStopwords(lang string, stop map[string]struct{})
+}
+
+// DeleteIndexer is implemented by indexers that can remove a document.
+type DeleteIndexer interface {
+	// Delete removes doc, its metadata and the anchor text of its links,
+	// reporting whether it was indexed. Anchor text of links pointing at
+	// doc is kept for when it is re-added.
+	Delete(doc string) (bool, error)
+}
+
+// ReplaceIndexer is implemented by indexers that can swap a document for
+// a new version in one step, so searches never see it missing and a failed
+// write keeps the old version.
+type ReplaceIndexer interface {
+	// ReplaceLang indexes doc like AddLang, first removing any earlier
+	// version as Delete does, and reports whether there was one.
+	ReplaceLang(doc, lang string, words []string) (bool, error)
+}
+
+// DocIndexer is implemented by indexers that can tell whether a document
+// is already indexed.
+type DocIndexer interface {
+	// Has reports whether doc is indexed.
+	Has(doc string) bool
+}
+
+// TermStat describes one entry of the term dictionary.
+type TermStat struct {
+	Term string // stemmed term as stored in the index
+	Form string // a surface word that produced the stem, for display
+	DF   int    // document frequency
+}
+
+// TermIndexer is implemented by indexers that can enumerate their term
+// dictionary and look up postings for an already-stemmed term.
+type TermIndexer interface {
+	// Terms returns every indexed term sorted by stem.
+	Terms() []TermStat
+
+	// SearchStem ranks documents containing stem, optionally only in lang.
+	SearchStem(stem, lang string) []Hit
+
+	// Stopword reports whether word is dropped by the pipeline for lang.
+	Stopword(word, lang string) bool
+}
+
+// ContextIndexer is implemented by term indexers whose lookups can be
+// abandoned, such as those backed by a database.
+type ContextIndexer interface {
+	// SearchStemContext is SearchStem that stops once ctx is done and
+	// returns ctx's error.
+	SearchStemContext(ctx context.Context, stem, lang string) ([]Hit, error)
+}
+
+// TermCountIndexer is implemented by indexers that can size their term
+// dictionary without listing it.
+type TermCountIndexer interface {
+	// TermCounts returns the number of distinct terms and the sum of their
+	// document frequencies.
+	TermCounts() (terms, postings int)
+}
+
+// PrefixIndexer is implemented by indexers that can complete a word prefix.
+type PrefixIndexer interface {
+	// PrefixTerms returns up to limit terms whose form starts with prefix,
+	// ordered by document frequency (highest first).
+	PrefixTerms(prefix string, limit int) []TermStat
+}
+
+// topTerms orders terms by df descending, then form ascending, and keeps
+// the first limit entries (all of them if limit <= 0).
+func topTerms(ts []TermStat, limit int) []TermStat {
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].DF != ts[j].DF {
+			return ts[i].DF > ts[j].DF
+		}
+		return ts[i].Form < ts[j].Form
+	})
+	if limit > 0 && len(ts) > limit {
+		ts = ts[:limit]
+	}
+	return ts
+}
+
+// ErrNotIndexed is returned by IndexDocument when the indexer did not store
+// the document body and cannot say why.
+var ErrNotIndexed = errors.New("document was not indexed")
+
+// IndexDocument adds a parsed document to indexer, passing its language
+// along, attaching its anchor texts to the link targets and storing its
+// metadata when the indexer supports it. A document the indexer already
+// has is left alone, so its anchors are not counted twice, and anchors and
+// metadata are only stored once the body has been indexed. The body is
+// written with ReplaceLang where available, so write errors are returned.
+func IndexDocument(indexer Indexer, url string, d *Document) error {
+	if d == nil {
+		return nil
+	}
+	di, has := indexer.(DocIndexer)
+	if has && di.Has(url) {
+		return nil
+	}
+	if ri, ok := indexer.(ReplaceIndexer); ok {
+		if _, err := ri.ReplaceLang(url, d.Lang, d.Words); err != nil {
+			return err
+		}
+	} else {
+		if li, ok := indexer.(LangIndexer); ok {
+			li.AddLang(url, d.Lang, d.Words)
+		} else {
+			indexer.Add(url, d.Words)
+		}
+		if has && !di.Has(url) {
+			return ErrNotIndexed
+		}
+	}
+	indexExtras(indexer, url, d)
+	return nil
+}
+
+// indexExtras indexes the anchor text of d's links and its metadata once
+// its body is indexed as url.
+func indexExtras(indexer Indexer, url string, d *Document) {
+	if ai, ok := indexer.(AnchorIndexer); ok {
+		indexAnchors(ai, url, d)
+	}
+	if mi, ok := indexer.(MetaIndexer); ok {
+		m := d.Meta
+		m.Lang = d.Lang
+		if !m.IsZero() {
+			mi.SetMeta(url, m)
+		}
+	}
+}
+
+// ReplaceDocument indexes d as url like IndexDocument, replacing any
+// earlier version, and reports whether there was one. Indexers without
+// ReplaceIndexer delete the old version first, so the document is missing
+// in between.
+func ReplaceDocument(indexer Indexer, url string, d *Document) (bool, error) {
+	if d == nil {
+		return false, nil
+	}
+	ri, ok := indexer.(ReplaceIndexer)
+	if !ok {
+		replaced := false
+		if di, ok := indexer.(DeleteIndexer); ok {
+			var err error
+			if replaced, err = di.Delete(url); err != nil {
+				return false, err
+			}
+		}
+		IndexDocument(indexer, url, d)
+		return replaced, nil
+	}
+	replaced, err := ri.ReplaceLang(url, d.Lang, d.Words)
+	if err != nil {
+		return false, err
+	}
+	indexExtras(indexer, url, d)
+	return replaced, nil
+}
+
 // lessHit orders two hits: higher score first; if scores are equal, URL ascending.
 func lessHit(a, b Hit) bool {
 	if a.Score != b.Score {
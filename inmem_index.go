@@ -1,18 +1,45 @@
 package project02
 
 import (
+	"maps"
 	"math"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-// InMemIndex stores data for TF-IDF ranking in memory.
+// InMemIndex stores data for TF-IDF ranking in memory. It is safe for
+// concurrent use, so documents can be added while searches are served.
 type InMemIndex struct {
+	mu sync.RWMutex // guards every field but gen
+
 	tf     map[string]map[string]int // stem -> doc -> term freq
 	df     map[string]int            // stem -> doc freq
 	docLen map[string]int            // doc -> token count (after stop+stem)
-	N      int                       // total documents
-	stop   map[string]struct{}       // stopword set
+	// Deprecated: N is guarded by mu and races with writers when read
+	// directly; use GetN.
+	N int
+
+	stop map[string]struct{} // stopword set
+
+	langStop map[string]map[string]struct{} // lang -> stopword set
+	docLang  map[string]string              // doc -> language code
+	form     map[string]string              // stem -> first surface word seen
+	forms    []formStem                     // every surface word seen, sorted, for prefix lookups
+
+	edges []Edge             // link graph, in insertion order
+	seenE map[Edge]bool      // dedup set for edges
+	ranks map[string]float64 // doc -> PageRank
+
+	atf       map[string]map[string]int // anchor field: stem -> target -> freq
+	anchorLen map[string]int            // target -> anchor token count
+	anchorSrc map[string]map[string]int // source -> stem+"\x00"+target -> freq, undone by Delete
+
+	meta map[string]Metadata // doc -> structured metadata
+
+	gen atomic.Uint64 // bumped by writes that change search results
 }
 
 // NewInMemIndex creates an empty in-memory index. If stop is nil, uses DefaultStopwords().
@@ -25,14 +52,78 @@ func NewInMemIndex(stop map[string]struct{}) *InMemIndex {
 		df:     make(map[string]int),
 		docLen: make(map[string]int),
 		stop:   stop,
+
+		langStop: make(map[string]map[string]struct{}),
+		docLang:  make(map[string]string),
+		form:     make(map[string]string),
+
+		seenE: make(map[Edge]bool),
+		ranks: make(map[string]float64),
+
+		atf:       make(map[string]map[string]int),
+		anchorLen: make(map[string]int),
+		anchorSrc: make(map[string]map[string]int),
+
+		meta: make(map[string]Metadata),
 	}
 }
 
+// SetLangStopwords sets the stopword list used for documents and queries in lang.
+func (idx *InMemIndex) SetLangStopwords(lang string, stop map[string]struct{}) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.langStop[lang] = stop
+}
+
+// stopFor returns the stopword set for lang. English and unknown documents use
+// the default set; other languages have none unless configured.
+func (idx *InMemIndex) stopFor(lang string) map[string]struct{} {
+	if s, ok := idx.langStop[lang]; ok {
+		return s
+	}
+	if lang == "" || lang == "en" {
+		return idx.stop
+	}
+	return nil
+}
+
+// Stopword reports whether word is a stopword for lang.
+func (idx *InMemIndex) Stopword(word, lang string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	_, bad := idx.stopFor(lang)[strings.ToLower(word)]
+	return bad
+}
+
 // Add indexes a single document. Pipeline: lower -> stop filter -> stem.
 func (idx *InMemIndex) Add(doc string, words []string) {
+	idx.AddLang(doc, "", words)
+}
+
+// AddLang indexes a single document with the stopwords and stemmer for lang.
+func (idx *InMemIndex) AddLang(doc, lang string, words []string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
 	if _, dup := idx.docLen[doc]; dup {
 		return
 	}
+	idx.add(doc, lang, words)
+}
+
+// ReplaceLang indexes doc like AddLang, replacing any earlier version (its
+// metadata and the anchor text of its links included) under one lock, and
+// reports whether there was one.
+func (idx *InMemIndex) ReplaceLang(doc, lang string, words []string) (bool, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	replaced := idx.delete(doc)
+	idx.add(doc, lang, words)
+	return replaced, nil
+}
+
+// add indexes doc, which is not indexed; idx.mu must be held.
+func (idx *InMemIndex) add(doc, lang string, words []string) {
+	stop := idx.stopFor(lang)
 	seen := make(map[string]bool)
 	var kept int
 
@@ -41,10 +132,10 @@ func (idx *InMemIndex) Add(doc string, words []string) {
 			continue
 		}
 		lw := strings.ToLower(w)
-		if _, bad := idx.stop[lw]; bad {
+		if _, bad := stop[lw]; bad {
 			continue
 		}
-		s := stem(w)
+		s := stemLang(lang, w)
 		if s == "" {
 			continue
 		}
@@ -53,6 +144,10 @@ func (idx *InMemIndex) Add(doc string, words []string) {
 			idx.tf[s] = make(map[string]int)
 		}
 		idx.tf[s][doc]++
+		if _, ok := idx.form[s]; !ok {
+			idx.form[s] = lw
+		}
+		idx.addForm(formStem{lw, s})
 		if !seen[s] {
 			seen[s] = true
 		}
@@ -61,32 +156,134 @@ func (idx *InMemIndex) Add(doc string, words []string) {
 		idx.df[s]++
 	}
 	idx.docLen[doc] = kept
+	idx.docLang[doc] = lang
 	idx.N++
+	idx.gen.Add(1)
+}
+
+// Has reports whether doc is indexed.
+func (idx *InMemIndex) Has(doc string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	_, ok := idx.docLen[doc]
+	return ok
+}
+
+// Delete removes doc and its metadata, reporting whether it was indexed.
+// Stems no other document uses leave the dictionary.
+func (idx *InMemIndex) Delete(doc string) (bool, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.delete(doc), nil
+}
+
+// delete removes doc, reporting whether it was indexed; idx.mu must be held.
+func (idx *InMemIndex) delete(doc string) bool {
+	if _, ok := idx.docLen[doc]; !ok {
+		return false
+	}
+	gone := false
+	for s, docs := range idx.tf {
+		if _, ok := docs[doc]; !ok {
+			continue
+		}
+		delete(docs, doc)
+		if idx.df[s]--; idx.df[s] > 0 {
+			continue
+		}
+		delete(idx.df, s)
+		delete(idx.tf, s)
+		delete(idx.form, s)
+		gone = true
+	}
+	if gone {
+		kept := idx.forms[:0]
+		for _, fs := range idx.forms {
+			if _, ok := idx.form[fs.stem]; ok {
+				kept = append(kept, fs)
+			}
+		}
+		idx.forms = kept
+	}
+	delete(idx.docLen, doc)
+	delete(idx.docLang, doc)
+	delete(idx.meta, doc)
+	idx.deleteAnchors(doc)
+	idx.N--
+	idx.gen.Add(1)
+	return true
 }
 
-// GetN returns the total number of documents
+// deleteAnchors removes the anchor words added from links on source.
+func (idx *InMemIndex) deleteAnchors(source string) {
+	for key, c := range idx.anchorSrc[source] {
+		s, target, _ := strings.Cut(key, "\x00")
+		if idx.atf[s][target] -= c; idx.atf[s][target] <= 0 {
+			delete(idx.atf[s], target)
+			if len(idx.atf[s]) == 0 {
+				delete(idx.atf, s)
+			}
+		}
+		if idx.anchorLen[target] -= c; idx.anchorLen[target] <= 0 {
+			delete(idx.anchorLen, target)
+		}
+	}
+	delete(idx.anchorSrc, source)
+}
+
+// GetN returns the total number of documents, safely under concurrent
+// writes.
 func (idx *InMemIndex) GetN() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
 	return idx.N
 }
 
 // SearchTFIDF ranks a single-term query using TF-IDF.
 func (idx *InMemIndex) SearchTFIDF(term string) []Hit {
+	return idx.SearchTFIDFLang(term, "")
+}
+
+// SearchTFIDFLang ranks a single-term query within documents in lang.
+// An empty lang searches every document with the default pipeline.
+func (idx *InMemIndex) SearchTFIDFLang(term, lang string) []Hit {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
 	if term == "" || idx.N == 0 {
 		return nil
 	}
 	q := strings.ToLower(term)
-	if _, bad := idx.stop[q]; bad {
+	if _, bad := idx.stopFor(lang)[q]; bad {
 		return nil
 	}
-	s := stem(q)
+	return idx.searchStem(stemLang(lang, q), lang)
+}
+
+// SearchStem ranks documents containing the already-stemmed term s in
+// their body or in the anchor text of links pointing at them.
+func (idx *InMemIndex) SearchStem(s, lang string) []Hit {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.searchStem(s, lang)
+}
+
+func (idx *InMemIndex) searchStem(s, lang string) []Hit {
+	return mergeAnchorHits(idx.searchBody(s, lang), idx.searchAnchors(s, lang))
+}
+
+// searchBody scores the page body field for stem s.
+func (idx *InMemIndex) searchBody(s, lang string) []Hit {
 	df := idx.df[s]
-	if df == 0 {
+	if df == 0 || idx.N == 0 {
 		return nil
 	}
 	idf := math.Log(float64(idx.N) / float64(df))
 
 	hits := make([]Hit, 0, len(idx.tf[s]))
 	for doc, tfreq := range idx.tf[s] {
+		if lang != "" && idx.docLang[doc] != lang {
+			continue
+		}
 		den := idx.docLen[doc]
 		if den == 0 {
 			continue
@@ -102,6 +299,232 @@ func (idx *InMemIndex) SearchTFIDF(term string) []Hit {
 	return hits
 }
 
+// AddAnchor indexes anchor words of a link on source pointing at target.
+func (idx *InMemIndex) AddAnchor(source, target, lang string, words []string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, s := range anchorStems(idx.stopFor(lang), lang, words) {
+		if _, ok := idx.atf[s]; !ok {
+			idx.atf[s] = make(map[string]int)
+		}
+		idx.atf[s][target]++
+		idx.anchorLen[target]++
+		if idx.anchorSrc[source] == nil {
+			idx.anchorSrc[source] = make(map[string]int)
+		}
+		idx.anchorSrc[source][s+"\x00"+target]++
+	}
+	idx.gen.Add(1)
+}
+
+// Generation returns a counter bumped by every AddLang, AddAnchor, SetMeta
+// and Delete.
+func (idx *InMemIndex) Generation() uint64 {
+	return idx.gen.Load()
+}
+
+// searchAnchors scores the anchor field for stem s. Targets that are not
+// indexed yet are neither returned nor counted in df.
+func (idx *InMemIndex) searchAnchors(s, lang string) []Hit {
+	var df int
+	for target := range idx.atf[s] {
+		if _, ok := idx.docLen[target]; ok {
+			df++
+		}
+	}
+	if df == 0 {
+		return nil
+	}
+	idf := anchorIDF(idx.N, idx.df[s], df)
+
+	var hits []Hit
+	for target, c := range idx.atf[s] {
+		if _, ok := idx.docLen[target]; !ok {
+			continue
+		}
+		if lang != "" && idx.docLang[target] != lang {
+			continue
+		}
+		tf := float64(c) / float64(idx.anchorLen[target])
+		hits = append(hits, Hit{URL: target, Score: tf * idf})
+	}
+	return hits
+}
+
+// Explain breaks down how url scores for query with SearchQuery.
+func (idx *InMemIndex) Explain(query, url string) Explanation {
+	return idx.ExplainLang(query, url, "")
+}
+
+// ExplainLang is Explain for a search restricted to lang.
+func (idx *InMemIndex) ExplainLang(query, url, lang string) Explanation {
+	return explainStems(idx, url, lang, queryStems(idx, query, lang))
+}
+
+func (idx *InMemIndex) stemStats(s, url string) stemStats {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	st := stemStats{Lang: idx.docLang[url], N: idx.N}
+	st.DocLen, st.Indexed = idx.docLen[url]
+	if s == "" {
+		return st
+	}
+	st.TF, st.DF = idx.tf[s][url], idx.df[s]
+	st.ATF, st.AnchorLen = idx.atf[s][url], idx.anchorLen[url]
+	for target := range idx.atf[s] {
+		if _, ok := idx.docLen[target]; ok {
+			st.ADF++
+		}
+	}
+	return st
+}
+
+// Terms returns the term dictionary sorted by stem.
+func (idx *InMemIndex) Terms() []TermStat {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	out := make([]TermStat, 0, len(idx.df))
+	for s, df := range idx.df {
+		out = append(out, TermStat{Term: s, Form: idx.form[s], DF: df})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Term < out[j].Term })
+	return out
+}
+
+// TermCounts returns the number of distinct terms and the sum of their
+// document frequencies.
+func (idx *InMemIndex) TermCounts() (terms, postings int) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	for _, df := range idx.df {
+		postings += df
+	}
+	return len(idx.df), postings
+}
+
+// formStem pairs a surface word with the stem it was indexed under.
+type formStem struct {
+	form, stem string
+}
+
+func (a formStem) less(b formStem) bool {
+	if a.form != b.form {
+		return a.form < b.form
+	}
+	return a.stem < b.stem
+}
+
+// addForm inserts fs into the sorted forms unless it is already there.
+// Callers hold the write lock.
+func (idx *InMemIndex) addForm(fs formStem) {
+	i := sort.Search(len(idx.forms), func(i int) bool { return !idx.forms[i].less(fs) })
+	if i < len(idx.forms) && idx.forms[i] == fs {
+		return
+	}
+	idx.forms = slices.Insert(idx.forms, i, fs)
+}
+
+// PrefixTerms returns up to limit terms with a surface form starting with
+// prefix, most frequent first. Each term is reported once, with its first
+// matching form.
+func (idx *InMemIndex) PrefixTerms(prefix string, limit int) []TermStat {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	prefix = strings.ToLower(prefix)
+	i := sort.Search(len(idx.forms), func(i int) bool {
+		return idx.forms[i].form >= prefix
+	})
+	var out []TermStat
+	seen := make(map[string]bool)
+	for ; i < len(idx.forms) && strings.HasPrefix(idx.forms[i].form, prefix); i++ {
+		fs := idx.forms[i]
+		if seen[fs.stem] {
+			continue
+		}
+		seen[fs.stem] = true
+		out = append(out, TermStat{Term: fs.stem, Form: fs.form, DF: idx.df[fs.stem]})
+	}
+	return topTerms(out, limit)
+}
+
+// AddEdge records a link; duplicates are ignored.
+func (idx *InMemIndex) AddEdge(e Edge) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.seenE[e] {
+		return
+	}
+	idx.seenE[e] = true
+	idx.edges = append(idx.edges, e)
+}
+
+// Edges returns every stored link.
+func (idx *InMemIndex) Edges() []Edge {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return append([]Edge(nil), idx.edges...)
+}
+
+// SetPageRank replaces the stored PageRank scores with a copy of ranks.
+func (idx *InMemIndex) SetPageRank(ranks map[string]float64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ranks = maps.Clone(ranks)
+}
+
+// PageRanks returns a copy of the stored PageRank scores by URL.
+func (idx *InMemIndex) PageRanks() map[string]float64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	out := maps.Clone(idx.ranks)
+	if out == nil {
+		out = make(map[string]float64)
+	}
+	return out
+}
+
+// PageRank returns the stored scores of those of urls that have one.
+func (idx *InMemIndex) PageRank(urls []string) map[string]float64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	out := make(map[string]float64)
+	for _, u := range urls {
+		if r, ok := idx.ranks[u]; ok {
+			out[u] = r
+		}
+	}
+	return out
+}
+
+// SetMeta replaces the metadata stored for url.
+func (idx *InMemIndex) SetMeta(url string, m Metadata) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.meta[url] = m
+	idx.gen.Add(1)
+}
+
+// Meta returns the metadata stored for url.
+func (idx *InMemIndex) Meta(url string) (Metadata, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	m, ok := idx.meta[url]
+	return m, ok
+}
+
+// MetaBatch returns the metadata stored for those of urls that have any.
+func (idx *InMemIndex) MetaBatch(urls []string) map[string]Metadata {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	out := make(map[string]Metadata)
+	for _, u := range urls {
+		if m, ok := idx.meta[u]; ok {
+			out[u] = m
+		}
+	}
+	return out
+}
+
 // Close closes the indexer resources
 func (idx *InMemIndex) Close() error {
 	// No resources to close for in-memory index
@@ -0,0 +1,189 @@
+package project02
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/kljensen/snowball/english"
+	"github.com/kljensen/snowball/french"
+	"github.com/kljensen/snowball/hungarian"
+	"github.com/kljensen/snowball/norwegian"
+	"github.com/kljensen/snowball/russian"
+	"github.com/kljensen/snowball/spanish"
+	"github.com/kljensen/snowball/swedish"
+)
+
+// NormalizeLang maps a language tag such as "fr-CA" or "EN_us" to the
+// two-letter code used by the index. Unsupported languages map to "".
+func NormalizeLang(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	switch tag {
+	case "en", "fr", "es", "ru", "sv", "hu":
+		return tag
+	case "no", "nb", "nn":
+		return "no"
+	}
+	return ""
+}
+
+// stemLang stems w with the snowball stemmer for lang.
+// Unknown or empty languages fall back to English, like stem.
+func stemLang(lang, w string) string {
+	switch lang {
+	case "fr":
+		return french.Stem(w, true)
+	case "es":
+		return spanish.Stem(w, true)
+	case "ru":
+		return russian.Stem(w, true)
+	case "sv":
+		return swedish.Stem(w, true)
+	case "no":
+		return norwegian.Stem(w, true)
+	case "hu":
+		return hungarian.Stem(w, true)
+	}
+	return english.Stem(w, true)
+}
+
+// langMarkers lists a handful of very frequent function words per language.
+// They are distinctive enough for a cheap guess when <html lang> is missing.
+// Words that are common in more than one language, such as "a", "is", "de",
+// "que" or "det", are left out: they would count for the wrong language.
+func langMarkers() map[string][]string {
+	return map[string][]string{
+		"en": {"the", "and", "of", "to", "that", "with", "was", "this", "which", "were"},
+		"fr": {"les", "et", "des", "est", "une", "dans", "pour", "qui", "sur", "pas"},
+		"es": {"el", "los", "las", "y", "del", "una", "por", "con", "para", "como"},
+		"sv": {"och", "att", "är", "för", "inte", "jag", "ett", "från", "hade", "sig"},
+		"no": {"og", "er", "til", "ikke", "jeg", "seg", "fra", "ble", "hun", "ved"},
+		"hu": {"az", "és", "hogy", "nem", "egy", "meg", "van", "volt", "csak", "már"},
+	}
+}
+
+// langMinMarkers is how many marker words the best language needs, and
+// langMargin how many times more than the runner-up, for DetectLanguage
+// to trust its guess.
+const (
+	langMinMarkers = 3
+	langMargin     = 2
+)
+
+// DetectLanguage guesses the language of a token stream. Cyrillic text is
+// reported as Russian; otherwise the language whose marker words occur most
+// often wins if it clearly beats the runner-up. Returns "", the default
+// language, when there is not enough evidence or the guess is close.
+func DetectLanguage(words []string) string {
+	var cyrillic, latin int
+	for _, w := range words {
+		for _, r := range w {
+			if unicode.Is(unicode.Cyrillic, r) {
+				cyrillic++
+			} else if unicode.Is(unicode.Latin, r) {
+				latin++
+			}
+			break
+		}
+	}
+	if cyrillic > latin {
+		return "ru"
+	}
+
+	counts := make(map[string]int)
+	for lang, ws := range langMarkers() {
+		set := make(map[string]bool, len(ws))
+		for _, w := range ws {
+			set[w] = true
+		}
+		for _, w := range words {
+			if set[strings.ToLower(w)] {
+				counts[lang]++
+			}
+		}
+	}
+	best, bestN, secondN := "", 0, 0
+	for lang, n := range counts {
+		// Tie-break on the code so the result is deterministic.
+		if n > bestN || (n == bestN && lang < best) {
+			best, bestN, secondN = lang, n, bestN
+		} else if n > secondN {
+			secondN = n
+		}
+	}
+	if bestN < langMinMarkers || bestN < langMargin*secondN {
+		return ""
+	}
+	return best
+}
+
+// LoadStopwords reads a stopword file: one word per line, blank lines and
+// lines starting with '#' are ignored.
+func LoadStopwords(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := make(map[string]struct{})
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		w := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if w == "" || strings.HasPrefix(w, "#") {
+			continue
+		}
+		m[w] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadStopwordsDir loads every <lang>.txt file in dir and returns the sets
+// keyed by normalized language code. Files for unsupported languages are skipped.
+func LoadStopwordsDir(dir string) (map[string]map[string]struct{}, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]map[string]struct{})
+	for _, p := range paths {
+		lang := NormalizeLang(strings.TrimSuffix(filepath.Base(p), ".txt"))
+		if lang == "" {
+			continue
+		}
+		set, err := LoadStopwords(p)
+		if err != nil {
+			return nil, err
+		}
+		out[lang] = set
+	}
+	return out, nil
+}
+
+// ApplyStopwordsDir loads the <lang>.txt files in dir (see LoadStopwordsDir)
+// into idx and returns the languages it set, sorted. It fails when idx has
+// no per-language stopwords.
+func ApplyStopwordsDir(idx Indexer, dir string) ([]string, error) {
+	li, ok := idx.(LangStopwordIndexer)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support per-language stopwords", idx)
+	}
+	sets, err := LoadStopwordsDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	langs := sortedKeys(sets)
+	for _, lang := range langs {
+		li.SetLangStopwords(lang, sets[lang])
+	}
+	return langs, nil
+}
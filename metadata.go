@@ -0,0 +1,519 @@
+package project02
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Metadata is the structured data a page declares about itself. Fields are
+// merged from JSON-LD, microdata, OpenGraph and plain <meta>/<title> tags,
+// in that order of precedence.
+type Metadata struct {
+	Type          string `json:"type,omitempty"` // schema.org type, e.g. "Article"
+	Title         string `json:"title,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Author        string `json:"author,omitempty"`
+	DatePublished string `json:"datePublished,omitempty"`
+	DateModified  string `json:"dateModified,omitempty"`
+	Image         string `json:"image,omitempty"`
+	SiteName      string `json:"siteName,omitempty"`
+
+	// Recorded by the indexer rather than declared by the page.
+	Lang        string `json:"lang,omitempty"`        // document language code
+	ContentType string `json:"contentType,omitempty"` // media type of the response
+}
+
+// IsZero reports whether m carries no metadata.
+func (m Metadata) IsZero() bool { return m == Metadata{} }
+
+// merge fills the empty fields of m from o.
+func (m *Metadata) merge(o Metadata) {
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&m.Type, o.Type)
+	fill(&m.Title, o.Title)
+	fill(&m.Description, o.Description)
+	fill(&m.Author, o.Author)
+	fill(&m.DatePublished, o.DatePublished)
+	fill(&m.DateModified, o.DateModified)
+	fill(&m.Image, o.Image)
+	fill(&m.SiteName, o.SiteName)
+	fill(&m.Lang, o.Lang)
+	fill(&m.ContentType, o.ContentType)
+}
+
+// MetaIndexer is implemented by indexers that store document metadata.
+type MetaIndexer interface {
+	// SetMeta replaces the metadata stored for url.
+	SetMeta(url string, m Metadata)
+
+	// Meta returns the metadata stored for url.
+	Meta(url string) (Metadata, bool)
+}
+
+// MetaBatchIndexer is implemented by indexers that can look up the metadata
+// of many documents at once.
+type MetaBatchIndexer interface {
+	// MetaBatch returns the metadata stored for those of urls that have any.
+	MetaBatch(urls []string) map[string]Metadata
+}
+
+// LoadMeta returns the stored metadata of hits by URL, in one lookup when
+// the indexer supports it, so a request reads it once for filters, facets
+// and results. Indexers without metadata return nil.
+func LoadMeta(indexer Indexer, hits []Hit) map[string]Metadata {
+	urls := make([]string, len(hits))
+	for i, h := range hits {
+		urls[i] = h.URL
+	}
+	if bi, ok := indexer.(MetaBatchIndexer); ok {
+		return bi.MetaBatch(urls)
+	}
+	mi, ok := indexer.(MetaIndexer)
+	if !ok {
+		return nil
+	}
+	out := make(map[string]Metadata)
+	for _, u := range urls {
+		if m, ok := mi.Meta(u); ok {
+			out[u] = m
+		}
+	}
+	return out
+}
+
+// QueryFilter is a field:value term of a query, e.g. "type:Article".
+type QueryFilter struct {
+	Field string
+	Value string
+}
+
+func (f QueryFilter) String() string { return f.Field + ":" + f.Value }
+
+// Match reports whether m satisfies f. Values compare case-insensitively.
+func (f QueryFilter) Match(m Metadata) bool {
+	var v string
+	switch f.Field {
+	case "type":
+		v = m.Type
+	case "author":
+		v = m.Author
+	case "site":
+		v = m.SiteName
+	}
+	return v != "" && strings.EqualFold(v, f.Value)
+}
+
+// ParseFilters removes the metadata filters (type:, author:, site:) from q
+// and returns the remaining query text along with them. Filters narrow the
+// hits of the remaining terms, so a query of filters alone finds nothing.
+func ParseFilters(q string) (string, []QueryFilter) {
+	var rest []string
+	var filters []QueryFilter
+	for _, f := range strings.Fields(q) {
+		k, v, ok := strings.Cut(f, ":")
+		switch k = strings.ToLower(k); {
+		case ok && v != "" && (k == "type" || k == "author" || k == "site"):
+			filters = append(filters, QueryFilter{Field: k, Value: v})
+		default:
+			rest = append(rest, f)
+		}
+	}
+	return strings.Join(rest, " "), filters
+}
+
+// FilterHits keeps the hits whose stored metadata matches every filter.
+// Indexers without metadata match nothing once a filter is given.
+func FilterHits(indexer Indexer, hits []Hit, filters []QueryFilter) []Hit {
+	if len(filters) == 0 {
+		return hits
+	}
+	if _, ok := indexer.(MetaIndexer); !ok {
+		return nil
+	}
+	meta := LoadMeta(indexer, hits)
+	var out []Hit
+	for _, h := range hits {
+		m := meta[h.URL]
+		keep := true
+		for _, f := range filters {
+			if !f.Match(m) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// metaCollector gathers Metadata while ExtractDocumentWith walks the tree.
+type metaCollector struct {
+	ld, micro, og, plain Metadata
+
+	items      int // top-level microdata items seen
+	scopeDepth int // nesting of itemscope elements
+}
+
+// enter is called for n before its children are walked.
+func (mc *metaCollector) enter(n *html.Node) {
+	if n.Type != html.ElementNode {
+		return
+	}
+	switch strings.ToLower(n.Data) {
+	case "script":
+		if strings.EqualFold(strings.TrimSpace(attr(n, "type")), "application/ld+json") && n.FirstChild != nil {
+			mc.ld.merge(parseJSONLD(n.FirstChild.Data))
+		}
+	case "title":
+		if mc.plain.Title == "" {
+			mc.plain.Title = nodeText(n)
+		}
+	case "meta":
+		mc.meta(n)
+	}
+
+	if prop := attr(n, "itemprop"); prop != "" && mc.scopeDepth == 1 && mc.items == 1 {
+		mc.itemprop(n, prop)
+	}
+	if _, ok := attrOK(n, "itemscope"); ok {
+		if mc.scopeDepth == 0 {
+			mc.items++
+			if mc.items == 1 {
+				mc.micro.Type = schemaType(attr(n, "itemtype"))
+			}
+		}
+		mc.scopeDepth++
+	}
+}
+
+// leave is called for n after its children are walked.
+func (mc *metaCollector) leave(n *html.Node) {
+	if n.Type != html.ElementNode {
+		return
+	}
+	if _, ok := attrOK(n, "itemscope"); ok {
+		mc.scopeDepth--
+	}
+}
+
+// meta reads OpenGraph (<meta property="og:...">) and plain <meta name> tags.
+func (mc *metaCollector) meta(n *html.Node) {
+	content := strings.TrimSpace(attr(n, "content"))
+	if content == "" {
+		return
+	}
+	key := strings.ToLower(attr(n, "property"))
+	if key == "" {
+		key = strings.ToLower(attr(n, "name"))
+	}
+	set := func(dst *string) {
+		if *dst == "" {
+			*dst = content
+		}
+	}
+	switch key {
+	case "og:type":
+		// og types are lower-case ("article", "video.movie"); match schema.org casing.
+		if mc.og.Type == "" {
+			t := content[strings.LastIndexByte(content, '.')+1:]
+			if t != "" {
+				mc.og.Type = strings.ToUpper(t[:1]) + t[1:]
+			}
+		}
+	case "og:title":
+		set(&mc.og.Title)
+	case "og:description":
+		set(&mc.og.Description)
+	case "og:image", "og:image:url":
+		set(&mc.og.Image)
+	case "og:site_name":
+		set(&mc.og.SiteName)
+	case "article:author":
+		set(&mc.og.Author)
+	case "article:published_time":
+		set(&mc.og.DatePublished)
+	case "article:modified_time":
+		set(&mc.og.DateModified)
+	case "author":
+		set(&mc.plain.Author)
+	case "description":
+		set(&mc.plain.Description)
+	}
+}
+
+// itemprop records a property of the first top-level microdata item.
+func (mc *metaCollector) itemprop(n *html.Node, prop string) {
+	v := microValue(n)
+	if v == "" {
+		return
+	}
+	set := func(dst *string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	for _, p := range strings.Fields(prop) {
+		switch p {
+		case "name", "headline":
+			set(&mc.micro.Title)
+		case "description":
+			set(&mc.micro.Description)
+		case "author", "creator":
+			set(&mc.micro.Author)
+		case "datePublished":
+			set(&mc.micro.DatePublished)
+		case "dateModified":
+			set(&mc.micro.DateModified)
+		case "image":
+			set(&mc.micro.Image)
+		}
+	}
+}
+
+// result merges the collected sources in order of precedence.
+func (mc *metaCollector) result() Metadata {
+	m := mc.ld
+	m.merge(mc.micro)
+	m.merge(mc.og)
+	m.merge(mc.plain)
+	return m
+}
+
+// attrOK is attr that also reports whether the attribute is present, for
+// boolean attributes such as itemscope.
+func attrOK(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// microValue returns the value of a microdata property element. A nested
+// item (e.g. an author Person) is represented by its name property.
+func microValue(n *html.Node) string {
+	if _, ok := attrOK(n, "itemscope"); ok {
+		var name string
+		var find func(*html.Node)
+		find = func(c *html.Node) {
+			for ; c != nil && name == ""; c = c.NextSibling {
+				if c.Type == html.ElementNode && hasToken(attr(c, "itemprop"), "name") {
+					name = microValue(c)
+					return
+				}
+				find(c.FirstChild)
+			}
+		}
+		find(n.FirstChild)
+		if name != "" {
+			return name
+		}
+	}
+	if v, ok := attrOK(n, "content"); ok {
+		return strings.TrimSpace(v)
+	}
+	switch strings.ToLower(n.Data) {
+	case "time":
+		if v := attr(n, "datetime"); v != "" {
+			return strings.TrimSpace(v)
+		}
+	case "a", "link", "area":
+		return strings.TrimSpace(attr(n, "href"))
+	case "img", "audio", "video", "source", "embed", "iframe":
+		return strings.TrimSpace(attr(n, "src"))
+	case "meta":
+		return ""
+	}
+	return nodeText(n)
+}
+
+// schemaType strips the vocabulary prefix of a type IRI:
+// "https://schema.org/NewsArticle" -> "NewsArticle".
+func schemaType(t string) string {
+	t = strings.TrimSpace(strings.TrimRight(strings.TrimSpace(t), "/"))
+	if f := strings.Fields(t); len(f) > 0 {
+		t = f[0]
+	}
+	if i := strings.LastIndexAny(t, "/#:"); i >= 0 {
+		t = t[i+1:]
+	}
+	return t
+}
+
+// parseJSONLD extracts Metadata from a JSON-LD script body. Top-level arrays
+// and @graph are searched for the most specific typed object; objects that
+// describe the site rather than the page only fill what it leaves empty.
+func parseJSONLD(s string) Metadata {
+	containers := map[string]bool{
+		"WebSite": true, "WebPage": true, "Organization": true, "BreadcrumbList": true,
+		"ImageObject": true, "Person": true, "SearchAction": true,
+	}
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return Metadata{}
+	}
+	var objs []map[string]any
+	var collect func(any)
+	collect = func(v any) {
+		switch x := v.(type) {
+		case []any:
+			for _, c := range x {
+				collect(c)
+			}
+		case map[string]any:
+			if g, ok := x["@graph"]; ok {
+				collect(g)
+			}
+			if _, ok := x["@type"]; ok {
+				objs = append(objs, x)
+			}
+		}
+	}
+	collect(v)
+
+	var primary, rest Metadata
+	for _, o := range objs {
+		m := ldObject(o)
+		if primary.Type == "" && !containers[m.Type] {
+			primary = m
+		} else {
+			rest.merge(m)
+		}
+	}
+	primary.merge(rest)
+	return primary
+}
+
+// ldObject maps one schema.org JSON-LD object onto Metadata.
+func ldObject(o map[string]any) Metadata {
+	m := Metadata{
+		Type:          schemaType(ldString(o["@type"])),
+		Title:         ldString(o["headline"]),
+		Description:   ldString(o["description"]),
+		Author:        ldString(o["author"]),
+		DatePublished: ldString(o["datePublished"]),
+		DateModified:  ldString(o["dateModified"]),
+		Image:         ldString(o["image"]),
+	}
+	if m.Title == "" {
+		m.Title = ldString(o["name"])
+	}
+	if m.Author == "" {
+		m.Author = ldString(o["creator"])
+	}
+	return m
+}
+
+// ldString flattens a JSON-LD value to a string: the first element of an
+// array, or the name (then url, then @id) of a nested object.
+func ldString(v any) string {
+	switch x := v.(type) {
+	case string:
+		return strings.TrimSpace(x)
+	case []any:
+		for _, c := range x {
+			if s := ldString(c); s != "" {
+				return s
+			}
+		}
+	case map[string]any:
+		for _, k := range []string{"name", "url", "@id"} {
+			if s := ldString(x[k]); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// createMetaTables creates the document metadata table shared by the SQLite indexers.
+func createMetaTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS doc_meta (
+			url TEXT PRIMARY KEY,
+			type TEXT NOT NULL DEFAULT '',
+			title TEXT NOT NULL DEFAULT '',
+			description TEXT NOT NULL DEFAULT '',
+			author TEXT NOT NULL DEFAULT '',
+			date_published TEXT NOT NULL DEFAULT '',
+			date_modified TEXT NOT NULL DEFAULT '',
+			image TEXT NOT NULL DEFAULT '',
+			site_name TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_doc_meta_type ON doc_meta(type);
+	`)
+	if err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "doc_meta", "lang", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "doc_meta", "content_type", "TEXT NOT NULL DEFAULT ''")
+}
+
+func sqlSetMeta(db *sql.DB, url string, m Metadata) {
+	_, _ = db.Exec(`
+		INSERT OR REPLACE INTO doc_meta
+			(url, type, title, description, author, date_published, date_modified, image, site_name, lang, content_type)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		url, m.Type, m.Title, m.Description, m.Author, m.DatePublished, m.DateModified, m.Image, m.SiteName,
+		m.Lang, m.ContentType)
+}
+
+// sqlMetaBatch looks up the metadata of urls, sqlMetaChunk at a time to stay
+// under SQLite's limit on query parameters.
+func sqlMetaBatch(db *sql.DB, urls []string) map[string]Metadata {
+	out := make(map[string]Metadata)
+	for len(urls) > 0 {
+		chunk := urls[:min(len(urls), sqlMetaChunk)]
+		urls = urls[len(chunk):]
+		args := make([]any, len(chunk))
+		for i, u := range chunk {
+			args[i] = u
+		}
+		rows, err := db.Query(`
+			SELECT url, type, title, description, author, date_published, date_modified, image, site_name, lang, content_type
+			FROM doc_meta WHERE url IN (?`+strings.Repeat(", ?", len(chunk)-1)+`)`, args...)
+		if err != nil {
+			return out
+		}
+		for rows.Next() {
+			var u string
+			var m Metadata
+			if err := rows.Scan(&u, &m.Type, &m.Title, &m.Description, &m.Author, &m.DatePublished, &m.DateModified,
+				&m.Image, &m.SiteName, &m.Lang, &m.ContentType); err != nil {
+				continue
+			}
+			out[u] = m
+		}
+		rows.Close()
+	}
+	return out
+}
+
+// sqlMetaChunk is how many URLs one sqlMetaBatch query looks up.
+const sqlMetaChunk = 500
+
+func sqlMeta(db *sql.DB, url string) (Metadata, bool) {
+	var m Metadata
+	err := db.QueryRow(`
+		SELECT type, title, description, author, date_published, date_modified, image, site_name, lang, content_type
+		FROM doc_meta WHERE url = ?`, url).
+		Scan(&m.Type, &m.Title, &m.Description, &m.Author, &m.DatePublished, &m.DateModified, &m.Image, &m.SiteName,
+			&m.Lang, &m.ContentType)
+	if err != nil {
+		return Metadata{}, false
+	}
+	return m, true
+}
@@ -0,0 +1,351 @@
+package project02
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PingIndexer is implemented by indexers backed by a database that can be
+// checked for readiness.
+type PingIndexer interface {
+	// Ping returns an error when the backing database cannot be queried.
+	Ping() error
+}
+
+// Metrics collects request and crawl counters and writes them in the
+// Prometheus text exposition format. A nil *Metrics records nothing.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[routeCode]uint64
+	latency  map[string]*histogram // route -> request durations
+
+	fetched, failed, indexed uint64
+	skipped                  map[string]uint64 // reason -> pages
+	bytes                    uint64            // downloaded body bytes
+}
+
+type routeCode struct {
+	route string
+	code  int
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	n      uint64
+}
+
+// NewMetrics creates an empty metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[routeCode]uint64),
+		latency:  make(map[string]*histogram),
+		skipped:  make(map[string]uint64),
+	}
+}
+
+// ObserveRequest records one request served by route.
+func (m *Metrics) ObserveRequest(route string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[routeCode{route, code}]++
+	h := m.latency[route]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[route] = h
+	}
+	s := d.Seconds()
+	h.counts[sort.SearchFloat64s(latencyBuckets, s)]++
+	h.sum += s
+	h.n++
+}
+
+func (m *Metrics) crawlFetched(bytes int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.fetched++
+	m.bytes += uint64(bytes)
+	m.mu.Unlock()
+}
+
+func (m *Metrics) crawlFailed() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.failed++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) crawlIndexed() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.indexed++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) crawlSkipped(reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.skipped[reason]++
+	m.mu.Unlock()
+}
+
+// Instrument wraps h, which is mux or middleware in front of it, so every
+// request is counted under the pattern of mux that matches it. This keeps
+// the route label bounded.
+func (m *Metrics) Instrument(mux *http.ServeMux, h http.Handler) http.Handler {
+	if m == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "other"
+		}
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(sw, r)
+		m.ObserveRequest(route, sw.code, time.Since(start))
+	})
+}
+
+// statusWriter remembers the status code and counts the body bytes
+// written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// WriteTo writes the collected counters in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := &promWriter{w: w}
+
+	p.header("search_http_requests_total", "counter", "HTTP requests by route and status code.")
+	keys := make([]routeCode, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		p.sample("search_http_requests_total", labels("route", k.route, "code", strconv.Itoa(k.code)), float64(m.requests[k]))
+	}
+
+	p.header("search_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	for _, route := range sortedKeys(m.latency) {
+		h := m.latency[route]
+		var cum uint64
+		for i, c := range h.counts {
+			cum += c
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			p.sample("search_http_request_duration_seconds_bucket", labels("route", route, "le", le), float64(cum))
+		}
+		p.sample("search_http_request_duration_seconds_sum", labels("route", route), h.sum)
+		p.sample("search_http_request_duration_seconds_count", labels("route", route), float64(h.n))
+	}
+
+	p.header("search_crawl_pages_total", "counter", "Crawled pages by outcome.")
+	p.sample("search_crawl_pages_total", labels("result", "fetched"), float64(m.fetched))
+	p.sample("search_crawl_pages_total", labels("result", "failed"), float64(m.failed))
+	p.sample("search_crawl_pages_total", labels("result", "indexed"), float64(m.indexed))
+	p.header("search_crawl_skipped_total", "counter", "Crawled pages not fetched or not indexed, by reason.")
+	for _, reason := range sortedKeys(m.skipped) {
+		p.sample("search_crawl_skipped_total", labels("reason", reason), float64(m.skipped[reason]))
+	}
+	p.header("search_download_bytes_total", "counter", "Bytes of response bodies downloaded by the crawler.")
+	p.sample("search_download_bytes_total", "", float64(m.bytes))
+	return p.n, p.err
+}
+
+// writeIndexMetrics writes size gauges for each index, labelled with its
+// collection. Term and posting counts need a TermCountIndexer, or else a
+// TermIndexer whose dictionary is listed; postings are the sum of document
+// frequencies.
+func writeIndexMetrics(w io.Writer, indexes []mountedIndex) {
+	p := &promWriter{w: w}
+	type size struct {
+		name            string
+		terms, postings int
+		hasTerms        bool
+		documents       int
+	}
+	var sizes []size
+	for _, m := range indexes {
+		if m.indexer == nil {
+			continue
+		}
+		sz := size{name: m.name, documents: m.indexer.GetN()}
+		if ci, ok := m.indexer.(TermCountIndexer); ok {
+			sz.terms, sz.postings = ci.TermCounts()
+			sz.hasTerms = true
+		} else if ti, ok := m.indexer.(TermIndexer); ok {
+			terms := ti.Terms()
+			sz.terms, sz.hasTerms = len(terms), true
+			for _, ts := range terms {
+				sz.postings += ts.DF
+			}
+		}
+		sizes = append(sizes, sz)
+	}
+	if len(sizes) == 0 {
+		return
+	}
+	p.header("search_index_documents", "gauge", "Documents in the index.")
+	for _, sz := range sizes {
+		p.sample("search_index_documents", indexLabels(sz.name), float64(sz.documents))
+	}
+	p.header("search_index_terms", "gauge", "Distinct terms in the index.")
+	for _, sz := range sizes {
+		if sz.hasTerms {
+			p.sample("search_index_terms", indexLabels(sz.name), float64(sz.terms))
+		}
+	}
+	p.header("search_index_postings", "gauge", "Term-document pairs in the index.")
+	for _, sz := range sizes {
+		if sz.hasTerms {
+			p.sample("search_index_postings", indexLabels(sz.name), float64(sz.postings))
+		}
+	}
+}
+
+// writeCacheMetrics writes the counters of each index's QueryCache.
+func writeCacheMetrics(w io.Writer, indexes []mountedIndex) {
+	p := &promWriter{w: w}
+	var names []string
+	var stats []CacheStats
+	for _, m := range indexes {
+		if m.cfg.cache != nil {
+			names = append(names, m.name)
+			stats = append(stats, m.cfg.cache.Stats())
+		}
+	}
+	if len(stats) == 0 {
+		return
+	}
+	p.header("search_query_cache_requests_total", "counter", "Query cache lookups by result.")
+	for i, st := range stats {
+		p.sample("search_query_cache_requests_total", indexLabels(names[i], "result", "hit"), float64(st.Hits))
+		p.sample("search_query_cache_requests_total", indexLabels(names[i], "result", "miss"), float64(st.Misses))
+	}
+	p.header("search_query_cache_evictions_total", "counter", "Query cache entries dropped for space or staleness.")
+	for i, st := range stats {
+		p.sample("search_query_cache_evictions_total", indexLabels(names[i]), float64(st.Evictions))
+	}
+	p.header("search_query_cache_entries", "gauge", "Entries in the query cache.")
+	for i, st := range stats {
+		p.sample("search_query_cache_entries", indexLabels(names[i]), float64(st.Entries))
+	}
+	p.header("search_query_cache_bytes", "gauge", "Estimated size of the cached results.")
+	for i, st := range stats {
+		p.sample("search_query_cache_bytes", indexLabels(names[i]), float64(st.Bytes))
+	}
+}
+
+// promWriter writes exposition lines, keeping the first error.
+type promWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name, labels string, v float64) {
+	p.printf("%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// indexLabels is labels with a collection label first, unless collection
+// is the default index ("").
+func indexLabels(collection string, kv ...string) string {
+	if collection != "" {
+		kv = append([]string{"collection", collection}, kv...)
+	}
+	if len(kv) == 0 {
+		return ""
+	}
+	return labels(kv...)
+}
+
+// labels formats name/value pairs as {a="x",b="y"}.
+func labels(kv ...string) string {
+	s := "{"
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			s += ","
+		}
+		s += kv[i] + `="` + labelEscaper.Replace(kv[i+1]) + `"`
+	}
+	return s + "}"
+}
+
+// labelEscaper escapes a label value for the text exposition format, which
+// only knows backslash, double quote and line feed escapes.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sqlPing checks that db answers a query, not just that it is open.
+func sqlPing(db *sql.DB) error {
+	var one int
+	return db.QueryRow("SELECT 1").Scan(&one)
+}
@@ -2,15 +2,33 @@ package project02
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
+	"math"
+	"math/bits"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
 )
 
 // --- TestExtract ---
@@ -334,3 +352,2208 @@ func TestTfIdf(t *testing.T) {
 		t.Fatalf("Top hit for 'frankenstein' should be from Frankenstein corpus, got %s", h2[0].URL)
 	}
 }
+
+// --- TestMultilingual (html lang, per-language stemming and lang filter) ---
+
+func TestMultilingual(t *testing.T) {
+	fr := ExtractDocument([]byte(`<html lang="fr-FR"><body>Nous mangeons. Vous mangez.</body></html>`))
+	if fr.Lang != "fr" {
+		t.Fatalf("ExtractDocument lang=%q; want fr", fr.Lang)
+	}
+	en := ExtractDocument([]byte(`<html><body>The cat and the dog went to the park with the ball.</body></html>`))
+	if en.Lang != "en" {
+		t.Fatalf("DetectLanguage fallback=%q; want en", en.Lang)
+	}
+	// Words shared with Hungarian ("a", "is", "de") do not outvote English,
+	// and a close call falls back to the default language.
+	mixed := strings.Fields("a de facto rule is a habit of the trade and a norm is de rigueur")
+	if got := DetectLanguage(mixed); got != "en" {
+		t.Fatalf("DetectLanguage(English with a/is/de)=%q; want en", got)
+	}
+	if got := DetectLanguage(strings.Fields("the cat and the dog et les chats et les chiens")); got != "" {
+		t.Fatalf("DetectLanguage(half English, half French)=%q; want the default", got)
+	}
+
+	idx := NewInMemIndex(nil)
+	idx.SetLangStopwords("fr", map[string]struct{}{"nous": {}, "vous": {}})
+	IndexDocument(idx, "fr.html", fr)
+	IndexDocument(idx, "en.html", en)
+
+	// French stemming folds "manger" and "mangez" onto the same stem.
+	hits := idx.SearchTFIDFLang("manger", "fr")
+	if len(hits) != 1 || hits[0].URL != "fr.html" {
+		t.Fatalf("SearchTFIDFLang(manger, fr)=%#v; want fr.html", hits)
+	}
+	if got := idx.docLen["fr.html"]; got != 2 {
+		t.Fatalf("French stopwords should be removed; docLen=%d", got)
+	}
+	// The lang filter excludes documents in other languages.
+	if hits := idx.SearchTFIDFLang("cat", "fr"); len(hits) != 0 {
+		t.Fatalf("lang filter should exclude English docs; got %#v", hits)
+	}
+
+	// Stopword files named by language are loaded from a directory.
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "fr.txt"), []byte("# French\nnous\nvous\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "xx.txt"), []byte("ignored\n"), 0o644)
+	fromDir := NewInMemIndex(nil)
+	langs, err := ApplyStopwordsDir(fromDir, dir)
+	if err != nil || !reflect.DeepEqual(langs, []string{"fr"}) {
+		t.Fatalf("ApplyStopwordsDir=%v, %v; want [fr]", langs, err)
+	}
+	if !fromDir.Stopword("Nous", "fr") || fromDir.Stopword("nous", "en") {
+		t.Fatalf("stopwords from dir not applied per language")
+	}
+}
+
+// --- TestCJK (bigram tokenization and matching query segmentation) ---
+
+func TestCJK(t *testing.T) {
+	got := Tokenize("Go语言教程 hello", true)
+	want := []string{"go", "语言", "言教", "教程", "hello"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Tokenize=%#v; want %#v", got, want)
+	}
+	// Without the mode the whole run stays a single token.
+	if got := Tokenize("语言教程", false); !reflect.DeepEqual(got, []string{"语言教程"}) {
+		t.Fatalf("Tokenize without CJK mode=%#v", got)
+	}
+
+	// Default extraction splits CJK the same way queries do.
+	page := []byte(`<html><body><p>搜索引擎的实现</p></body></html>`)
+	other := []byte(`<html><body><p>数据库设计</p></body></html>`)
+	idx := NewInMemIndex(nil)
+	IndexDocument(idx, "cn1", ExtractDocument(page))
+	IndexDocument(idx, "cn2", ExtractDocument(other))
+
+	hits := SearchQuery(idx, "搜索引擎", "")
+	if len(hits) != 1 || hits[0].URL != "cn1" {
+		t.Fatalf("SearchQuery(搜索引擎)=%#v; want cn1", hits)
+	}
+	if hits, _ := NewFuzzySearcher(idx).Search("数据库", ""); len(hits) == 0 || hits[0].URL != "cn2" {
+		t.Fatalf("FuzzySearcher(数据库)=%#v; want cn2", hits)
+	}
+}
+
+// --- TestFuzzy (typo expansion and "did you mean" suggestions) ---
+
+func TestFuzzy(t *testing.T) {
+	if d := levenshtein("kitten", "sitting"); d != 3 {
+		t.Fatalf("levenshtein(kitten, sitting)=%d; want 3", d)
+	}
+
+	idx := NewInMemIndex(nil)
+	idx.Add("a", []string{"concurrency", "in", "go"})
+	idx.Add("b", []string{"concurrency", "patterns"})
+	idx.Add("c", []string{"memory", "model"})
+
+	srv := httptest.NewServer(NewMux(idx))
+	defer srv.Close()
+
+	// The default body is the plain hit array, the suggestion a header.
+	resp, err := http.Get(srv.URL + "/search?q=concurency")
+	if err != nil {
+		t.Fatalf("GET /search: %v", err)
+	}
+	defer resp.Body.Close()
+	var hits []SearchHit
+	if err := json.NewDecoder(resp.Body).Decode(&hits); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(hits) != 2 {
+		t.Fatalf("fuzzy search should match both concurrency docs; got %#v", hits)
+	}
+	if got := resp.Header.Get(SuggestionHeader); got != "concurrency" {
+		t.Fatalf("suggestion header=%q; want %q", got, "concurrency")
+	}
+
+	// Corrected terms score lower than exact matches.
+	exact := SearchQuery(idx, "concurrency", "")
+	if hits[0].Score >= exact[0].Score {
+		t.Fatalf("corrected score %v should be below exact score %v", hits[0].Score, exact[0].Score)
+	}
+
+	// format=v2 returns the suggestion in the body.
+	resp, err = http.Get(srv.URL + "/search?q=concurency+go&format=v2")
+	if err != nil {
+		t.Fatalf("GET /search: %v", err)
+	}
+	defer resp.Body.Close()
+	var sr SearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if sr.Suggestion != "concurrency go" || len(sr.Hits) != 2 {
+		t.Fatalf("v2 response=%#v; want suggestion %q", sr, "concurrency go")
+	}
+
+	// A term with hits is not respelled to a slightly more common neighbour.
+	idx.Add("d", []string{"pattern"})
+	if _, s := NewFuzzySearcher(idx).Search("patterns", ""); s != "" {
+		t.Fatalf("suggested %q for a term with hits", s)
+	}
+	for _, d := range []string{"e", "f", "g", "h", "i"} {
+		idx.Add(d, []string{"modal"})
+	}
+	if _, s := NewFuzzySearcher(idx).Search("model", ""); s != "modal" {
+		t.Fatalf("suggestion for a rare spelling=%q; want modal", s)
+	}
+
+	// New terms reach the dictionary through a background rebuild, and
+	// searches meanwhile use the old dictionary.
+	f := NewFuzzySearcher(idx)
+	f.RebuildInterval = 0
+	f.Search("go", "")
+	idx.Add("j", []string{"goroutine"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if hits, _ := f.Search("gorutine", ""); len(hits) == 1 && hits[0].URL == "j" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the dictionary was never rebuilt with the new term")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.RebuildInterval = time.Hour
+	idx.Add("k", []string{"channels"})
+	if hits, _ := f.Search("chanels", ""); len(hits) != 0 {
+		t.Fatalf("rebuilt within RebuildInterval: %#v", hits)
+	}
+}
+
+// --- TestSuggest (prefix completions and prefix* wildcard queries) ---
+
+func TestSuggest(t *testing.T) {
+	idx := NewInMemIndex(nil)
+	idx.Add("a", []string{"search", "engine"})
+	idx.Add("b", []string{"searching", "sea"})
+	idx.Add("c", []string{"search", "seal"})
+
+	srv := httptest.NewServer(NewMux(idx))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/suggest?q=sea&n=2")
+	if err != nil {
+		t.Fatalf("GET /suggest: %v", err)
+	}
+	defer resp.Body.Close()
+	var got []Completion
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	// "search" and "searching" share a stem (df=3) and outrank "sea"/"seal".
+	want := []Completion{{Text: "search", DF: 3}, {Text: "sea", DF: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("/suggest=%#v; want %#v", got, want)
+	}
+
+	hits := SearchQuery(idx, "eng*", "")
+	if len(hits) != 1 || hits[0].URL != "a" {
+		t.Fatalf("SearchQuery(eng*)=%#v; want [a]", hits)
+	}
+	if got := ParseQuery("go sea*"); !reflect.DeepEqual(got, []string{"go", "sea*"}) {
+		t.Fatalf("ParseQuery kept wildcard wrong: %#v", got)
+	}
+
+	// Every surface form of a stem is completed, not only the first seen.
+	dir := t.TempDir()
+	sq, err := NewSQLiteIndex(filepath.Join(dir, "v1.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sq.Close()
+	sq2, err := NewSQLiteIndexV2(filepath.Join(dir, "v2.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sq2.Close()
+	for _, ix := range []Indexer{idx, sq, sq2} {
+		if ix != Indexer(idx) {
+			ix.Add("a", []string{"search", "engine"})
+			ix.Add("b", []string{"searching", "sea"})
+		}
+		pi := ix.(PrefixIndexer)
+		if got := pi.PrefixTerms("searchi", 5); len(got) != 1 || got[0].Form != "searching" || got[0].Term != "search" {
+			t.Fatalf("%T PrefixTerms(searchi)=%#v; want the searching form of search", ix, got)
+		}
+		got := pi.PrefixTerms("sea", 5)
+		if len(got) < 2 || got[0].Form != "search" || got[1].Term == "search" {
+			t.Fatalf("%T PrefixTerms(sea)=%#v; want search once, first", ix, got)
+		}
+	}
+}
+
+// --- TestPageRank (crawl records the link graph; PageRank boosts hubs) ---
+
+func TestPageRank(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body><a href="/hub">Go memory model</a> <a href="/leaf">leaf</a></body></html>`)
+	})
+	mux.HandleFunc("/leaf", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body>go go go <a href="/hub">hub</a></body></html>`)
+	})
+	mux.HandleFunc("/hub", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body>go tutorial <a href="/">home</a></body></html>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	idx := NewInMemIndex(nil)
+	idx.Add("other", []string{"unrelated"}) // keeps idf("go") above zero
+	if _, err := CrawlWith(srv.URL+"/", CrawlConfig{Max: 10, Indexer: idx, Graph: idx}); err != nil {
+		t.Fatalf("CrawlWith error: %v", err)
+	}
+	want := Edge{Source: srv.URL + "/", Target: srv.URL + "/hub", Anchor: "Go memory model"}
+	if !idx.seenE[want] {
+		t.Fatalf("edge %#v not recorded; got %#v", want, idx.Edges())
+	}
+
+	ranks := UpdatePageRank(idx)
+	hub := srv.URL + "/hub"
+	for u, r := range ranks {
+		if u != hub && r >= ranks[hub] {
+			t.Fatalf("hub should have the highest PageRank; ranks=%v", ranks)
+		}
+	}
+
+	// TF-IDF alone prefers /leaf (densest "go"); PageRank lifts /hub.
+	hits := SearchQuery(idx, "go", "")
+	if hits[0].URL != srv.URL+"/leaf" {
+		t.Fatalf("TF-IDF top=%s; want /leaf", hits[0].URL)
+	}
+	if got := BlendPageRank(hits, LoadPageRank(idx, hits), 0.7); got[0].URL != hub {
+		t.Fatalf("blended top=%s; want %s", got[0].URL, hub)
+	}
+
+	// The in-memory index neither keeps nor hands out its callers' maps.
+	ranks[hub] = 0
+	if got := idx.PageRanks(); got[hub] == 0 {
+		t.Fatal("SetPageRank kept the caller's map")
+	}
+	idx.PageRanks()[hub] = 0
+	if got := idx.PageRank([]string{hub, "missing"}); got[hub] == 0 || len(got) != 1 {
+		t.Fatalf("PageRank(hub, missing)=%v", got)
+	}
+
+	// SQLite indexes look up only the requested rows.
+	dir := t.TempDir()
+	sq, err := NewSQLiteIndex(filepath.Join(dir, "v1.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sq.Close()
+	sq2, err := NewSQLiteIndexV2(filepath.Join(dir, "v2.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sq2.Close()
+	for name, g := range map[string]GraphIndexer{"v1": sq, "v2": sq2} {
+		g.SetPageRank(map[string]float64{"a": 0.5, "b": 0.3, "c": 0.2})
+		got := LoadPageRank(g, []Hit{{URL: "a"}, {URL: "c"}, {URL: "d"}})
+		if !reflect.DeepEqual(got, map[string]float64{"a": 0.5, "c": 0.2}) {
+			t.Fatalf("%s: LoadPageRank=%v", name, got)
+		}
+	}
+}
+
+// --- TestAnchorText (incoming anchor text is indexed on the target) ---
+
+func TestAnchorText(t *testing.T) {
+	a := []byte(`<html><body>notes <a href="/b.html">Go memory model</a> <a href="#top">memory</a></body></html>`)
+	links := ExtractLinks(a)
+	want := []Link{{Href: "/b.html", Text: "Go memory model"}, {Href: "#top", Text: "memory"}}
+	if !reflect.DeepEqual(links, want) {
+		t.Fatalf("ExtractLinks=%#v; want %#v", links, want)
+	}
+
+	idx := NewInMemIndex(nil)
+	// A is indexed before B; its anchor must still apply to B later.
+	IndexDocument(idx, "http://x.test/a.html", ExtractDocument(a))
+	for _, h := range SearchQuery(idx, "model", "") {
+		if strings.HasSuffix(h.URL, "b.html") {
+			t.Fatalf("anchor target not indexed yet should not match; got %#v", h)
+		}
+	}
+	IndexDocument(idx, "http://x.test/b.html", ExtractDocument([]byte(`<html><body>happens before rules</body></html>`)))
+	IndexDocument(idx, "http://x.test/c.html", ExtractDocument([]byte(`<html><body>unrelated</body></html>`)))
+
+	// "model" only appears in A's body and in A's link to B.
+	hits := SearchQuery(idx, "model", "")
+	if len(hits) != 2 || hits[0].URL != "http://x.test/a.html" || hits[1].URL != "http://x.test/b.html" {
+		t.Fatalf("SearchQuery(model)=%#v; want a.html then b.html via anchor text", hits)
+	}
+
+	// Indexing A again (a recrawl) must not count its anchors twice.
+	IndexDocument(idx, "http://x.test/a.html", ExtractDocument(a))
+	for _, te := range idx.Explain("model", "http://x.test/b.html").Terms {
+		if te.Field == "anchor" && (te.TF != 1 || te.DocLen != 3) {
+			t.Fatalf("after re-indexing a.html anchor of b.html has tf=%d len=%d; want 1 and 3", te.TF, te.DocLen)
+		}
+	}
+}
+
+// --- TestDedup (SimHash near-duplicates: merge groups and cluster collapse) ---
+
+func TestDedup(t *testing.T) {
+	var base, other []string
+	for i := 0; i < 200; i++ {
+		base = append(base, "page"+strconv.Itoa(i))
+		other = append(other, "other"+strconv.Itoa(i))
+	}
+	near := append(append([]string(nil), base...), "printed", "view")
+
+	if d := bits.OnesCount64(SimHash(base) ^ SimHash(near)); d > 3 {
+		t.Fatalf("near-duplicate Hamming distance=%d; want <= 3", d)
+	}
+
+	m := NewDeduper(DedupMerge, 3)
+	if ok, _ := m.Observe("a", base); !ok {
+		t.Fatalf("first page must be indexed")
+	}
+	if ok, c := m.Observe("a?print=1", near); ok || c != "a" {
+		t.Fatalf("merge mode: Observe near-dup = (%v, %q); want (false, a)", ok, c)
+	}
+	if ok, _ := m.Observe("b", other); !ok {
+		t.Fatalf("distinct page must be indexed")
+	}
+	if g := m.Group("a?print=1"); !reflect.DeepEqual(g, []string{"a", "a?print=1"}) {
+		t.Fatalf("Group=%#v", g)
+	}
+
+	c := NewDeduper(DedupCluster, 3)
+	c.Observe("a", base)
+	if ok, _ := c.Observe("a/", near); !ok {
+		t.Fatalf("cluster mode should still index near-duplicates")
+	}
+	hits := []Hit{{URL: "a/", Score: 2}, {URL: "b", Score: 1.5}, {URL: "a", Score: 1}}
+	want := []Hit{{URL: "a/", Score: 2}, {URL: "b", Score: 1.5}}
+	if got := c.Collapse(hits); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Collapse=%#v; want %#v", got, want)
+	}
+
+	// Pages without words share SimHash 0 but are not duplicates.
+	if ok, canon := c.Observe("empty1", nil); !ok || canon != "empty1" {
+		t.Fatalf("Observe(empty1)=(%v, %q)", ok, canon)
+	}
+	if ok, canon := c.Observe("empty2", nil); !ok || canon != "empty2" {
+		t.Fatalf("Observe(empty2)=(%v, %q); empty pages must not be grouped", ok, canon)
+	}
+
+	// Groups stored in SQLite are found again after reopening it.
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	sq, err := NewSQLiteIndex(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewDeduper(DedupMerge, 3)
+	p.Persist(sq)
+	p.Observe("a", base)
+	p.Observe("a?print=1", near)
+	sq.Close()
+	if sq, err = NewSQLiteIndex(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer sq.Close()
+	p = NewDeduper(DedupMerge, 3)
+	p.Persist(sq)
+	if g := p.Group("a"); !reflect.DeepEqual(g, []string{"a", "a?print=1"}) {
+		t.Fatalf("reloaded Group=%#v", g)
+	}
+	if ok, canon := p.Observe("a?amp=1", near); ok || canon != "a" {
+		t.Fatalf("reloaded Observe near-dup=(%v, %q); want (false, a)", ok, canon)
+	}
+
+	// Forgetting a canonical page promotes its earliest member, in memory
+	// and in the store; forgetting the last member dissolves the group.
+	p.Forget("a")
+	if g := p.Group("a?amp=1"); !reflect.DeepEqual(g, []string{"a?print=1", "a?amp=1"}) {
+		t.Fatalf("Group after forgetting the canonical page=%#v", g)
+	}
+	if ok, canon := p.Observe("a?m=1", near); ok || canon != "a?print=1" {
+		t.Fatalf("Observe near-dup after Forget=(%v, %q); want (false, a?print=1)", ok, canon)
+	}
+	reloaded := NewDeduper(DedupMerge, 3)
+	reloaded.Persist(sq)
+	if g := reloaded.Groups(); !reflect.DeepEqual(g, p.Groups()) {
+		t.Fatalf("reloaded Groups=%#v; want %#v", g, p.Groups())
+	}
+	for _, u := range []string{"a?amp=1", "a?m=1"} {
+		p.Forget(u)
+	}
+	if g := p.Groups(); len(g) != 0 {
+		t.Fatalf("Groups after forgetting every member=%#v", g)
+	}
+
+	// Deleting a document through the admin API removes it from /duplicates.
+	idx := NewInMemIndex(nil)
+	d := NewDeduper(DedupCluster, 3)
+	for u, words := range map[string][]string{"http://x/a": base, "http://x/b": near} {
+		d.Observe(u, words)
+		idx.Add(u, words)
+	}
+	srv := httptest.NewServer(NewMux(idx, WithDeduper(d), WithAdmin(AdminConfig{Token: "s3cret"})))
+	defer srv.Close()
+	req, _ := http.NewRequest("DELETE", srv.URL+"/admin/documents?url=http://x/b", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE = %d", resp.StatusCode)
+	}
+	if g := d.Groups(); len(g) != 0 {
+		t.Fatalf("/duplicates still reports a deleted page: %#v", g)
+	}
+}
+
+// --- TestCanonicalize (URL normalization and rel=canonical in Crawl) ---
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"HTTP://Example.COM/a", "http://example.com/a"},
+		{"http://example.com:80/a", "http://example.com/a"},
+		{"https://example.com:443", "https://example.com/"},
+		{"http://example.com:8080/a", "http://example.com:8080/a"},
+		{"http://example.com/a/./b/../", "http://example.com/a/"},
+		{"http://example.com/%7euser/%2fx%3a", "http://example.com/~user/%2Fx%3A"},
+		{"http://example.com/p?b=2&a=1", "http://example.com/p?a=1&b=2"},
+		{"http://example.com/p?utm_source=x&id=3&fbclid=y#top", "http://example.com/p?id=3"},
+		{"a.html", "a.html"}, // not an absolute URL: unchanged
+	}
+	for _, tc := range tests {
+		if got := Canonicalize(tc.in); got != tc.want {
+			t.Fatalf("Canonicalize(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+	keep := CanonicalOptions{StripParams: []string{"sid"}}
+	if got := CanonicalizeWith("http://x.com/?utm_a=1&sid=9", keep); got != "http://x.com/?utm_a=1" {
+		t.Fatalf("CanonicalizeWith custom strip=%q", got)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body>
+			<a href="/a?y=2&x=1">a</a> <a href="/a?x=1&y=2&utm_medium=m">a again</a>
+			<a href="/b/./c/../">b</a> <a href="/print">print</a></body></html>`)
+	})
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "a") })
+	mux.HandleFunc("/b/", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "b") })
+	mux.HandleFunc("/print", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><head><link rel="canonical" href="/article"></head><body>printable text</body></html>`)
+	})
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><head><link rel="canonical" href="/article"></head><body>article text</body></html>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	idx := NewInMemIndex(nil)
+	var st CrawlStats
+	got, err := CrawlWith(srv.URL+"/", CrawlConfig{Max: 10, Indexer: idx, Stats: &st})
+	if err != nil {
+		t.Fatalf("CrawlWith error: %v", err)
+	}
+	want := []string{srv.URL + "/", srv.URL + "/a?x=1&y=2", srv.URL + "/b/", srv.URL + "/print", srv.URL + "/article"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("CrawlWith visited %#v; want %#v", got, want)
+	}
+	// The canonical page is fetched itself rather than shadowed by its alias.
+	if _, ok := idx.docLen[srv.URL+"/print"]; ok {
+		t.Fatalf("page naming another rel=canonical URL should not be indexed")
+	}
+	if hits := SearchQuery(idx, "article", ""); len(hits) != 1 || hits[0].URL != srv.URL+"/article" {
+		t.Fatalf("SearchQuery(article)=%#v; want the fetched /article page", hits)
+	}
+	if len(SearchQuery(idx, "printable", "")) != 0 || st.Skipped[SkipCanonical] != 1 {
+		t.Fatalf("alias content indexed or not counted; skipped=%v", st.Skipped)
+	}
+}
+
+// --- TestSitemaps (robots.txt discovery, sitemap index, gzip, lastmod) ---
+
+func TestSitemaps(t *testing.T) {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "User-agent: *\nSitemap: "+srv.URL+"/sitemap-index.xml\n")
+	})
+	mux.HandleFunc("/sitemap-index.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<?xml version="1.0"?><sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+			<sitemap><loc>`+srv.URL+`/pages.xml.gz</loc></sitemap></sitemapindex>`)
+	})
+	mux.HandleFunc("/pages.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, `<?xml version="1.0"?><urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+			<url><loc>`+srv.URL+`/low</loc><priority>0.1</priority></url>
+			<url><loc>`+srv.URL+`/old</loc><lastmod>2020-01-01</lastmod></url>
+			<url><loc>`+srv.URL+`/orphan</loc><lastmod>2024-05-01T10:00:00Z</lastmod><priority>0.9</priority></url>
+		</urlset>`)
+		zw.Close()
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			io.WriteString(w, `<html><body><a href="/linked">linked</a></body></html>`)
+			return
+		}
+		io.WriteString(w, `<html><body>no links here</body></html>`)
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	entries := FetchSitemaps(srv.URL)
+	if len(entries) != 3 || entries[0].Loc != srv.URL+"/orphan" || entries[2].Loc != srv.URL+"/low" {
+		t.Fatalf("FetchSitemaps order=%#v", entries)
+	}
+
+	last := map[string]time.Time{srv.URL + "/old": time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	got, err := CrawlWith(srv.URL+"/", CrawlConfig{Max: 10, Sitemaps: true, LastCrawled: last})
+	if err != nil {
+		t.Fatalf("CrawlWith error: %v", err)
+	}
+	want := []string{srv.URL + "/", srv.URL + "/orphan", srv.URL + "/linked", srv.URL + "/low"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("CrawlWith with sitemaps=%#v; want %#v", got, want)
+	}
+	if len(last) != 5 || last[srv.URL+"/orphan"].Before(last[srv.URL+"/old"]) || !last[srv.URL+"/old"].Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("LastCrawled after crawl=%v; want fetch times added, /old kept", last)
+	}
+
+	// A small Max still reaches links found on pages.
+	got, err = CrawlWith(srv.URL+"/", CrawlConfig{Max: 3, Sitemaps: true})
+	if err != nil {
+		t.Fatalf("CrawlWith error: %v", err)
+	}
+	if want := want[:3]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("CrawlWith Max 3 with sitemaps=%#v; want %#v", got, want)
+	}
+
+	// A gzip sitemap expanding past the protocol's 50 MB is refused.
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write([]byte(`<urlset>`))
+	zw.Write(make([]byte, maxSitemapSize))
+	zw.Close()
+	if _, _, err := ParseSitemap(bomb.Bytes()); !errors.Is(err, errSitemapTooLarge) {
+		t.Fatalf("ParseSitemap(%d compressed bytes) error=%v; want errSitemapTooLarge", bomb.Len(), err)
+	}
+}
+
+// --- TestRobotsDirectives (meta robots, X-Robots-Tag, rel=nofollow/ugc) ---
+
+func TestRobotsDirectives(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body>home
+			<a href="/hidden">hidden</a> <a href="/tagged">tagged</a> <a href="/closed">closed</a>
+			<a href="/spam" rel="nofollow">spam</a> <a href="/comment" rel="ugc noopener">comment</a></body></html>`)
+	})
+	mux.HandleFunc("/hidden", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><head><meta name="robots" content="noindex"></head><body>secret <a href="/deep">deep</a></body></html>`)
+	})
+	mux.HandleFunc("/tagged", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex")
+		io.WriteString(w, `<html><body>tagged secret</body></html>`)
+	})
+	mux.HandleFunc("/closed", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><head><meta name="ROBOTS" content="nofollow"></head><body>closed <a href="/never">never</a></body></html>`)
+	})
+	mux.HandleFunc("/deep", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "deep") })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	idx := NewInMemIndex(nil)
+	var st CrawlStats
+	got, err := CrawlWith(srv.URL+"/", CrawlConfig{Max: 20, Indexer: idx, Stats: &st})
+	if err != nil {
+		t.Fatalf("CrawlWith error: %v", err)
+	}
+	want := []string{srv.URL + "/", srv.URL + "/hidden", srv.URL + "/tagged", srv.URL + "/closed", srv.URL + "/deep"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("CrawlWith visited %#v; want %#v", got, want)
+	}
+	if hits := SearchQuery(idx, "secret", ""); len(hits) != 0 {
+		t.Fatalf("noindex pages must not be indexed; got %#v", hits)
+	}
+	if st.Fetched != 5 || st.Indexed != 3 || st.Skipped[SkipNoIndex] != 2 || st.NoFollowLinks != 2 || st.NoFollowPages != 1 {
+		t.Fatalf("unexpected stats %#v", st)
+	}
+	if ni, nf := ParseRobots("otherbot: noindex, NOFOLLOW"); ni || nf {
+		t.Fatalf("ParseRobots scoped directive = (%v, %v); want (false, false)", ni, nf)
+	}
+	if ni, nf := ParseRobots("otherbot: noindex, *: nofollow, unavailable_after: 25 Jun 2010 15:00:00 PST, noarchive"); ni || !nf {
+		t.Fatalf("ParseRobots rescoped directives = (%v, %v); want (false, true)", ni, nf)
+	}
+}
+
+// --- TestCharset (header/meta/BOM detection, transcoding and NFC) ---
+
+func TestCharset(t *testing.T) {
+	// "café naïve" in ISO-8859-1.
+	latin1 := []byte("<html><body>caf\xe9 na\xefve</body></html>")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latin1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		w.Write(latin1)
+	})
+	feed := []byte(`<?xml version="1.0" encoding="ISO-8859-1"?><rss><channel><item><link>/i</link><title>caf` + "\xe9" + `</title></item></channel></rss>`)
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write(feed)
+	})
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=iso-8859-1")
+		w.Write([]byte(`{"title": "naïve"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	b, err := Download(srv.URL + "/latin1")
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	words, _ := Extract(b)
+	if !reflect.DeepEqual(words, []string{"café", "naïve"}) {
+		t.Fatalf("header charset: words=%#v", words)
+	}
+
+	// XML declarations are honoured too, whether or not the body went
+	// through Download. JSON is always UTF-8, whatever its header says.
+	reg := DefaultExtractors()
+	for _, tc := range []struct {
+		path, ct string
+		raw      []byte
+		want     string
+	}{
+		{"/feed", "application/rss+xml", feed, "café"},
+		{"/json", "application/json", nil, "naïve"},
+	} {
+		b, err := Download(srv.URL + tc.path)
+		if err != nil {
+			t.Fatalf("Download(%s): %v", tc.path, err)
+		}
+		bodies := [][]byte{b}
+		if tc.raw != nil {
+			bodies = append(bodies, tc.raw)
+		}
+		for _, body := range bodies {
+			docs := reg.For(tc.ct, body).Extract(srv.URL+tc.path, body, ExtractOptions{})
+			if len(docs) != 1 || !reflect.DeepEqual(docs[0].Words, []string{tc.want}) {
+				t.Fatalf("%s: docs=%#v; want words [%s]", tc.path, docs, tc.want)
+			}
+		}
+	}
+
+	// A UTF-8 page without a declaration is not taken for windows-1252
+	// because its first KB is ASCII.
+	page := []byte("<html><body>" + strings.Repeat("plain ", 200) + "naïve</body></html>")
+	if out, name := ToUTF8(page, "text/html"); name != "utf-8" || !bytes.Equal(out, page) {
+		t.Fatalf("undeclared UTF-8: name=%q", name)
+	}
+
+	// Raw Shift_JIS bytes with only a <meta charset> to go on.
+	sjis, _ := japanese.ShiftJIS.NewEncoder().String(`<html><head><meta charset="shift_jis"></head><body>日本語</body></html>`)
+	if words, _ := Extract([]byte(sjis)); !reflect.DeepEqual(words, []string{"日本", "本語"}) {
+		t.Fatalf("meta charset: words=%#v", words)
+	}
+
+	// UTF-16 with a BOM.
+	utf16le, _ := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String("<p>hello</p>")
+	if words, _ := Extract([]byte(utf16le)); !reflect.DeepEqual(words, []string{"hello"}) {
+		t.Fatalf("BOM: words=%#v", words)
+	}
+
+	// Decomposed "e" + combining acute is normalized to the composed form.
+	if got := Tokenize("cafe\u0301", false); !reflect.DeepEqual(got, []string{"caf\u00e9"}) {
+		t.Fatalf("NFC: Tokenize=%#v", got)
+	}
+}
+
+// --- TestBoilerplate (content mode drops site chrome but keeps its links) ---
+
+func TestBoilerplate(t *testing.T) {
+	page := []byte(`<html><body>
+		<header><h1>Project Gutenberg</h1></header>
+		<nav><a href="/index.html">Index</a></nav>
+		<div style="display: none">We use cookies</div>
+		<div role="search">Search books</div>
+		<div class="menu"><a href="/a.html">Dracula</a> | <a href="/b.html">Frankenstein</a></div>
+		<main><article><header><h2>Chapter one</h2></header>
+			<p>Whale ahoy, said <a href="/ahab.html">Ahab</a> to the crew of the ship.</p>
+			<footer>Posted by Ishmael</footer></article></main>
+		<aside>Related titles</aside>
+		<noscript>Enable JavaScript</noscript>
+		<footer>Copyright notice</footer>
+	</body></html>`)
+
+	full := ExtractDocument(page)
+	content := ExtractDocumentWith(page, ExtractOptions{Boilerplate: true, MaxLinkDensity: 0.5})
+
+	has := func(words []string, w string) bool {
+		for _, x := range words {
+			if x == w {
+				return true
+			}
+		}
+		return false
+	}
+	for _, w := range []string{"gutenberg", "index", "cookies", "search", "dracula", "related", "javascript", "copyright"} {
+		if !has(full.Words, w) {
+			t.Fatalf("default mode should keep %q; got %#v", w, full.Words)
+		}
+		if has(content.Words, w) {
+			t.Fatalf("boilerplate mode should drop %q; got %#v", w, content.Words)
+		}
+	}
+	for _, w := range []string{"chapter", "whale", "ahab", "ship", "ishmael"} {
+		if !has(content.Words, w) {
+			t.Fatalf("boilerplate mode lost content word %q; got %#v", w, content.Words)
+		}
+	}
+	if !reflect.DeepEqual(content.Hrefs, full.Hrefs) {
+		t.Fatalf("boilerplate mode must keep links: %#v vs %#v", content.Hrefs, full.Hrefs)
+	}
+}
+
+// --- TestExtractors (text, Markdown, RSS/Atom and JSON selected by Content-Type) ---
+
+func TestExtractors(t *testing.T) {
+	reg := DefaultExtractors()
+	extract := func(ct, body string) []*Document {
+		e := reg.For(ct, []byte(body))
+		if e == nil {
+			t.Fatalf("no extractor for %q", ct)
+		}
+		return e.Extract("http://example.com/", []byte(body), ExtractOptions{})
+	}
+
+	docs := extract("text/plain; charset=utf-8", "Call me Ishmael.")
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0].Words, []string{"call", "me", "ishmael"}) {
+		t.Fatalf("text extractor got %#v", docs)
+	}
+
+	docs = extract("text/markdown", "# Moby Dick\nSee [the whale](/whale.html \"w\") and ![cover](/c.png) or <https://example.org/x>.")
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0].Hrefs, []string{"/whale.html", "https://example.org/x"}) {
+		t.Fatalf("markdown links got %#v", docs)
+	}
+	if w := strings.Join(docs[0].Words, " "); w != "moby dick see the whale and cover or" {
+		t.Fatalf("markdown words got %q", w)
+	}
+
+	rss := `<?xml version="1.0"?><rss version="2.0"><channel><title>Feed</title>
+		<item><title>First whale</title><link>http://example.com/1</link><description>&lt;p&gt;harpoon&lt;/p&gt;</description></item>
+		<item><title>Second</title><link>http://example.com/2</link><description>ship</description></item>
+		<item><title>Third</title><guid>http://example.com/3</guid></item>
+		<item><title>Nowhere</title><guid isPermaLink="false">42</guid></item>
+	</channel></rss>`
+	docs = extract("application/rss+xml", rss)
+	if len(docs) != 3 || docs[0].URL != "http://example.com/1" || !reflect.DeepEqual(docs[0].Words, []string{"first", "whale", "harpoon"}) || docs[2].URL != "http://example.com/3" {
+		t.Fatalf("rss items got %#v", docs)
+	}
+	if docs := extract("application/rss+xml", "<rss><channel><item>"); docs != nil {
+		t.Fatalf("malformed feed got %#v; want nil", docs)
+	}
+	atom := `<feed xmlns="http://www.w3.org/2005/Atom"><entry><title>Entry</title>
+		<link rel="self" href="http://example.com/self"/><link href="http://example.com/e"/><summary>sea</summary></entry></feed>`
+	docs = extract("application/atom+xml", atom)
+	if len(docs) != 1 || docs[0].URL != "http://example.com/e" || !reflect.DeepEqual(docs[0].Words, []string{"entry", "sea"}) {
+		t.Fatalf("atom entries got %#v", docs)
+	}
+
+	docs = extract("application/ld+json", `{"name": "Queequeg", "url": "http://example.com/q", "tags": ["harpooner"]}`)
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0].Words, []string{"queequeg", "harpooner"}) || !reflect.DeepEqual(docs[0].Hrefs, []string{"http://example.com/q"}) {
+		t.Fatalf("json extractor got %#v", docs)
+	}
+	if reg.For("image/png", nil) != nil {
+		t.Fatalf("image/png should be unsupported")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body>home <a href="/notes.md">notes</a> <a href="/feed.xml">feed</a> <a href="/logo.png">logo</a> <a href="/bad.json">bad</a></body></html>`)
+	})
+	mux.HandleFunc("/notes.md", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/markdown")
+		io.WriteString(w, "Whale notes, see [data](/data.json)")
+	})
+	mux.HandleFunc("/data.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"text": "ambergris"}`)
+	})
+	mux.HandleFunc("/logo.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	})
+	mux.HandleFunc("/bad.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"text": `)
+	})
+	mux.HandleFunc("/pequod", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body>The Pequod sails from Nantucket</body></html>`)
+	})
+	mux.HandleFunc("/gone", http.NotFound)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		io.WriteString(w, `<rss><channel><item><title>Pequod</title><link>`+srv.URL+`/pequod</link></item>
+			<item><title>Starbuck</title><link>/gone</link></item>
+			<item><title>Rachel</title><link>http://elsewhere.test/rachel</link></item></channel></rss>`)
+	})
+
+	idx := NewInMemIndex(nil)
+	var st CrawlStats
+	if _, err := CrawlWith(srv.URL+"/", CrawlConfig{Max: 10, Indexer: idx, Stats: &st}); err != nil {
+		t.Fatalf("CrawlWith error: %v", err)
+	}
+	// Feed items are indexed under their item URL and replaced by their own
+	// page when it can be fetched; off-host items are not indexed.
+	for term, url := range map[string]string{"whale": "/notes.md", "ambergris": "/data.json", "nantucket": "/pequod",
+		"starbuck": "/gone"} {
+		hits := SearchQuery(idx, term, "")
+		if len(hits) != 1 || hits[0].URL != srv.URL+url {
+			t.Fatalf("search %q got %#v; want %s", term, hits, url)
+		}
+	}
+	if hits := SearchQuery(idx, "rachel", ""); len(hits) != 0 {
+		t.Fatalf("off-host feed item indexed: %#v", hits)
+	}
+	if hits := SearchQuery(idx, "pequod", ""); len(hits) != 1 || idx.GetN() != 5 || st.Indexed != 5 {
+		t.Fatalf("item page should replace its feed version; hits %#v, %d docs", hits, idx.GetN())
+	}
+	if st.Skipped[SkipUnsupported] != 1 || st.Skipped[SkipUnparsable] != 1 || st.Skipped[SkipOffHost] != 1 {
+		t.Fatalf("unexpected stats %#v", st)
+	}
+}
+
+// --- TestStructuredData (JSON-LD, microdata, OpenGraph and type: filters) ---
+
+func TestStructuredData(t *testing.T) {
+	ld := []byte(`<html><head><title>Whales | Sea News</title>
+		<meta property="og:type" content="article"><meta property="og:site_name" content="Sea News">
+		<meta property="og:image" content="http://example.com/og.png">
+		<script type="application/ld+json">{"@context": "https://schema.org", "@graph": [
+			{"@type": "WebSite", "name": "Sea News"},
+			{"@type": "NewsArticle", "headline": "Whales return", "datePublished": "2024-05-01",
+			 "author": [{"@type": "Person", "name": "Ishmael"}]}]}</script>
+		</head><body>whale sightings</body></html>`)
+	d := ExtractDocument(ld)
+	want := Metadata{Type: "NewsArticle", Title: "Whales return", Author: "Ishmael", DatePublished: "2024-05-01",
+		Image: "http://example.com/og.png", SiteName: "Sea News"}
+	if d.Meta != want {
+		t.Fatalf("JSON-LD metadata %#v; want %#v", d.Meta, want)
+	}
+	if strings.Contains(strings.Join(d.Words, " "), "ishmael") {
+		t.Fatalf("JSON-LD must not be indexed as text; got %#v", d.Words)
+	}
+
+	micro := []byte(`<html><body><div itemscope itemtype="http://schema.org/Recipe">
+		<h1 itemprop="name">Chowder</h1>
+		<span itemprop="author" itemscope itemtype="http://schema.org/Person"><span itemprop="name">Queequeg</span></span>
+		<time itemprop="datePublished" datetime="2024-06-02">June 2</time>
+		<p>clam whale chowder</p></div></body></html>`)
+	d = ExtractDocument(micro)
+	want = Metadata{Type: "Recipe", Title: "Chowder", Author: "Queequeg", DatePublished: "2024-06-02"}
+	if d.Meta != want {
+		t.Fatalf("microdata %#v; want %#v", d.Meta, want)
+	}
+
+	og := []byte(`<html><head><title>Plain</title><meta property="og:type" content="video.movie">
+		<meta name="author" content="Melville"></head><body>whale film</body></html>`)
+	d = ExtractDocument(og)
+	want = Metadata{Type: "Movie", Title: "Plain", Author: "Melville"}
+	if d.Meta != want {
+		t.Fatalf("OpenGraph metadata %#v; want %#v", d.Meta, want)
+	}
+
+	idx := NewInMemIndex(nil)
+	IndexDocument(idx, "http://example.com/news", ExtractDocument(ld))
+	IndexDocument(idx, "http://example.com/recipe", ExtractDocument(micro))
+	IndexDocument(idx, "http://example.com/film", ExtractDocument(og))
+	// A second version of an indexed URL is ignored, metadata included.
+	IndexDocument(idx, "http://example.com/news", ExtractDocument(og))
+	if m, _ := idx.Meta("http://example.com/news"); m.Type != "NewsArticle" {
+		t.Fatalf("re-indexing replaced metadata: %#v", m)
+	}
+
+	if hits := SearchQuery(idx, "whale type:recipe", ""); len(hits) != 1 || hits[0].URL != "http://example.com/recipe" {
+		t.Fatalf("type:recipe got %#v", hits)
+	}
+	if hits := SearchQuery(idx, "whale author:melville", ""); len(hits) != 1 || hits[0].URL != "http://example.com/film" {
+		t.Fatalf("author:melville got %#v", hits)
+	}
+
+	srv := httptest.NewServer(NewMux(idx))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/search?q=" + url.QueryEscape("whales type:NewsArticle"))
+	if err != nil {
+		t.Fatalf("GET /search: %v", err)
+	}
+	defer resp.Body.Close()
+	var hits []SearchHit
+	if err := json.NewDecoder(resp.Body).Decode(&hits); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(hits) != 1 || hits[0].URL != "http://example.com/news" || hits[0].Meta == nil || hits[0].Meta.Author != "Ishmael" {
+		t.Fatalf("/search with type filter got %#v", hits)
+	}
+}
+
+// --- TestFacets (host/path/lang/date filters and facet counts, all backends) ---
+
+func TestFacets(t *testing.T) {
+	dir := t.TempDir()
+	sq, err := NewSQLiteIndex(filepath.Join(dir, "v1.db"), nil)
+	if err != nil {
+		t.Fatalf("NewSQLiteIndex: %v", err)
+	}
+	defer sq.Close()
+	sq2, err := NewSQLiteIndexV2(filepath.Join(dir, "v2.db"), nil)
+	if err != nil {
+		t.Fatalf("NewSQLiteIndexV2: %v", err)
+	}
+	defer sq2.Close()
+
+	docs := []struct {
+		url string
+		doc Document
+	}{
+		{"http://a.com/blog/1", Document{Words: []string{"cod", "song"}, Lang: "en",
+			Meta: Metadata{ContentType: "text/html", DatePublished: "2024-03-10"}}},
+		{"http://a.com/blog/2", Document{Words: []string{"cod", "oil"}, Lang: "en",
+			Meta: Metadata{ContentType: "text/html", DatePublished: "2024-07-01T12:00:00Z"}}},
+		{"http://a.com/notes.md", Document{Words: []string{"cod", "notes"}, Lang: "en",
+			Meta: Metadata{ContentType: "text/markdown"}}},
+		{"http://b.org/baleine", Document{Words: []string{"cod", "baleine"}, Lang: "fr",
+			Meta: Metadata{ContentType: "text/html", DatePublished: "2024-03-31"}}},
+	}
+	for _, idx := range []Indexer{NewInMemIndex(nil), sq, sq2} {
+		for _, d := range docs {
+			doc := d.doc
+			IndexDocument(idx, d.url, &doc)
+		}
+		hits := SearchQuery(idx, "cod", "")
+
+		meta := LoadMeta(idx, hits)
+		many := append([]Hit(nil), hits...)
+		for i := 0; i < 1200; i++ {
+			many = append(many, Hit{URL: "http://c.net/" + strconv.Itoa(i)})
+		}
+		if got := LoadMeta(idx, many); !reflect.DeepEqual(got, meta) || len(meta) != len(docs) {
+			t.Fatalf("%T LoadMeta over %d hits got %d entries; want %d", idx, len(many), len(got), len(docs))
+		}
+		f := CountFacets(hits, meta, 0)
+		want := Facets{
+			Hosts:        []FacetCount{{"a.com", 3}, {"b.org", 1}},
+			ContentTypes: []FacetCount{{"text/html", 3}, {"text/markdown", 1}},
+			Langs:        []FacetCount{{"en", 3}, {"fr", 1}},
+		}
+		if !reflect.DeepEqual(f, want) {
+			t.Fatalf("%T facets %#v; want %#v", idx, f, want)
+		}
+
+		urls := func(hs []Hit) []string {
+			var out []string
+			for _, h := range hs {
+				out = append(out, h.URL)
+			}
+			sort.Strings(out)
+			return out
+		}
+		cases := []struct {
+			f    SearchFilter
+			want []string
+		}{
+			{SearchFilter{Host: "A.com", PathPrefix: "/blog/"}, []string{"http://a.com/blog/1", "http://a.com/blog/2"}},
+			{SearchFilter{Lang: "fr"}, []string{"http://b.org/baleine"}},
+			{SearchFilter{From: ParseDateBound("2024-03-01", false), To: ParseDateBound("2024-03-31", true)},
+				[]string{"http://a.com/blog/1", "http://b.org/baleine"}},
+		}
+		for _, c := range cases {
+			if got := urls(ApplyFilter(hits, meta, c.f)); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("%T filter %+v got %#v; want %#v", idx, c.f, got, c.want)
+			}
+		}
+	}
+
+	srv := httptest.NewServer(NewMux(sq))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/search?q=cod&host=a.com&date_from=2024-06-01&format=v2")
+	if err != nil {
+		t.Fatalf("GET /search: %v", err)
+	}
+	defer resp.Body.Close()
+	var sr SearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(sr.Hits) != 1 || sr.Hits[0].URL != "http://a.com/blog/2" || sr.Hits[0].Meta.Lang != "en" {
+		t.Fatalf("/search filters got %#v", sr.Hits)
+	}
+	if sr.Facets == nil || !reflect.DeepEqual(sr.Facets.Hosts, []FacetCount{{"a.com", 1}}) {
+		t.Fatalf("/search facets got %#v", sr.Facets)
+	}
+}
+
+// --- TestExplain (per-term breakdown matches search scores on all backends) ---
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	sq, err := NewSQLiteIndex(filepath.Join(dir, "v1.db"), nil)
+	if err != nil {
+		t.Fatalf("NewSQLiteIndex: %v", err)
+	}
+	defer sq.Close()
+	sq2, err := NewSQLiteIndexV2(filepath.Join(dir, "v2.db"), nil)
+	if err != nil {
+		t.Fatalf("NewSQLiteIndexV2: %v", err)
+	}
+	defer sq2.Close()
+
+	docs := map[string]*Document{
+		"http://x.com/a": {Words: []string{"whale", "whale", "ship", "the"},
+			Links: []Link{{Href: "http://x.com/b", Text: "whale ships"}}},
+		"http://x.com/b": {Words: []string{"harpoon", "shipping", "news"}},
+		"http://x.com/c": {Words: []string{"sea", "salt"}},
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for _, idx := range []Indexer{NewInMemIndex(nil), sq, sq2} {
+		for _, u := range []string{"http://x.com/a", "http://x.com/b", "http://x.com/c"} {
+			IndexDocument(idx, u, docs[u])
+		}
+		ei := idx.(ExplainIndexer)
+		q := "the whale ship*"
+		hits := SearchQuery(idx, q, "")
+		if len(hits) != 2 {
+			t.Fatalf("%T hits %#v", idx, hits)
+		}
+		for _, h := range hits {
+			if ex := ei.Explain(q, h.URL); !near(ex.Score, h.Score) {
+				t.Fatalf("%T explain %s score %v; search score %v (%#v)", idx, h.URL, ex.Score, h.Score, ex)
+			}
+		}
+
+		// Backends may count document length differently (V2 keeps stopwords),
+		// which is exactly what the breakdown is for.
+		ex := ei.Explain("whale", "http://x.com/a")
+		if len(ex.Terms) != 1 {
+			t.Fatalf("%T explain whale got %#v", idx, ex)
+		}
+		te := ex.Terms[0]
+		if te.Field != "body" || te.TF != 2 || te.DF != 1 || te.N != 3 || !near(te.IDF, math.Log(3)) || te.Boost != 1 ||
+			!near(te.Score, 2/float64(te.DocLen)*math.Log(3)) {
+			t.Fatalf("%T body breakdown %#v", idx, te)
+		}
+
+		ex = ei.Explain("whale", "http://x.com/b")
+		if len(ex.Terms) != 2 || ex.Terms[1].Field != "anchor" || ex.Terms[1].Boost != anchorBoost || ex.Terms[1].TF != 1 {
+			t.Fatalf("%T anchor breakdown %#v", idx, ex)
+		}
+		if ex := ei.Explain("the", "http://x.com/a"); len(ex.Terms) != 1 || ex.Terms[0].Note != "stopword" {
+			t.Fatalf("%T stopword breakdown %#v", idx, ex)
+		}
+		if ex := ei.Explain("whale", "http://x.com/missing"); ex.Note == "" || ex.Score != 0 {
+			t.Fatalf("%T missing document explained as %#v", idx, ex)
+		}
+	}
+
+	// A document added through another handle changes the stored count but
+	// not sq's; explanations use the same N as sq's searches.
+	other, err := NewSQLiteIndex(filepath.Join(dir, "v1.db"), nil)
+	if err != nil {
+		t.Fatalf("NewSQLiteIndex: %v", err)
+	}
+	other.Add("http://x.com/d", []string{"whale", "river"})
+	other.Close()
+	for _, h := range SearchQuery(sq, "whale", "") {
+		if ex := sq.Explain("whale", h.URL); !near(ex.Score, h.Score) {
+			t.Fatalf("explain %s score %v after another writer; search score %v", h.URL, ex.Score, h.Score)
+		}
+	}
+
+	srv := httptest.NewServer(NewMux(sq))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/search?q=harpon&explain=true")
+	if err != nil {
+		t.Fatalf("GET /search: %v", err)
+	}
+	defer resp.Body.Close()
+	var hits []SearchHit
+	if err := json.NewDecoder(resp.Body).Decode(&hits); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(hits) != 1 || hits[0].Explanation == nil || !near(hits[0].Explanation.Score, hits[0].Score) {
+		t.Fatalf("/search explain got %#v", hits)
+	}
+	if terms := hits[0].Explanation.Terms; len(terms) != 2 || terms[1].Stem != "harpoon" || terms[1].Boost != 0.5 {
+		t.Fatalf("fuzzy expansion not explained: %#v", terms)
+	}
+}
+
+// --- TestEval (qrels parsing, ranking metrics and diff reports) ---
+
+func TestEval(t *testing.T) {
+	qrels, err := ParseQrels(strings.NewReader("# judgments\nq1 0 a.html 2\nq1 0 c.html 1\nq1 0 b.html 0\nq2 0 d.md 1\n"))
+	if err != nil {
+		t.Fatalf("ParseQrels: %v", err)
+	}
+	queries, err := ParseQueries(strings.NewReader("q1\twhale ship\nq2 harpoon\nq3 nothing judged\n"))
+	if err != nil {
+		t.Fatalf("ParseQueries: %v", err)
+	}
+	if len(queries) != 3 || queries[0] != (EvalQuery{"q1", "whale ship"}) {
+		t.Fatalf("ParseQueries got %#v", queries)
+	}
+	if _, err := ParseQrels(strings.NewReader("q1 0 a.html\n")); err == nil {
+		t.Fatalf("ParseQrels should reject short lines")
+	}
+
+	// Ranking b (non-relevant), a (grade 2), x, c (grade 1) at k=2.
+	m := scoreRanking("q1", []Hit{{URL: "b.html"}, {URL: "a.html"}, {URL: "x"}, {URL: "c.html"}}, qrels["q1"], 2)
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	idcg := 3 + 1/math.Log2(3)
+	if !near(m.Precision, 0.5) || !near(m.Recall, 0.5) || !near(m.AP, (1.0/2+2.0/4)/2) || !near(m.RR, 0.5) ||
+		!near(m.NDCG, 3/math.Log2(3)/idcg) {
+		t.Fatalf("scoreRanking got %#v", m)
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.html":    "<html><body>whale ship whale</body></html>",
+		"b.html":    "<html><body>ship the ship</body></html>",
+		"c.html":    "<html><body>whale</body></html>",
+		"sub/d.md":  "harpoon notes",
+		"image.png": "\x89PNG",
+	}
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	qrels["q2"] = map[string]int{"sub/d.md": 1}
+
+	idx := NewInMemIndex(nil)
+	if n, err := IndexDir(idx, dir, ExtractOptions{}); err != nil || n != 4 {
+		t.Fatalf("IndexDir = %d, %v; want 4 files", n, err)
+	}
+	r := Evaluate(idx, queries, qrels, 10)
+	if len(r.Queries) != 2 || !reflect.DeepEqual(r.Unjudged, []string{"q3"}) || !near(r.Mean.RR, 1) || !near(r.Mean.Recall, 1) {
+		t.Fatalf("Evaluate got %#v", r)
+	}
+
+	// A configuration that only returns the first hit loses recall on q1.
+	top1 := EvaluateFunc(func(q string) []Hit {
+		hits := SearchQuery(idx, q, "")
+		if len(hits) > 1 {
+			hits = hits[:1]
+		}
+		return hits
+	}, queries, qrels, 10)
+	var buf bytes.Buffer
+	if err := WriteDiff(&buf, "full", r, "top1", top1); err != nil {
+		t.Fatalf("WriteDiff: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "MAP") || !strings.Contains(out, "-0.2500") || !strings.Contains(out, "q1\tAP -0.3333") {
+		t.Fatalf("WriteDiff output:\n%s", out)
+	}
+	buf.Reset()
+	if err := WriteReport(&buf, r); err != nil || !strings.Contains(buf.String(), "unjudged queries: q3") {
+		t.Fatalf("WriteReport output (%v):\n%s", err, buf.String())
+	}
+}
+
+// --- TestQueryCache (LRU limits, generation invalidation and /search wiring) ---
+
+func TestQueryCache(t *testing.T) {
+	c := NewQueryCache(2, 0)
+	k := CacheKey("  Whale  SHIP ", "")
+	if k != CacheKey("whale ship", "") || k == CacheKey("whale ship", "fr") {
+		t.Fatalf("CacheKey should ignore case and spacing but not language")
+	}
+	c.Put("a", 1, []Hit{{URL: "x", Score: 1}}, "")
+	c.Put("b", 1, nil, "")
+	if _, _, ok := c.Get("a", 1); !ok {
+		t.Fatalf("expected hit for a")
+	}
+	c.Put("c", 1, nil, "") // evicts b, the least recently used
+	if _, _, ok := c.Get("b", 1); ok {
+		t.Fatalf("b should have been evicted")
+	}
+	if _, _, ok := c.Get("a", 2); ok {
+		t.Fatalf("a newer generation should empty the cache")
+	}
+	c.Put("old", 1, nil, "")
+	if st := c.Stats(); st.Entries != 0 || st.Hits != 1 || st.Misses != 2 || st.Evictions != 3 {
+		t.Fatalf("Stats got %#v", st)
+	}
+	small := NewQueryCache(0, 100)
+	small.Put("big", 1, []Hit{{URL: strings.Repeat("u", 200)}}, "")
+	if st := small.Stats(); st.Entries != 0 {
+		t.Fatalf("entry above the byte limit was stored: %#v", st)
+	}
+
+	idx := NewInMemIndex(nil)
+	idx.Add("a.html", []string{"whale", "ship"})
+	cache := NewQueryCache(100, 0)
+	srv := httptest.NewServer(NewMux(idx, WithQueryCache(cache)))
+	defer srv.Close()
+	search := func() int {
+		resp, err := http.Get(srv.URL + "/search?q=Whale")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var hits []SearchHit
+		if err := json.NewDecoder(resp.Body).Decode(&hits); err != nil {
+			t.Fatal(err)
+		}
+		return len(hits)
+	}
+	if search() != 1 || search() != 1 {
+		t.Fatalf("expected one hit before the index changes")
+	}
+	idx.Add("b.html", []string{"whale", "tail"})
+	if n := search(); n != 2 {
+		t.Fatalf("Add should invalidate cached results, got %d hits", n)
+	}
+	resp, err := http.Get(srv.URL + "/stats/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st CacheStats
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Hits != 1 || st.Misses != 2 || st.Entries != 1 {
+		t.Fatalf("/stats/cache got %#v", st)
+	}
+}
+
+// --- TestMetrics (Prometheus exposition, crawl counters, health and readiness) ---
+
+func TestMetrics(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<html><body>whale <a href="/hidden">h</a> <a href="/gone">g</a></body></html>`)
+		case "/hidden":
+			io.WriteString(w, `<html><head><meta name="robots" content="noindex"></head><body>secret</body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	m := NewMetrics()
+	idx := NewInMemIndex(nil)
+	var st CrawlStats
+	if _, err := CrawlWith(site.URL+"/", CrawlConfig{Max: 10, Indexer: idx, Stats: &st, Metrics: m}); err != nil {
+		t.Fatal(err)
+	}
+	if st.Bytes == 0 {
+		t.Fatalf("CrawlStats.Bytes not counted: %#v", st)
+	}
+
+	srv := httptest.NewServer(NewMux(idx, WithMetrics(m), WithQueryCache(NewQueryCache(10, 0))))
+	defer srv.Close()
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	get("/search?q=whale")
+	get("/search?q=whale")
+	get("/nope")
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz = %d", code)
+	}
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz = %d", code)
+	}
+	_, out := get("/metrics")
+	for _, want := range []string{
+		"# TYPE search_http_request_duration_seconds histogram",
+		`search_http_requests_total{route="/search",code="200"} 2`,
+		`search_http_requests_total{route="/",code="404"} 1`,
+		`search_http_request_duration_seconds_count{route="/search"} 2`,
+		`search_http_request_duration_seconds_bucket{route="/search",le="+Inf"} 2`,
+		`search_crawl_pages_total{result="fetched"} 2`,
+		`search_crawl_pages_total{result="failed"} 1`,
+		`search_crawl_pages_total{result="indexed"} 1`,
+		`search_crawl_skipped_total{reason="noindex"} 1`,
+		"search_download_bytes_total " + strconv.FormatInt(st.Bytes, 10),
+		"search_index_documents 1",
+		"search_index_terms 3",
+		"search_index_postings 3",
+		`search_query_cache_requests_total{result="hit"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("/metrics missing %q in:\n%s", want, out)
+		}
+	}
+
+	db, err := NewSQLiteIndex(filepath.Join(t.TempDir(), "m.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2, err := NewSQLiteIndexV2(filepath.Join(t.TempDir(), "m2.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	// Index sizes are counted without listing the dictionary.
+	for _, ix := range []Indexer{db, db2} {
+		ix.Add("a", []string{"whale", "sea"})
+		ix.Add("b", []string{"whale", "ship"})
+		if terms, postings := ix.(TermCountIndexer).TermCounts(); terms != 3 || postings != 4 {
+			t.Fatalf("%T TermCounts=(%d, %d); want (3, 4)", ix, terms, postings)
+		}
+	}
+	dbSrv := httptest.NewServer(NewMux(db))
+	defer dbSrv.Close()
+	check := func() int {
+		resp, err := http.Get(dbSrv.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := check(); code != http.StatusOK {
+		t.Fatalf("/readyz with open database = %d", code)
+	}
+	db.Close()
+	if code := check(); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz with closed database = %d", code)
+	}
+
+	// Label values escape only backslash, quote and newline; other
+	// characters, including non-ASCII ones, are written as is.
+	if got, want := labels("collection", "a\\b\"c\nd\té"), `{collection="a\\b\"c\nd`+"\té"+`"}`; got != want {
+		t.Fatalf("labels=%s; want %s", got, want)
+	}
+}
+
+// --- TestAdmin (document add/replace/delete, crawl jobs and auth) ---
+
+func TestAdmin(t *testing.T) {
+	for _, backend := range []string{"inmem", "sqlite", "sqlitev2"} {
+		var idx Indexer = NewInMemIndex(nil)
+		switch backend {
+		case "sqlite":
+			db, err := NewSQLiteIndex(filepath.Join(t.TempDir(), "a.db"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx = db
+		case "sqlitev2":
+			db, err := NewSQLiteIndexV2(filepath.Join(t.TempDir(), "a.db"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx = db
+		}
+		idx.Add("keep", []string{"whale"})
+		idx.Add("gone", []string{"whale", "harpoon"})
+		first, err1 := idx.(DeleteIndexer).Delete("gone")
+		again, err2 := idx.(DeleteIndexer).Delete("gone")
+		if !first || again || err1 != nil || err2 != nil {
+			t.Fatalf("%s: Delete should succeed exactly once; got %v %v, %v %v", backend, first, err1, again, err2)
+		}
+		var stems []string
+		for _, ts := range idx.(TermIndexer).Terms() {
+			stems = append(stems, ts.Term+":"+strconv.Itoa(ts.DF))
+		}
+		if idx.GetN() != 1 || !reflect.DeepEqual(stems, []string{"whale:1"}) || len(SearchQuery(idx, "harpoon", "")) != 0 {
+			t.Fatalf("%s: after Delete N=%d terms=%v", backend, idx.GetN(), stems)
+		}
+		// Deleting a page takes back the anchor text of its links, so a
+		// replaced page does not count its anchors twice.
+		idx.Add("http://x.test/t", []string{"whale"})
+		src := &Document{Words: []string{"squid"}, Links: []Link{{Href: "/t", Text: "kraken lair"}}}
+		IndexDocument(idx, "http://x.test/src", src)
+		idx.(DeleteIndexer).Delete("http://x.test/src")
+		if hits := SearchQuery(idx, "kraken", ""); len(hits) != 0 {
+			t.Fatalf("%s: anchor of deleted page still matches: %#v", backend, hits)
+		}
+		IndexDocument(idx, "http://x.test/src", src)
+		idx.(DeleteIndexer).Delete("http://x.test/src")
+		IndexDocument(idx, "http://x.test/src", src)
+		for _, te := range idx.(ExplainIndexer).Explain("kraken", "http://x.test/t").Terms {
+			if te.Field == "anchor" && (te.TF != 1 || te.DocLen != 2) {
+				t.Fatalf("%s: replaced page's anchor has tf=%d len=%d; want 1 and 2", backend, te.TF, te.DocLen)
+			}
+		}
+		idx.Close()
+	}
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<html><body>kraken <a href="/deep">deep</a> <a href="/missing">m</a></body></html>`)
+		case "/deep":
+			io.WriteString(w, `<html><body>kraken abyss</body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	idx := NewInMemIndex(nil)
+	srv := httptest.NewServer(NewMux(idx, WithAdmin(AdminConfig{Token: "s3cret"})))
+	defer srv.Close()
+	do := func(method, path, body string, out any) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+	hits := func(q string) int { return len(SearchQuery(idx, q, "")) }
+
+	resp, err := http.Post(srv.URL+"/admin/documents", "application/json", strings.NewReader(`{"url":"http://x/a","text":"whale"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated POST = %d", resp.StatusCode)
+	}
+	if code := do("POST", "/admin/documents", `{"url":"http://x/a","html":"<p>text</p>","text":"both"}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("text and html together = %d", code)
+	}
+	var added map[string]any
+	if code := do("POST", "/admin/documents", `{"url":"HTTP://X/a","text":"whale song"}`, &added); code != http.StatusCreated ||
+		added["url"] != "http://x/a" || added["replaced"] != false {
+		t.Fatalf("POST text = %d %v", code, added)
+	}
+	if code := do("POST", "/admin/documents", `{"url":"http://x/a","html":"<html><body><p>ship ahoy</p></body></html>"}`, &added); code != http.StatusCreated ||
+		added["replaced"] != true {
+		t.Fatalf("POST html = %d %v", code, added)
+	}
+	if hits("whale") != 0 || hits("ship") != 1 {
+		t.Fatalf("replacement not indexed: whale=%d ship=%d", hits("whale"), hits("ship"))
+	}
+	if code := do("DELETE", "/admin/documents?url=http://x/a", "", nil); code != http.StatusNoContent || hits("ship") != 0 {
+		t.Fatalf("DELETE = %d", code)
+	}
+	if code := do("DELETE", "/admin/documents?url=http://x/a", "", nil); code != http.StatusNotFound {
+		t.Fatalf("second DELETE = %d", code)
+	}
+
+	var job CrawlJob
+	if code := do("POST", "/admin/crawl", `{"start":"`+site.URL+`/","max":10}`, &job); code != http.StatusAccepted || job.ID == "" {
+		t.Fatalf("POST /admin/crawl = %d %#v", code, job)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for job.State == JobRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		do("GET", "/admin/jobs/"+job.ID, "", &job)
+	}
+	if job.State != JobDone || job.Visited != 3 || job.Stats.Fetched != 2 || job.Stats.Indexed != 2 ||
+		len(job.Errors) != 1 || !strings.Contains(job.Errors[0], "/missing") || job.Finished == nil {
+		t.Fatalf("crawl job = %#v", job)
+	}
+	if hits("kraken") != 2 {
+		t.Fatalf("crawled pages not searchable")
+	}
+	var all []CrawlJob
+	if code := do("GET", "/admin/jobs", "", &all); code != http.StatusOK || len(all) != 1 {
+		t.Fatalf("GET /admin/jobs = %d %v", code, all)
+	}
+	if code := do("GET", "/admin/jobs/42", "", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown job = %d", code)
+	}
+}
+
+// --- TestSQLiteWrites (concurrent writers and atomic replace) ---
+
+func TestSQLiteWrites(t *testing.T) {
+	for _, backend := range []string{"sqlite", "sqlitev2"} {
+		var idx interface {
+			Indexer
+			ReplaceIndexer
+			TermCountIndexer
+		}
+		var docs string
+		switch backend {
+		case "sqlite":
+			db, err := NewSQLiteIndex(filepath.Join(t.TempDir(), "w.db"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx, docs = db, "urls"
+		case "sqlitev2":
+			db, err := NewSQLiteIndexV2(filepath.Join(t.TempDir(), "w.db"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx, docs = db, "documents"
+		}
+
+		// Writers running side by side store every document whole.
+		var wg sync.WaitGroup
+		for g := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 10 {
+					idx.Add(fmt.Sprintf("http://x/%d-%d", g, i), []string{"shared", fmt.Sprintf("w%dx%d", g, i)})
+					SearchQuery(idx, "shared", "")
+				}
+			}()
+		}
+		wg.Wait()
+		if terms, postings := idx.TermCounts(); idx.GetN() != 80 || terms != 81 || postings != 160 || len(SearchQuery(idx, "shared", "")) != 80 {
+			t.Fatalf("%s: after concurrent adds N=%d terms=%d postings=%d", backend, idx.GetN(), terms, postings)
+		}
+
+		// A replace that fails keeps the old version.
+		if replaced, err := idx.ReplaceLang("http://x/0-0", "", []string{"fresh"}); !replaced || err != nil || idx.GetN() != 80 {
+			t.Fatalf("%s: ReplaceLang = %v, %v; N=%d", backend, replaced, err, idx.GetN())
+		}
+		var db *sql.DB
+		switch x := idx.(type) {
+		case *SQLiteIndex:
+			db = x.db
+		case *SQLiteIndexV2:
+			db = x.db
+		}
+		if _, err := db.Exec(`CREATE TRIGGER refuse BEFORE INSERT ON ` + docs + ` BEGIN SELECT RAISE(ABORT, 'refused'); END`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := idx.ReplaceLang("http://x/0-0", "", []string{"lost"}); err == nil {
+			t.Fatalf("%s: ReplaceLang ignored the failed insert", backend)
+		}
+		if err := IndexDocument(idx, "http://x/new", &Document{Words: []string{"lost"}}); err == nil {
+			t.Fatalf("%s: IndexDocument ignored the failed insert", backend)
+		}
+		if hits := SearchQuery(idx, "fresh", ""); len(hits) != 1 || idx.GetN() != 80 {
+			t.Fatalf("%s: failed replace lost the document: %v, N=%d", backend, hits, idx.GetN())
+		}
+		idx.Close()
+	}
+}
+
+// --- TestAccess (API key scopes, rate limiting and body limits) ---
+
+func TestAccess(t *testing.T) {
+	keys, err := ParseAPIKeys(strings.NewReader("# key scope name\nr-key read frontend\na-key admin ops\n"))
+	if err != nil || len(keys) != 2 || !reflect.DeepEqual(keys[1], APIKey{Key: "a-key", Scope: ScopeAdmin, Name: "ops"}) {
+		t.Fatalf("ParseAPIKeys = %v, %v", keys, err)
+	}
+	if _, err := ParseAPIKeys(strings.NewReader("k superuser x\n")); err == nil {
+		t.Fatalf("unknown scope accepted")
+	}
+
+	idx := NewInMemIndex(nil)
+	idx.Add("http://x/a", []string{"whale"})
+	srv := httptest.NewServer(NewMux(idx,
+		WithAdmin(AdminConfig{Token: "legacy"}),
+		WithAccess(AccessConfig{Keys: keys, Anonymous: true, Rate: 0.5, Burst: 2, MaxBodyBytes: 64})))
+	defer srv.Close()
+	do := func(method, path, key, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if code := do("GET", "/search?q=whale", "bogus", "").StatusCode; code != http.StatusUnauthorized {
+		t.Fatalf("unknown key = %d", code)
+	}
+	if code := do("DELETE", "/admin/documents?url=http://x/a", "r-key", "").StatusCode; code != http.StatusForbidden {
+		t.Fatalf("read key on admin endpoint = %d", code)
+	}
+	if code := do("POST", "/admin/documents", "a-key", `{"url":"http://x/b","text":"`+strings.Repeat("w ", 64)+`"}`).StatusCode; code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body = %d", code)
+	}
+	if code := do("DELETE", "/admin/documents?url=http://x/a", "legacy", "").StatusCode; code != http.StatusNoContent {
+		t.Fatalf("admin token as key = %d", code)
+	}
+
+	// Anonymous clients share one bucket per IP; the burst of 2 is spent
+	// by the first two requests. Health checks are not limited.
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp := do("GET", "/search?q=whale", "", "")
+		if resp.StatusCode != want {
+			t.Fatalf("anonymous request %d = %d, want %d", i, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "2" {
+			t.Fatalf("Retry-After = %q", resp.Header.Get("Retry-After"))
+		}
+	}
+	if code := do("GET", "/healthz", "", "").StatusCode; code != http.StatusOK {
+		t.Fatalf("/healthz limited: %d", code)
+	}
+	if code := do("GET", "/search?q=whale", "r-key", "").StatusCode; code != http.StatusOK {
+		t.Fatalf("keyed client should have its own bucket: %d", code)
+	}
+
+	// Only the entry the proxy appended is trusted.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 10.0.0.7")
+	if ip := newAccessControl(AccessConfig{TrustProxy: true}).clientIP(req); ip != "10.0.0.7" {
+		t.Fatalf("clientIP = %q, want the right-most X-Forwarded-For entry", ip)
+	}
+
+	// A collection's admin token administers that collection only.
+	scoped := httptest.NewServer(NewMux(idx, WithAdmin(AdminConfig{Token: "root-token"}),
+		WithCollections(map[string]Collection{
+			"a": {Indexer: NewInMemIndex(nil), Options: []MuxOption{WithAdmin(AdminConfig{Token: "a-token"})}},
+			"b": {Indexer: NewInMemIndex(nil), Options: []MuxOption{WithAdmin(AdminConfig{Token: "b-token"})}},
+		}),
+		WithAccess(AccessConfig{Keys: keys})))
+	defer scoped.Close()
+	for _, c := range []struct {
+		path, key string
+		want      int
+	}{
+		{"/collections/a", "a-token", http.StatusNotFound},
+		{"/collections/b", "a-token", http.StatusForbidden},
+		{"", "a-token", http.StatusForbidden},
+		{"/collections/a", "root-token", http.StatusForbidden},
+		{"/collections/b", "a-key", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest("DELETE", scoped.URL+c.path+"/admin/documents?url=http://x/none", nil)
+		req.Header.Set("X-API-Key", c.key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Fatalf("%s on %q admin = %d, want %d", c.key, c.path, resp.StatusCode, c.want)
+		}
+	}
+
+	// Reusing the option for several muxes must not pile up admin tokens.
+	opt := WithAccess(AccessConfig{Keys: keys})
+	for range 2 {
+		NewMux(idx, WithAdmin(AdminConfig{Token: "legacy"}), opt)
+	}
+	var cfg muxConfig
+	opt(&cfg)
+	if len(cfg.access.Keys) != len(keys) {
+		t.Fatalf("reused WithAccess has %d keys, want %d", len(cfg.access.Keys), len(keys))
+	}
+
+	l := newRateLimiter(1, 1)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	if ok, _ := l.take("c"); !ok {
+		t.Fatalf("first take refused")
+	}
+	if ok, wait := l.take("c"); ok || wait != time.Second {
+		t.Fatalf("second take = %v, %v", ok, wait)
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.take("c"); !ok {
+		t.Fatalf("bucket did not refill")
+	}
+}
+
+// --- TestCollections (static roots and independent named indexes) ---
+
+func TestCollections(t *testing.T) {
+	static := t.TempDir()
+	if err := os.WriteFile(filepath.Join(static, "page.html"), []byte("<p>hello</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	docs, blog := NewInMemIndex(nil), NewInMemIndex(nil)
+	docs.Add("http://d/1", []string{"install", "guide"})
+	blog.Add("http://b/1", []string{"release", "notes"})
+	blog.Add("http://b/2", []string{"install", "party"})
+	m := NewMetrics()
+	srv := httptest.NewServer(NewMux(nil,
+		WithStatic("/files", static),
+		WithMetrics(m),
+		WithCollections(map[string]Collection{
+			"docs": {Indexer: docs, Static: static},
+			"blog": {Indexer: blog, Options: []MuxOption{WithAdmin(AdminConfig{Token: "t"}), WithQueryCache(NewQueryCache(10, 0))}},
+		})))
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	search := func(path string) []string {
+		_, body := get(path)
+		var hits []SearchHit
+		if err := json.Unmarshal([]byte(body), &hits); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		var urls []string
+		for _, h := range hits {
+			urls = append(urls, h.URL)
+		}
+		return urls
+	}
+
+	if resp, _ := get("/"); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/files/" {
+		t.Fatalf("root redirect = %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if _, body := get("/files/page.html"); !strings.Contains(body, "hello") {
+		t.Fatalf("static root not served: %q", body)
+	}
+	if resp, _ := get("/top10/"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("default static root still served")
+	}
+	if _, body := get("/collections/docs/page.html"); !strings.Contains(body, "hello") {
+		t.Fatalf("collection static root not served: %q", body)
+	}
+	if got := search("/collections/docs/search?q=install"); !reflect.DeepEqual(got, []string{"http://d/1"}) {
+		t.Fatalf("docs search = %v", got)
+	}
+	if got := search("/collections/blog/search?q=install"); !reflect.DeepEqual(got, []string{"http://b/2"}) {
+		t.Fatalf("blog search = %v", got)
+	}
+	if got := search("/search?q=install"); len(got) != 0 {
+		t.Fatalf("default index should be empty: %v", got)
+	}
+	if resp, _ := get("/collections/docs/admin/jobs"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("docs has no admin API, got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("DELETE", srv.URL+"/collections/blog/admin/documents?url=http://b/2", nil)
+	req.Header.Set("Authorization", "Bearer t")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || docs.GetN() != 1 || blog.GetN() != 1 {
+		t.Fatalf("collection DELETE = %d", resp.StatusCode)
+	}
+
+	var infos []CollectionInfo
+	_, body := get("/collections")
+	if err := json.Unmarshal([]byte(body), &infos); err != nil ||
+		!reflect.DeepEqual(infos, []CollectionInfo{{"blog", 1}, {"docs", 1}}) {
+		t.Fatalf("/collections = %s", body)
+	}
+	_, out := get("/metrics")
+	for _, want := range []string{
+		`search_index_documents{collection="blog"} 1`,
+		`search_index_documents{collection="docs"} 1`,
+		`search_query_cache_requests_total{collection="blog",result="miss"} 1`,
+		`search_http_requests_total{route="/collections/blog/search",code="200"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("/metrics missing %q in:\n%s", want, out)
+		}
+	}
+	if resp, _ := get("/readyz"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/readyz with collections = %d", resp.StatusCode)
+	}
+}
+
+// --- TestServerLifecycle (graceful drain, request deadlines, job cancellation) ---
+
+type closeCounter struct {
+	*InMemIndex
+	closed int
+}
+
+func (c *closeCounter) Close() error { c.closed++; return nil }
+
+func TestServerLifecycle(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	idx := &closeCounter{InMemIndex: NewInMemIndex(nil)}
+	srv := NewServer(ServerConfig{ShutdownTimeout: 5 * time.Second}, slow, idx)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, ln) }()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond) // let shutdown begin while the request is in flight
+	if idx.closed != 0 {
+		t.Fatalf("indexer closed before in-flight request finished")
+	}
+	close(release)
+	if got := <-body; got != "done" {
+		t.Fatalf("in-flight request got %q", got)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	if idx.closed != 1 || srv.Shutdown(context.Background()) != nil || idx.closed != 1 {
+		t.Fatalf("indexer closed %d times", idx.closed)
+	}
+
+	// Work still running when the shutdown timeout passes keeps the
+	// indexers open.
+	started, release = make(chan struct{}), make(chan struct{})
+	defer close(release)
+	idx = &closeCounter{InMemIndex: NewInMemIndex(nil)}
+	srv = NewServer(ServerConfig{ShutdownTimeout: 20 * time.Millisecond}, slow, idx)
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { served <- srv.Serve(ctx, ln) }()
+	go http.Get("http://" + ln.Addr().String() + "/")
+	<-started
+	cancel()
+	if err := <-served; err == nil || idx.closed != 0 {
+		t.Fatalf("Serve with a stuck request = %v, indexer closed %d times", err, idx.closed)
+	}
+
+	// A client that went away is not reported as a timeout.
+	for err, want := range map[error]int{context.DeadlineExceeded: http.StatusServiceUnavailable, context.Canceled: statusClientClosed} {
+		rec := httptest.NewRecorder()
+		if searchFailed(rec, err); rec.Code != want {
+			t.Fatalf("searchFailed(%v) = %d, want %d", err, rec.Code, want)
+		}
+	}
+	db, err := NewSQLiteIndex(filepath.Join(t.TempDir(), "ctx.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Add("a", []string{"whale"})
+	done, stop := context.WithCancel(context.Background())
+	stop()
+	if hits, err := db.SearchStemContext(done, "whale", ""); hits != nil || !errors.Is(err, context.Canceled) {
+		t.Fatalf("SearchStemContext after cancel = %v, %v", hits, err)
+	}
+
+	// A request deadline that has already passed stops the search.
+	search := NewInMemIndex(nil)
+	search.Add("a", []string{"whale"})
+	srv = NewServer(ServerConfig{RequestTimeout: time.Nanosecond}, NewMux(search))
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { served <- srv.Serve(ctx, ln) }()
+	resp, err := http.Get("http://" + ln.Addr().String() + "/search?q=whale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expired search = %d", resp.StatusCode)
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+
+	// Shutdown cancels crawl jobs and waits for them before closing.
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		fmt.Fprintf(w, `<html><body>page <a href="/%d">next</a></body></html>`, n+1)
+	}))
+	defer site.Close()
+	idx = &closeCounter{InMemIndex: NewInMemIndex(nil)}
+	mux := NewMux(idx, WithAdmin(AdminConfig{Token: "t"}))
+	srv = NewServer(ServerConfig{ShutdownTimeout: 5 * time.Second}, mux, idx)
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { served <- srv.Serve(ctx, ln) }()
+	req, _ := http.NewRequest("POST", "http://"+ln.Addr().String()+"/admin/crawl", strings.NewReader(`{"start":"`+site.URL+`/0","max":1000}`))
+	req.Header.Set("Authorization", "Bearer t")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	get := httptest.NewRequest("GET", "/admin/jobs/1", nil)
+	get.Header.Set("Authorization", "Bearer t")
+	mux.ServeHTTP(rec, get)
+	var job CrawlJob
+	if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobCanceled || job.Visited == 0 || job.Visited >= 1000 || idx.closed != 1 {
+		t.Fatalf("job after shutdown = %#v, closed %d", job, idx.closed)
+	}
+}
+
+// --- TestQueryLog (request logs, query log and analytics) ---
+
+func TestQueryLog(t *testing.T) {
+	idx := NewInMemIndex(nil)
+	idx.Add("http://a/1", []string{"whale", "song"})
+	idx.Add("http://a/2", []string{"whale", "oil"})
+	var logged, reqs bytes.Buffer
+	ql := NewQueryLog(&logged, 0)
+	mux := NewMux(idx,
+		WithQueryLog(ql),
+		WithLogger(slog.New(slog.NewJSONHandler(&reqs, nil))),
+		WithAdmin(AdminConfig{Token: "t"}),
+		WithAccess(AccessConfig{Keys: []APIKey{{Key: "k", Scope: ScopeRead, Name: "app"}}, Anonymous: true}))
+	for _, q := range []string{"whale", "Whale ", "oil", "zzzz", "zzzz", "whale"} {
+		req := httptest.NewRequest("GET", "/search?q="+url.QueryEscape(q), nil)
+		req.Header.Set("X-API-Key", "k")
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	bad := httptest.NewRequest("GET", "/search?q=whale", nil)
+	bad.Header.Set("X-API-Key", "nope")
+	mux.ServeHTTP(httptest.NewRecorder(), bad)
+
+	events, err := ReadQueryLog(&logged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 6 || events[1].Query != "whale" || events[1].Results != 2 || events[1].Client != "key:app" {
+		t.Fatalf("query log = %+v", events)
+	}
+	rep := AnalyzeQueries(ql.Events(), 2)
+	if rep.Searches != 6 || rep.Distinct != 3 || len(rep.Top) != 2 || rep.Top[0].Query != "whale" || rep.Top[0].Count != 3 {
+		t.Fatalf("report = %+v", rep)
+	}
+	if len(rep.Zero) != 1 || rep.Zero[0].Query != "zzzz" || rep.Zero[0].Count != 2 {
+		t.Fatalf("zero-result queries = %+v", rep.Zero)
+	}
+	var out bytes.Buffer
+	if err := WriteQueryReport(&out, rep); err != nil || !strings.Contains(out.String(), "zero-result queries") {
+		t.Fatalf("WriteQueryReport = %q, %v", out.String(), err)
+	}
+
+	// One JSON record per request, including the rejected one.
+	var lines []map[string]any
+	for _, l := range strings.Split(strings.TrimSpace(reqs.String()), "\n") {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(l), &rec); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, rec)
+	}
+	if len(lines) != 7 || lines[0]["route"] != "/search" || lines[0]["client"] != "key:app" || lines[0]["status"] != 200.0 {
+		t.Fatalf("request log = %v", lines)
+	}
+	if last := lines[6]; last["status"] != 401.0 || !strings.HasPrefix(last["client"].(string), "ip:") {
+		t.Fatalf("rejected request log = %v", last)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin/queries?n=1", nil)
+	req.Header.Set("Authorization", "Bearer t")
+	mux.ServeHTTP(rec, req)
+	var got QueryReport
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Searches != 6 || len(got.Top) != 1 || got.Top[0].Query != "whale" {
+		t.Fatalf("/admin/queries = %+v", got)
+	}
+
+	// The ring buffer keeps only the most recent events.
+	small := NewQueryLog(nil, 2)
+	for _, q := range []string{"a", "b", "c"} {
+		small.Record(QueryEvent{Query: q})
+	}
+	if ev := small.Events(); len(ev) != 2 || ev[0].Query != "b" || ev[1].Query != "c" {
+		t.Fatalf("ring = %+v", ev)
+	}
+
+	// Unfinished searches are flagged, and write errors are logged while
+	// the event is still kept in memory.
+	var errs bytes.Buffer
+	broken := NewQueryLog(brokenWriter{}, 0)
+	mux = NewMux(idx, WithQueryLog(broken), WithLogger(slog.New(slog.NewJSONHandler(&errs, nil))))
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/search?q=whale", nil).WithContext(gone))
+	ev := broken.Events()
+	if rec.Code != statusClientClosed || len(ev) != 1 || ev[0].Error != QueryCanceled || !strings.Contains(errs.String(), "query log write failed") {
+		t.Fatalf("abandoned search = %d, events %+v, log %s", rec.Code, ev, errs.String())
+	}
+	if err := broken.Record(QueryEvent{Query: "whale"}); err == nil {
+		t.Fatalf("Record ignored the write error")
+	}
+	rep = AnalyzeQueries(broken.Events(), 5)
+	if len(rep.Top) != 1 || rep.Top[0].Count != 2 || rep.Top[0].Errors != 1 || len(rep.Zero) != 1 {
+		t.Fatalf("report with an unfinished search = %+v", rep)
+	}
+	if broken.CTR("", "whale", "http://a/1") != ctrPrior*ctrPriorWeight/(1+ctrPriorWeight) {
+		t.Fatalf("unfinished search counted as an impression")
+	}
+}
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+// --- TestClicks (click-through tracking and CTR blending) ---
+
+func TestClicks(t *testing.T) {
+	idx := NewInMemIndex(nil)
+	idx.Add("http://a/1", []string{"whale", "whale", "song"})
+	idx.Add("http://a/2", []string{"whale", "oil"})
+	idx.Add("http://a/3", []string{"song"})
+	var logged bytes.Buffer
+	ql := NewQueryLog(&logged, 0)
+	mux := NewMux(idx, WithQueryLog(ql))
+	do := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+	search := func(path string) []string {
+		var hits []SearchHit
+		if err := json.NewDecoder(do(path).Body).Decode(&hits); err != nil {
+			t.Fatal(err)
+		}
+		var urls []string
+		for _, h := range hits {
+			urls = append(urls, h.URL)
+		}
+		return urls
+	}
+	if got := search("/search?q=whale"); !reflect.DeepEqual(got, []string{"http://a/1", "http://a/2"}) {
+		t.Fatalf("initial ranking = %v", got)
+	}
+	click := func(path, client string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = client + ":1234"
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 5; i++ {
+		search("/search?q=Whale")
+		rec := click("/click?q=whale&url="+url.QueryEscape("http://a/2")+"&pos=2", "192.0.2."+strconv.Itoa(10+i))
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "http://a/2" {
+			t.Fatalf("click = %d %q", rec.Code, rec.Header().Get("Location"))
+		}
+	}
+	// A client clicking the same result again is redirected but not counted.
+	if rec := click("/click?q=whale&url="+url.QueryEscape("http://a/2"), "192.0.2.10"); rec.Code != http.StatusFound {
+		t.Fatalf("repeated click = %d", rec.Code)
+	}
+	if n := len(ql.Clicks()); n != 5 {
+		t.Fatalf("repeated click counted: %d clicks", n)
+	}
+	if rec := do("/click?q=whale&url=" + url.QueryEscape("http://evil/")); rec.Code != http.StatusBadRequest {
+		t.Fatalf("click on a non-result = %d", rec.Code)
+	}
+	if got := search("/search?q=whale&clicks=0.8"); !reflect.DeepEqual(got, []string{"http://a/2", "http://a/1"}) {
+		t.Fatalf("click-blended ranking = %v", got)
+	}
+	if got := search("/search?q=whale"); got[0] != "http://a/1" {
+		t.Fatalf("ranking without &clicks = %v", got)
+	}
+	if hi, lo := ql.CTR("", "whale", "http://a/2"), ql.CTR("", "whale", "http://a/1"); hi <= lo || lo != ctrPrior*ctrPriorWeight/(8+ctrPriorWeight) {
+		t.Fatalf("CTR = %v, %v", hi, lo)
+	}
+
+	// Clicks are logged next to searches and survive a replay.
+	clicks, err := ReadClicks(bytes.NewReader(logged.Bytes()))
+	if err != nil || len(clicks) != 5 || clicks[0].URL != "http://a/2" || clicks[0].Pos != 2 || clicks[0].Query != "whale" {
+		t.Fatalf("clicks = %+v, %v", clicks, err)
+	}
+	events, err := ReadQueryLog(bytes.NewReader(logged.Bytes()))
+	if err != nil || len(events) != 8 {
+		t.Fatalf("searches = %d, %v", len(events), err)
+	}
+	replayed := NewQueryLog(nil, 0)
+	if err := replayed.Replay(&logged); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replayed.CTR("", "whale", "http://a/2"), ql.CTR("", "whale", "http://a/2"); got != want {
+		t.Fatalf("replayed CTR = %v, want %v", got, want)
+	}
+
+	// With a query cache, a click right after its search checks the
+	// cached results instead of searching again.
+	cache := NewQueryCache(10, 0)
+	mux = NewMux(idx, WithQueryLog(NewQueryLog(nil, 0)), WithQueryCache(cache))
+	search("/search?q=song")
+	if rec := do("/click?q=song&url=" + url.QueryEscape("http://a/3")); rec.Code != http.StatusFound {
+		t.Fatalf("click after cached search = %d", rec.Code)
+	}
+	if st := cache.Stats(); st.Misses != 1 || st.Hits != 1 {
+		t.Fatalf("cache after search and click = %+v", st)
+	}
+
+	// Counts only cover the clicks still in memory.
+	small := NewQueryLog(nil, 1)
+	small.RecordClick(ClickEvent{Query: "q", URL: "u"})
+	small.RecordClick(ClickEvent{Query: "q", URL: "v"})
+	if small.CTR("", "q", "u") != ctrPrior {
+		t.Fatalf("evicted click still counted: %v", small.CTR("", "q", "u"))
+	}
+
+	// A repeated click counts again once clickWindow has passed.
+	now := time.Now()
+	win := NewQueryLog(nil, 0)
+	for _, at := range []time.Time{now, now.Add(clickWindow / 2), now.Add(clickWindow)} {
+		win.RecordClick(ClickEvent{Time: at, Query: "q", URL: "u", Client: "ip:1"})
+	}
+	win.RecordClick(ClickEvent{Time: now, Query: "q", URL: "u", Client: "ip:2"})
+	if n := len(win.Clicks()); n != 3 {
+		t.Fatalf("clicks within and after the window = %d; want 3", n)
+	}
+}
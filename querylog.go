@@ -0,0 +1,401 @@
+package project02
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// QueryEvent is one search recorded in the query log.
+type QueryEvent struct {
+	Time       time.Time `json:"time"`
+	Query      string    `json:"query"` // NormalizeQuery form
+	Lang       string    `json:"lang,omitempty"`
+	Collection string    `json:"collection,omitempty"`
+	Results    int       `json:"results"`
+	LatencyMS  float64   `json:"latency_ms"`
+	Client     string    `json:"client"`          // Client.ID
+	Error      string    `json:"error,omitempty"` // QueryTimedOut or QueryCanceled
+}
+
+// QueryEvent.Error values for searches that did not finish.
+const (
+	QueryTimedOut = "timeout"  // the request deadline passed
+	QueryCanceled = "canceled" // the client went away
+)
+
+// queryError is the QueryEvent.Error for a search stopped by err.
+func queryError(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return QueryTimedOut
+	}
+	return QueryCanceled
+}
+
+// QueryLog appends query and click events as JSON lines to a writer and
+// keeps the most recent ones in memory for reports and click-through rates.
+type QueryLog struct {
+	wmu sync.Mutex // serializes writes to w, apart from mu
+	w   io.Writer  // nil keeps events in memory only
+
+	mu     sync.Mutex
+	events ring[QueryEvent]
+	clicks ring[ClickEvent]
+
+	// Counts over the events and clicks in memory, for CTR. Searches that
+	// did not finish showed no results and are not counted.
+	searches map[string]int // ctrKey(collection, query)
+	clicked  map[string]int // ctrKey(collection, query, url)
+
+	// lastClick holds when each client's counted clicks were made, keyed by
+	// ctrKey(collection, client, query, url); see RecordClick.
+	lastClick map[string]time.Time
+}
+
+// NewQueryLog creates a query log writing to w (which may be nil) and
+// keeping the last max searches and max clicks, 10000 if max <= 0.
+func NewQueryLog(w io.Writer, max int) *QueryLog {
+	if max <= 0 {
+		max = 10000
+	}
+	return &QueryLog{
+		w:         w,
+		events:    ring[QueryEvent]{max: max},
+		clicks:    ring[ClickEvent]{max: max},
+		searches:  make(map[string]int),
+		clicked:   make(map[string]int),
+		lastClick: make(map[string]time.Time),
+	}
+}
+
+// WithQueryLog records every /search, including those of collections, in l
+// and serves a report of them at /admin/queries. It also serves /click,
+// which records followed results, and enables &clicks= on /search.
+func WithQueryLog(l *QueryLog) MuxOption {
+	return func(cfg *muxConfig) { cfg.queryLog = l }
+}
+
+// WithLogger writes one structured record per request to logger: method,
+// path, matched route, status, response bytes, duration and client.
+func WithLogger(logger *slog.Logger) MuxOption {
+	return func(cfg *muxConfig) { cfg.logger = logger }
+}
+
+// logError writes err, if any, to the mux's logger.
+func (cfg *muxConfig) logError(r *http.Request, msg string, err error) {
+	if err == nil || cfg.logger == nil {
+		return
+	}
+	cfg.logger.LogAttrs(r.Context(), slog.LevelError, msg, slog.String("error", err.Error()))
+}
+
+// NormalizeQuery lowercases q and collapses its whitespace, so spellings
+// that search the same are logged and cached together.
+func NormalizeQuery(q string) string {
+	return strings.Join(strings.Fields(strings.ToLower(q)), " ")
+}
+
+// Record adds e to the log, returning the error of writing it out; it is
+// kept in memory either way. A nil log records nothing.
+func (l *QueryLog) Record(e QueryEvent) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	l.addSearch(e)
+	l.mu.Unlock()
+	return l.write(e)
+}
+
+func (l *QueryLog) addSearch(e QueryEvent) {
+	if e.Error == "" {
+		l.searches[ctrKey(e.Collection, e.Query)]++
+	}
+	if old, ok := l.events.push(e); ok && old.Error == "" {
+		decrement(l.searches, ctrKey(old.Collection, old.Query))
+	}
+}
+
+// write appends v to the log's writer as one JSON line. It does not hold
+// mu, so a slow writer does not hold up reports and CTR lookups.
+func (l *QueryLog) write(v any) error {
+	if l.w == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// Events returns the searches kept in memory, oldest first.
+func (l *QueryLog) Events() []QueryEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.events.all()
+}
+
+// Replay loads the searches and clicks of a log written earlier, so reports
+// and click-through rates survive restarts. Nothing is written to the log.
+func (l *QueryLog) Replay(r io.Reader) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return scanLog(r, func(e QueryEvent) { l.addSearch(e) }, func(c ClickEvent) { l.addClick(c) })
+}
+
+// ReadQueryLog parses the searches of the JSON lines written by a QueryLog;
+// see ReadClicks for the clicks.
+func ReadQueryLog(r io.Reader) ([]QueryEvent, error) {
+	var out []QueryEvent
+	err := scanLog(r, func(e QueryEvent) { out = append(out, e) }, nil)
+	return out, err
+}
+
+// scanLog decodes the lines of a query log, passing searches to search and
+// clicks to click; either may be nil.
+func scanLog(r io.Reader, search func(QueryEvent), click func(ClickEvent)) error {
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var kind struct {
+			Event string `json:"event"`
+		}
+		var err error
+		if err = json.Unmarshal(sc.Bytes(), &kind); err == nil {
+			switch kind.Event {
+			case "":
+				var e QueryEvent
+				if err = json.Unmarshal(sc.Bytes(), &e); err == nil && search != nil {
+					search(e)
+				}
+			case clickEvent:
+				var c ClickEvent
+				if err = json.Unmarshal(sc.Bytes(), &c); err == nil && click != nil {
+					click(c)
+				}
+			default:
+				err = fmt.Errorf("unknown event %q", kind.Event)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("query log line %d: %v", line, err)
+		}
+	}
+	return sc.Err()
+}
+
+// LoadQueryLog reads a query log file; see ReadQueryLog.
+func LoadQueryLog(path string) ([]QueryEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadQueryLog(f)
+}
+
+// QueryStat aggregates the events of one normalized query.
+type QueryStat struct {
+	Query        string  `json:"query"`
+	Count        int     `json:"count"`
+	Errors       int     `json:"errors"`       // searches that timed out or were abandoned
+	ZeroResults  int     `json:"zero_results"` // finished searches that found nothing
+	AvgResults   float64 `json:"avg_results"`  // over finished searches
+	AvgLatencyMS float64 `json:"avg_latency_ms"`
+	MaxLatencyMS float64 `json:"max_latency_ms"`
+}
+
+// QueryReport summarizes a query log.
+type QueryReport struct {
+	Searches int         `json:"searches"`
+	Distinct int         `json:"distinct"`
+	Top      []QueryStat `json:"top"`          // most frequent first
+	Zero     []QueryStat `json:"zero_results"` // queries that never found anything when they finished, most frequent first
+	Slowest  []QueryStat `json:"slowest"`      // highest average latency first
+}
+
+// AnalyzeQueries aggregates events per query and keeps n entries in each
+// list of the report.
+func AnalyzeQueries(events []QueryEvent, n int) QueryReport {
+	byQuery := make(map[string]*QueryStat)
+	for _, e := range events {
+		st := byQuery[e.Query]
+		if st == nil {
+			st = &QueryStat{Query: e.Query}
+			byQuery[e.Query] = st
+		}
+		st.Count++
+		switch {
+		case e.Error != "":
+			st.Errors++
+		case e.Results == 0:
+			st.ZeroResults++
+		}
+		st.AvgResults += float64(e.Results)
+		st.AvgLatencyMS += e.LatencyMS
+		if e.LatencyMS > st.MaxLatencyMS {
+			st.MaxLatencyMS = e.LatencyMS
+		}
+	}
+	all, zero := []QueryStat{}, []QueryStat{}
+	for _, st := range byQuery {
+		if finished := st.Count - st.Errors; finished > 0 {
+			st.AvgResults /= float64(finished)
+		}
+		st.AvgLatencyMS /= float64(st.Count)
+		all = append(all, *st)
+		if st.ZeroResults > 0 && st.ZeroResults == st.Count-st.Errors {
+			zero = append(zero, *st)
+		}
+	}
+	byCount := func(s []QueryStat) {
+		sort.Slice(s, func(i, j int) bool {
+			if s[i].Count != s[j].Count {
+				return s[i].Count > s[j].Count
+			}
+			return s[i].Query < s[j].Query
+		})
+	}
+	byCount(all)
+	byCount(zero)
+	slow := append([]QueryStat(nil), all...)
+	sort.SliceStable(slow, func(i, j int) bool { return slow[i].AvgLatencyMS > slow[j].AvgLatencyMS })
+
+	limit := func(s []QueryStat) []QueryStat {
+		if n > 0 && len(s) > n {
+			s = s[:n]
+		}
+		return s
+	}
+	return QueryReport{
+		Searches: len(events),
+		Distinct: len(byQuery),
+		Top:      limit(all),
+		Zero:     limit(zero),
+		Slowest:  limit(slow),
+	}
+}
+
+// WriteQueryReport prints r as three tables: top, zero-result and slowest
+// queries.
+func WriteQueryReport(w io.Writer, r QueryReport) error {
+	if _, err := fmt.Fprintf(w, "%d searches, %d distinct queries\n", r.Searches, r.Distinct); err != nil {
+		return err
+	}
+	sections := []struct {
+		title string
+		rows  []QueryStat
+	}{
+		{"top queries", r.Top},
+		{"zero-result queries", r.Zero},
+		{"slowest queries", r.Slowest},
+	}
+	for _, sec := range sections {
+		fmt.Fprintf(w, "\n%s\n", sec.title)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(tw, "count\terrors\tzero\tavg results\tavg ms\tmax ms\t query\n")
+		for _, st := range sec.rows {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%.1f\t%.2f\t%.2f\t %s\n",
+				st.Count, st.Errors, st.ZeroResults, st.AvgResults, st.AvgLatencyMS, st.MaxLatencyMS, st.Query)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ring keeps the last max values pushed to it.
+type ring[T any] struct {
+	items []T
+	next  int // position of the oldest item once full
+	max   int
+}
+
+// push adds v, returning the item it evicted, if any.
+func (r *ring[T]) push(v T) (old T, evicted bool) {
+	if len(r.items) < r.max {
+		r.items = append(r.items, v)
+		return old, false
+	}
+	old = r.items[r.next]
+	r.items[r.next] = v
+	r.next = (r.next + 1) % r.max
+	return old, true
+}
+
+// all returns a copy of the items, oldest first.
+func (r *ring[T]) all() []T {
+	return append(append([]T(nil), r.items[r.next:]...), r.items[:r.next]...)
+}
+
+// decrement lowers m[k], dropping it at zero.
+func decrement(m map[string]int, k string) {
+	if m[k]--; m[k] <= 0 {
+		delete(m, k)
+	}
+}
+
+// clientID identifies the caller of r: the client found by the access
+// middleware, otherwise the remote IP.
+func clientID(r *http.Request) string {
+	if c, ok := ClientFromContext(r.Context()); ok {
+		return c.ID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// clientSlot lets the access middleware report the client it identified
+// to the request logger wrapped around it.
+type clientSlot struct{}
+
+// logRequests wraps h, which is mux or middleware in front of it, so every
+// request is logged with the pattern of mux that matches it.
+func logRequests(logger *slog.Logger, mux *http.ServeMux, h http.Handler) http.Handler {
+	if logger == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		slot := new(Client)
+		r = r.WithContext(context.WithValue(r.Context(), clientSlot{}, slot))
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(sw, r)
+		client := slot.ID
+		if client == "" {
+			client = clientID(r)
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", route),
+			slog.Int("status", sw.code),
+			slog.Int64("bytes", sw.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client", client),
+		)
+	})
+}
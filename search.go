@@ -1,6 +1,7 @@
 package project02
 
 import (
+	"context"
 	"math"
 	"sort"
 	"strings"
@@ -99,15 +100,98 @@ func (idx *Index) SearchTFIDF(term string) []Hit {
 	return hits
 }
 
-// BuildIndexFromURLList downloads and indexes a list of URLs.
+// maxWildcardTerms caps how many dictionary terms a prefix* query expands to.
+const maxWildcardTerms = 50
+
+// ParseQuery splits a query string into terms using the same tokenizer as
+// Extract, so CJK runs become the same bigrams that were indexed. A word
+// ending in '*' keeps the '*' on its last term to mark a prefix wildcard.
+func ParseQuery(q string) []string {
+	var terms []string
+	for _, f := range strings.Fields(q) {
+		toks := Tokenize(f, true)
+		if len(toks) > 0 && strings.HasSuffix(f, "*") {
+			toks[len(toks)-1] += "*"
+		}
+		terms = append(terms, toks...)
+	}
+	return terms
+}
+
+// searchTerm ranks documents for a single parsed term. Wildcard terms
+// ("prefix*") are expanded through PrefixIndexer and their hits summed.
+func searchTerm(indexer Indexer, term, lang string) []Hit {
+	if prefix, ok := strings.CutSuffix(term, "*"); ok {
+		pi, ok1 := indexer.(PrefixIndexer)
+		ti, ok2 := indexer.(TermIndexer)
+		if !ok1 || !ok2 || prefix == "" {
+			return nil
+		}
+		scores := make(map[string]float64)
+		for _, ts := range pi.PrefixTerms(prefix, maxWildcardTerms) {
+			for _, h := range ti.SearchStem(ts.Term, lang) {
+				scores[h.URL] += h.Score
+			}
+		}
+		return sortedHits(scores)
+	}
+	if li, ok := indexer.(LangIndexer); ok && lang != "" {
+		return li.SearchTFIDFLang(term, lang)
+	}
+	return indexer.SearchTFIDF(term)
+}
+
+// searchStem looks up stem with ti, bound to ctx when ti implements
+// ContextIndexer; other indexers only have ctx checked first.
+func searchStem(ctx context.Context, ti TermIndexer, stem, lang string) ([]Hit, error) {
+	if ci, ok := ti.(ContextIndexer); ok {
+		return ci.SearchStemContext(ctx, stem, lang)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ti.SearchStem(stem, lang), nil
+}
+
+// sortedHits turns accumulated scores into hits ordered by lessHit.
+func sortedHits(scores map[string]float64) []Hit {
+	if len(scores) == 0 {
+		return nil
+	}
+	hits := make([]Hit, 0, len(scores))
+	for u, sc := range scores {
+		hits = append(hits, Hit{URL: u, Score: sc})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return lessHit(hits[i], hits[j])
+	})
+	return hits
+}
+
+// SearchQuery runs every term of q against indexer and sums the per-term
+// TF-IDF scores per document. A non-empty lang restricts the search to
+// documents in that language when the indexer supports it. Metadata
+// filters in q ("type:Article") are applied through FilterHits.
+func SearchQuery(indexer Indexer, q, lang string) []Hit {
+	q, filters := ParseFilters(q)
+	scores := make(map[string]float64)
+	for _, t := range ParseQuery(q) {
+		for _, h := range searchTerm(indexer, t, lang) {
+			scores[h.URL] += h.Score
+		}
+	}
+	return FilterHits(indexer, sortedHits(scores), filters)
+}
+
+// BuildIndexFromURLList downloads and indexes a list of URLs, keyed by
+// their Canonicalize form.
 func BuildIndexFromURLList(urls []string, indexer Indexer) error {
 	for _, u := range urls {
 		b, err := Download(u)
 		if err != nil {
 			continue
 		}
-		words, _ := Extract(b)
-		indexer.Add(u, words)
+		IndexDocument(indexer, Canonicalize(u), ExtractDocument(b))
 	}
 	return nil
 }
@@ -0,0 +1,207 @@
+package project02
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServerConfig configures a Server. Zero durations mean no limit, as in
+// net/http.
+type ServerConfig struct {
+	Addr string // TCP address for Run, e.g. ":8080"
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// RequestTimeout is the deadline put on every request's context;
+	// /search answers 503 when it passes before the search is done.
+	RequestTimeout time.Duration
+
+	// ShutdownTimeout bounds how long shutdown waits for in-flight requests
+	// and background crawl jobs; the indexers are only closed once they
+	// have all finished.
+	ShutdownTimeout time.Duration
+}
+
+// DefaultServerConfig returns timeouts suited to serving search on addr.
+func DefaultServerConfig(addr string) ServerConfig {
+	return ServerConfig{
+		Addr:              addr,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+		RequestTimeout:    10 * time.Second,
+		ShutdownTimeout:   15 * time.Second,
+	}
+}
+
+// Server runs a handler such as NewMux's over HTTP and owns the indexers
+// behind it: they are closed once requests and crawl jobs have drained.
+type Server struct {
+	cfg      ServerConfig
+	srv      *http.Server
+	indexers []Indexer
+
+	base   context.Context // cancelled when shutdown starts
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	closing  bool
+	tasks    sync.WaitGroup // background work started by handlers
+	shutdown sync.Once
+	err      error // result of the first Shutdown
+}
+
+type serverKey struct{}
+
+// NewServer creates a Server for handler. The indexers are closed, in
+// order, when the server shuts down.
+func NewServer(cfg ServerConfig, handler http.Handler, indexers ...Indexer) *Server {
+	s := &Server{cfg: cfg, indexers: indexers}
+	s.base, s.cancel = context.WithCancel(context.Background())
+	s.srv = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           s.withDeadline(handler),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		// Request contexts carry the server so handlers can start
+		// background work that shutdown waits for (see startTask).
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), serverKey{}, s)
+		},
+	}
+	return s
+}
+
+func (s *Server) withDeadline(h http.Handler) http.Handler {
+	if s.cfg.RequestTimeout <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RequestTimeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Run listens on the configured address and serves until ctx is done or
+// the process receives SIGINT or SIGTERM, then shuts down gracefully.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return s.Serve(ctx, ln)
+}
+
+// Serve serves on ln until ctx is done, then shuts down gracefully within
+// ShutdownTimeout. It returns the first error of serving or shutting down.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.srv.Serve(ln) }()
+
+	var serveErr error
+	select {
+	case serveErr = <-errc:
+	case <-ctx.Done():
+	}
+	sctx := context.Background()
+	if s.cfg.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		sctx, cancel = context.WithTimeout(sctx, s.cfg.ShutdownTimeout)
+		defer cancel()
+	}
+	err := s.Shutdown(sctx)
+	if serveErr == nil {
+		serveErr = <-errc
+	}
+	if errors.Is(serveErr, http.ErrServerClosed) {
+		serveErr = nil
+	}
+	return errors.Join(serveErr, err)
+}
+
+// Shutdown stops accepting connections and cancels crawl jobs, waits for
+// in-flight requests and the jobs until ctx is done, then closes the
+// indexers. If requests or jobs are still running when ctx is done, the
+// indexers are left open for them and an error is returned. Later calls
+// return the first call's result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdown.Do(func() {
+		s.cancel()
+		err := s.srv.Shutdown(ctx)
+
+		s.mu.Lock()
+		s.closing = true
+		s.mu.Unlock()
+		done := make(chan struct{})
+		go func() {
+			s.tasks.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = errors.Join(err, errors.New("background jobs still running at shutdown"))
+		}
+		if err != nil {
+			s.err = errors.Join(err, errors.New("indexers left open"))
+			return
+		}
+
+		for _, idx := range s.indexers {
+			err = errors.Join(err, idx.Close())
+		}
+		s.err = err
+	})
+	return s.err
+}
+
+// statusClientClosed is the status logged for requests whose client went
+// away before the answer, after nginx's 499.
+const statusClientClosed = 499
+
+// searchFailed answers a search stopped by its request context: 503 when
+// the deadline passed, 499 when the client disconnected.
+func searchFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "search timed out", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(statusClientClosed)
+}
+
+// startTask registers work that outlives request r, such as a crawl job.
+// Under a Server the returned context is cancelled when shutdown starts and
+// shutdown waits for done before closing the indexers; elsewhere the
+// context is never cancelled.
+func startTask(r *http.Request) (ctx context.Context, done func()) {
+	s, ok := r.Context().Value(serverKey{}).(*Server)
+	if !ok {
+		return context.Background(), func() {}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return s.base, func() {}
+	}
+	s.tasks.Add(1)
+	return s.base, s.tasks.Done
+}
@@ -1,44 +1,475 @@
 package project02
 
 import (
+	"context"
 	"encoding/json"
+	"log/slog"
+	"math"
 	"net/http"
-	"sort"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// NewMux serves ./top10 at /top10/ and provides /search?q=term.
+// maxFacetValues caps how many values of each facet /search returns.
+const maxFacetValues = 10
+
+// SuggestionHeader carries the "did you mean" respelling of a /search
+// query, URL-encoded so it can be used as the q parameter as is.
+const SuggestionHeader = "X-Search-Suggestion"
+
+// SearchResponse is the JSON body returned by /search?format=v2. By
+// default /search returns only the Hits array, as it always has, with the
+// suggestion in SuggestionHeader.
+type SearchResponse struct {
+	Hits       []SearchHit `json:"hits"`
+	Suggestion string      `json:"suggestion,omitempty"` // "did you mean" respelling
+	Facets     *Facets     `json:"facets,omitempty"`     // counts over the filtered hits
+}
+
+// SearchHit is a Hit with the stored metadata of its document, if any,
+// and its score breakdown when requested with &explain=true.
+type SearchHit struct {
+	Hit
+	Meta        *Metadata    `json:"meta,omitempty"`
+	Explanation *Explanation `json:"explanation,omitempty"`
+}
+
+// Completion is one entry returned by /suggest.
+type Completion struct {
+	Text string `json:"text"`
+	DF   int    `json:"df"`
+}
+
+// MuxOption configures optional behaviour of NewMux.
+type MuxOption func(*muxConfig)
+
+type muxConfig struct {
+	dedup   *Deduper
+	cache   *QueryCache
+	metrics *Metrics
+	admin   *AdminConfig
+	access  *AccessConfig
+
+	queryLog *QueryLog
+	logger   *slog.Logger
+
+	staticPrefix, staticDir string
+	collections             map[string]Collection
+}
+
+// WithDeduper collapses near-duplicate hits in /search to one per group
+// and serves the duplicate groups at /duplicates.
+func WithDeduper(d *Deduper) MuxOption {
+	return func(c *muxConfig) { c.dedup = d }
+}
+
+// WithQueryCache caches the ranked hits of /search per normalized query and
+// serves the cache counters at /stats/cache. It has no effect unless the
+// indexer implements GenerationIndexer, since entries could not be expired.
+func WithQueryCache(c *QueryCache) MuxOption {
+	return func(cfg *muxConfig) { cfg.cache = c }
+}
+
+// WithMetrics counts requests and their latency per route and serves them,
+// with index size and query cache counters, at /metrics. Pass the same
+// Metrics in CrawlConfig to include crawl counters.
+func WithMetrics(m *Metrics) MuxOption {
+	return func(cfg *muxConfig) { cfg.metrics = m }
+}
+
+// WithStatic serves the files under dir at prefix (by default ./top10 at
+// /top10/) and redirects / there. An empty dir serves no files.
+func WithStatic(prefix, dir string) MuxOption {
+	return func(cfg *muxConfig) {
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		cfg.staticPrefix, cfg.staticDir = prefix, dir
+	}
+}
+
+// Collection is an index served independently of the others under
+// /collections/{name}/.
+type Collection struct {
+	Indexer Indexer
+
+	// Static, when set, is a directory served at /collections/{name}/.
+	Static string
+
+	// Options configure the collection's routes: WithDeduper,
+	// WithQueryCache and WithAdmin. Metrics, access control, the query log
+	// and the logger are those of the enclosing mux.
+	Options []MuxOption
+}
+
+// WithCollections hosts each collection under /collections/{name}/ with
+// its own /search, /suggest, /duplicates, /stats/cache and admin routes,
+// and lists them at /collections.
+func WithCollections(cs map[string]Collection) MuxOption {
+	return func(cfg *muxConfig) { cfg.collections = cs }
+}
+
+// mountedIndex is an index served by NewMux: the default one at the root
+// (name "") or a collection under /collections/{name}.
+type mountedIndex struct {
+	name    string
+	indexer Indexer
+	cfg     *muxConfig
+}
+
+func (m mountedIndex) prefix() string {
+	if m.name == "" {
+		return ""
+	}
+	return "/collections/" + m.name
+}
+
+// CollectionInfo is one entry returned by /collections.
+type CollectionInfo struct {
+	Name      string `json:"name"`
+	Documents int    `json:"documents"`
+}
+
+// NewMux serves ./top10 at /top10/ and provides /search?q=term over
+// indexer, plus any collections configured with WithCollections.
 // Library-only: does not start the server by itself.
-func NewMux(indexer Indexer) http.Handler {
+func NewMux(indexer Indexer, opts ...MuxOption) http.Handler {
+	cfg := muxConfig{staticPrefix: "/top10/", staticDir: "./top10"}
+	for _, o := range opts {
+		o(&cfg)
+	}
 	mux := http.NewServeMux()
 
-	// Redirect root to /top10/
+	// Redirect root to the static files
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" {
-			http.Redirect(w, r, "/top10/", http.StatusFound)
+		if r.URL.Path == "/" && cfg.staticDir != "" {
+			http.Redirect(w, r, cfg.staticPrefix, http.StatusFound)
 			return
 		}
 		http.NotFound(w, r)
 	})
 
 	// Map /top10/* -> ./top10/*
-	mux.Handle("/top10/", http.StripPrefix("/top10/",
-		http.FileServer(http.Dir("./top10"))))
+	if cfg.staticDir != "" {
+		mux.Handle(cfg.staticPrefix, http.StripPrefix(cfg.staticPrefix,
+			http.FileServer(http.Dir(cfg.staticDir))))
+	}
+
+	indexes := []mountedIndex{{indexer: indexer, cfg: &cfg}}
+	for _, name := range sortedKeys(cfg.collections) {
+		if name == "" || strings.ContainsAny(name, "/{}") {
+			panic("project02: invalid collection name " + strconv.Quote(name))
+		}
+		c := cfg.collections[name]
+		var ccfg muxConfig
+		for _, o := range c.Options {
+			o(&ccfg)
+		}
+		ccfg.metrics, ccfg.access, ccfg.queryLog, ccfg.logger = cfg.metrics, cfg.access, cfg.queryLog, cfg.logger
+		m := mountedIndex{name: name, indexer: c.Indexer, cfg: &ccfg}
+		if c.Static != "" {
+			mux.Handle(m.prefix()+"/", http.StripPrefix(m.prefix()+"/",
+				http.FileServer(http.Dir(c.Static))))
+		}
+		indexes = append(indexes, m)
+	}
+
+	// Admin tokens double as admin keys of their own collection once
+	// access control is on.
+	for _, m := range indexes {
+		if a := m.cfg.admin; a != nil && cfg.access != nil && a.Token != "" {
+			name := "admin-token"
+			if m.name != "" {
+				name += ":" + m.name
+			}
+			cfg.access.Keys = append(cfg.access.Keys, APIKey{Key: a.Token, Scope: ScopeAdmin, Name: name, Collections: []string{m.name}})
+		}
+	}
+	for _, m := range indexes {
+		if m.name != "" && m.indexer == nil {
+			continue
+		}
+		registerIndex(mux, m)
+	}
+
+	// /collections -> JSON names and sizes of the hosted collections
+	mux.HandleFunc("/collections", func(w http.ResponseWriter, r *http.Request) {
+		out := []CollectionInfo{}
+		for _, m := range indexes[1:] {
+			info := CollectionInfo{Name: m.name}
+			if m.indexer != nil {
+				info.Documents = m.indexer.GetN()
+			}
+			out = append(out, info)
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+
+	// /metrics -> Prometheus text exposition
+	if cfg.metrics != nil {
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			_, _ = cfg.metrics.WriteTo(w)
+			writeIndexMetrics(w, indexes)
+			writeCacheMetrics(w, indexes)
+		})
+	}
+
+	// /healthz -> 200 while the process serves requests
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	// /readyz -> 200 once there is an index and every database answers queries
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready := false
+		for _, m := range indexes {
+			if m.indexer == nil {
+				continue
+			}
+			ready = true
+			if pi, ok := m.indexer.(PingIndexer); ok {
+				if err := pi.Ping(); err != nil {
+					name := m.name
+					if name == "" {
+						name = "index"
+					}
+					http.Error(w, name+": "+err.Error(), http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+		if !ready {
+			http.Error(w, "no index", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	var h http.Handler = mux
+	if cfg.access != nil {
+		h = newAccessControl(*cfg.access).wrap(mux)
+	}
+	return logRequests(cfg.logger, mux, cfg.metrics.Instrument(mux, h))
+}
 
-	// /search?q=term -> JSON hits
-	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
-		q := r.URL.Query().Get("q")
-		// Create a temporary in-memory index for search if using SQLite
+// registerIndex adds the search, suggest, duplicate, cache and admin
+// routes of one index under its prefix.
+func registerIndex(mux *http.ServeMux, m mountedIndex) {
+	indexer, cfg, base := m.indexer, m.cfg, m.prefix()
+	var fuzzy *FuzzySearcher
+	if indexer != nil {
+		fuzzy = NewFuzzySearcher(indexer)
+	}
+	gi, _ := indexer.(GenerationIndexer)
+	if gi == nil {
+		cfg.cache = nil
+	}
+	// ranked runs the fuzzy search for q, through the query cache when
+	// there is one. Multi-term queries sum the per-term scores; misspelled
+	// terms are expanded with a penalty. Hits are cached before filters
+	// and blending, so those stay per request.
+	ranked := func(ctx context.Context, q, lang string) ([]Hit, string, error) {
+		if cfg.cache == nil {
+			return fuzzy.SearchContext(ctx, q, lang)
+		}
+		key, gen := CacheKey(q, lang), gi.Generation()
+		if hits, suggestion, ok := cfg.cache.Get(key, gen); ok {
+			return hits, suggestion, nil
+		}
+		hits, suggestion, err := fuzzy.SearchContext(ctx, q, lang)
+		if err == nil {
+			cfg.cache.Put(key, gen, hits, suggestion)
+		}
+		return hits, suggestion, err
+	}
+
+	// /search?q=terms[&lang=fr][&pagerank=w] -> JSON hits, facets and an optional suggestion.
+	// Terms like type:Article filter on document metadata, as do
+	// &host=, &path_prefix= and &date_from=/&date_to= (on datePublished).
+	// &explain=true adds a per-term score breakdown to every hit.
+	// &clicks=0.2 blends the click-through rate of each hit for q (see /click).
+	// Every search of q counts as an impression of every hit, however far
+	// down the list, so deep hits get lower rates than they deserve and the
+	// blend favours what already ranks high.
+	// The body is a JSON array of hits; &format=v2 wraps it in a
+	// SearchResponse with the suggestion and facets.
+	mux.HandleFunc(base+"/search", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		params := r.URL.Query()
+		q := params.Get("q")
+		lang := NormalizeLang(params.Get("lang"))
+		filter := SearchFilter{
+			Host:       params.Get("host"),
+			PathPrefix: params.Get("path_prefix"),
+			From:       ParseDateBound(params.Get("date_from"), false),
+			To:         ParseDateBound(params.Get("date_to"), true),
+		}
+		record := func(results int, errKind string) {
+			err := cfg.queryLog.Record(QueryEvent{
+				Time:       start.UTC(),
+				Query:      NormalizeQuery(q),
+				Lang:       lang,
+				Collection: m.name,
+				Results:    results,
+				LatencyMS:  float64(time.Since(start).Microseconds()) / 1000,
+				Client:     clientID(r),
+				Error:      errKind,
+			})
+			cfg.logError(r, "query log write failed", err)
+		}
+		var resp SearchResponse
 		var hits []Hit
-		if indexer != nil {
-			hits = indexer.SearchTFIDF(q)
-			// Sort hits by score (descending) and URL (ascending) for ties
-			sort.Slice(hits, func(i, j int) bool {
-				return lessHit(hits[i], hits[j])
+		if fuzzy != nil {
+			var err error
+			hits, resp.Suggestion, err = ranked(r.Context(), q, lang)
+			if err != nil {
+				record(0, queryError(err))
+				searchFailed(w, err)
+				return
+			}
+		}
+		// &pagerank=0.3 blends stored PageRank into the scores with that weight.
+		blended := false
+		if wt, err := strconv.ParseFloat(params.Get("pagerank"), 64); err == nil && wt > 0 {
+			if gi, ok := indexer.(GraphIndexer); ok {
+				hits = BlendPageRank(hits, LoadPageRank(gi, hits), math.Min(wt, 1))
+				blended = true
+			}
+		}
+		if wt, err := strconv.ParseFloat(params.Get("clicks"), 64); err == nil && wt > 0 && cfg.queryLog != nil {
+			hits = cfg.queryLog.BlendClicks(m.name, NormalizeQuery(q), hits, math.Min(wt, 1))
+			blended = true
+		}
+		explain, _ := strconv.ParseBool(params.Get("explain"))
+		meta := LoadMeta(indexer, hits)
+		hits = cfg.dedup.Collapse(ApplyFilter(hits, meta, filter))
+		v2 := params.Get("format") == "v2"
+		if v2 && indexer != nil {
+			facets := CountFacets(hits, meta, maxFacetValues)
+			resp.Facets = &facets
+		}
+		for _, h := range hits {
+			sh := SearchHit{Hit: h}
+			if m, ok := meta[h.URL]; ok {
+				sh.Meta = &m
+			}
+			if explain {
+				if ex, ok := fuzzy.Explain(q, h.URL, lang); ok {
+					if blended {
+						ex.Note = "TF-IDF score before blending with PageRank or clicks"
+					}
+					sh.Explanation = &ex
+				}
+			}
+			resp.Hits = append(resp.Hits, sh)
+		}
+		record(len(resp.Hits), "")
+		if resp.Suggestion != "" {
+			w.Header().Set(SuggestionHeader, url.QueryEscape(resp.Suggestion))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if v2 {
+			_ = json.NewEncoder(w).Encode(resp)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp.Hits)
+	})
+
+	// /click?q=terms&url=u[&pos=n][&lang=fr] -> records the click and redirects to u,
+	// which must be a result of q so the endpoint is no open redirect. The
+	// results come from the query cache when q was just searched.
+	if cfg.queryLog != nil && fuzzy != nil {
+		mux.HandleFunc("GET "+base+"/click", func(w http.ResponseWriter, r *http.Request) {
+			params := r.URL.Query()
+			q, target := params.Get("q"), params.Get("url")
+			hits, _, err := ranked(r.Context(), q, NormalizeLang(params.Get("lang")))
+			if err != nil {
+				searchFailed(w, err)
+				return
+			}
+			if target == "" || !slices.ContainsFunc(hits, func(h Hit) bool { return h.URL == target }) {
+				http.Error(w, "url is not a result of q", http.StatusBadRequest)
+				return
+			}
+			pos, _ := strconv.Atoi(params.Get("pos"))
+			err = cfg.queryLog.RecordClick(ClickEvent{
+				Time:       time.Now().UTC(),
+				Query:      NormalizeQuery(q),
+				URL:        target,
+				Pos:        max(pos, 0),
+				Collection: m.name,
+				Client:     clientID(r),
 			})
+			cfg.logError(r, "query log write failed", err)
+			http.Redirect(w, r, target, http.StatusFound)
+		})
+	}
+
+	// /duplicates[?url=u] -> JSON duplicate groups keyed by canonical URL
+	mux.HandleFunc(base+"/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		groups := map[string][]string{}
+		if cfg.dedup != nil {
+			if u := r.URL.Query().Get("url"); u != "" {
+				if g := cfg.dedup.Group(u); g != nil {
+					groups[g[0]] = g[1:]
+				}
+			} else {
+				groups = cfg.dedup.Groups()
+			}
 		}
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(hits)
+		_ = json.NewEncoder(w).Encode(groups)
 	})
 
-	return mux
+	// /stats/cache -> JSON query cache counters
+	mux.HandleFunc(base+"/stats/cache", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.cache == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(cfg.cache.Stats())
+	})
+
+	if cfg.admin != nil && indexer != nil && (cfg.admin.Token != "" || hasScope(cfg.access, ScopeAdmin)) {
+		registerAdmin(mux, m)
+	}
+
+	// /suggest?q=prefix[&n=10] -> JSON completions, most frequent first
+	mux.HandleFunc(base+"/suggest", func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			n = 10
+		}
+		out := []Completion{}
+		if pi, ok := indexer.(PrefixIndexer); ok && prefix != "" {
+			for _, ts := range pi.PrefixTerms(prefix, n) {
+				text := ts.Form
+				if text == "" {
+					text = ts.Term // rows indexed before forms were stored
+				}
+				out = append(out, Completion{Text: text, DF: ts.DF})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
+
+// hasScope reports whether ac has a key with scope.
+func hasScope(ac *AccessConfig, scope string) bool {
+	if ac == nil {
+		return false
+	}
+	for _, k := range ac.Keys {
+		if k.Scope == scope {
+			return true
+		}
+	}
+	return false
 }
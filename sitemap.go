@@ -0,0 +1,174 @@
+package project02
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSitemaps caps how many sitemap files FetchSitemaps downloads, so a
+// sitemap index cannot send the crawler on an unbounded walk.
+const maxSitemaps = 50
+
+// maxSitemapSize caps the uncompressed size of a gzip sitemap at the 50 MB
+// (52,428,800 bytes) the sitemap protocol allows, so a small compressed
+// file cannot expand without bound.
+const maxSitemapSize = 50 << 20
+
+// errSitemapTooLarge reports a gzip sitemap that expands past maxSitemapSize.
+var errSitemapTooLarge = errors.New("sitemap exceeds 50 MB uncompressed")
+
+// SitemapEntry is one <url> of a sitemap urlset.
+type SitemapEntry struct {
+	Loc      string
+	LastMod  time.Time // zero if absent or unparsable
+	Priority float64   // 0.5 if absent, per the sitemap protocol
+}
+
+type xmlSitemap struct {
+	XMLName xml.Name
+	URLs    []struct {
+		Loc      string `xml:"loc"`
+		LastMod  string `xml:"lastmod"`
+		Priority string `xml:"priority"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// ParseSitemap decodes a sitemap urlset or sitemap index, gzip-compressed
+// or not. It returns the page entries of a urlset and the child sitemap
+// URLs of an index.
+func ParseSitemap(body []byte) ([]SitemapEntry, []string, error) {
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err = io.ReadAll(io.LimitReader(zr, maxSitemapSize+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(body) > maxSitemapSize {
+			return nil, nil, errSitemapTooLarge
+		}
+	}
+	var sm xmlSitemap
+	if err := newXMLDecoder(body).Decode(&sm); err != nil {
+		return nil, nil, err
+	}
+
+	var entries []SitemapEntry
+	for _, u := range sm.URLs {
+		loc := strings.TrimSpace(u.Loc)
+		if loc == "" {
+			continue
+		}
+		e := SitemapEntry{Loc: loc, Priority: 0.5, LastMod: parseW3CDate(u.LastMod)}
+		if p, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64); err == nil {
+			e.Priority = p
+		}
+		entries = append(entries, e)
+	}
+	var children []string
+	for _, s := range sm.Sitemaps {
+		if loc := strings.TrimSpace(s.Loc); loc != "" {
+			children = append(children, loc)
+		}
+	}
+	return entries, children, nil
+}
+
+// parseW3CDate parses the W3C datetime profiles allowed in <lastmod>.
+func parseW3CDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// SitemapsFromRobots returns the URLs of all "Sitemap:" lines in a robots.txt body.
+func SitemapsFromRobots(body []byte) []string {
+	var out []string
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), "sitemap") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// FetchSitemaps discovers the sitemaps of the site rooted at base (from
+// robots.txt, falling back to /sitemap.xml), follows sitemap indexes and
+// returns the page entries ordered by priority, then most recent lastmod.
+func FetchSitemaps(base string) []SitemapEntry {
+	return fetchSitemaps(context.Background(), base)
+}
+
+// fetchSitemaps is FetchSitemaps with its downloads bound to ctx.
+func fetchSitemaps(ctx context.Context, base string) []SitemapEntry {
+	base = strings.TrimSuffix(base, "/")
+	var queue []string
+	if body, _, err := DownloadWithHeaderContext(ctx, base+"/robots.txt"); err == nil {
+		queue = SitemapsFromRobots(body)
+	}
+	if len(queue) == 0 {
+		queue = []string{base + "/sitemap.xml"}
+	}
+
+	seenMap := make(map[string]bool)
+	seenLoc := make(map[string]bool)
+	var entries []SitemapEntry
+	for len(queue) > 0 && len(seenMap) < maxSitemaps {
+		sm := queue[0]
+		queue = queue[1:]
+		if seenMap[sm] {
+			continue
+		}
+		seenMap[sm] = true
+
+		body, _, err := DownloadWithHeaderContext(ctx, sm)
+		if err != nil {
+			continue
+		}
+		es, children, err := ParseSitemap(body)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, children...)
+		for _, e := range es {
+			if !seenLoc[e.Loc] {
+				seenLoc[e.Loc] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if !a.LastMod.Equal(b.LastMod) {
+			return a.LastMod.After(b.LastMod)
+		}
+		return a.Loc < b.Loc
+	})
+	return entries
+}
@@ -1,20 +1,34 @@
 package project02
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"math"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	_ "github.com/glebarez/sqlite"
-	"github.com/kljensen/snowball/english"
 )
 
 // SQLiteIndex stores data for TF-IDF ranking in SQLite database.
 type SQLiteIndex struct {
 	db   *sql.DB
 	stop map[string]struct{}
-	N    int
+
+	// Deprecated: N is the document count when the index was opened and
+	// is not updated afterwards, so it never races with writers; use GetN.
+	N int
+
+	n   atomic.Int64 // document count, read by searches while writes run
+	wmu sync.Mutex   // serializes write transactions
+
+	langStop map[string]map[string]struct{} // lang -> stopword set
+	gen      atomic.Uint64                  // bumped by writes that change search results
 }
 
 // NewSQLiteIndex creates a new SQLite index
@@ -24,7 +38,7 @@ func NewSQLiteIndex(dbPath string, stop map[string]struct{}) (*SQLiteIndex, erro
 	}
 
 	// Open SQLite database
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath))
 	if err != nil {
 		return nil, err
 	}
@@ -62,9 +76,45 @@ func NewSQLiteIndex(dbPath string, stop map[string]struct{}) (*SQLiteIndex, erro
 		return nil, err
 	}
 
+	// Columns added after the first schema; older databases are migrated in place.
+	if err := addColumnIfMissing(db, "urls", "lang", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "terms", "form", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createFormTable(db, "terms", "word"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createGraphTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createAnchorTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createMetaTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createDedupTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_terms_form ON terms(form)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	idx := &SQLiteIndex{
 		db:   db,
 		stop: stop,
+
+		langStop: make(map[string]map[string]struct{}),
 	}
 
 	// Get the total number of documents
@@ -75,144 +125,325 @@ func NewSQLiteIndex(dbPath string, stop map[string]struct{}) (*SQLiteIndex, erro
 		return nil, err
 	}
 	idx.N = count
+	idx.n.Store(int64(count))
 
 	return idx, nil
 }
 
-// Add indexes a single document. Pipeline: lower -> stop filter -> stem.
-func (idx *SQLiteIndex) Add(doc string, words []string) {
-	// Check if document already exists
-	var existingID int
-	err := idx.db.QueryRow("SELECT id FROM urls WHERE url = ?", doc).Scan(&existingID)
-	if err == nil {
-		// Document already exists
-		return
+// sqliteBusyTimeout is how long a statement waits for another connection's
+// lock before failing with SQLITE_BUSY.
+const sqliteBusyTimeout = 5 * time.Second
+
+// sqliteDSN adds the connection pragmas every index uses to dbPath.
+func sqliteDSN(dbPath string) string {
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
 	}
+	return fmt.Sprintf("%s%s_pragma=busy_timeout(%d)", dbPath, sep, sqliteBusyTimeout.Milliseconds())
+}
 
-	seen := make(map[string]bool)
-	var kept int
+// createFormTable creates term_forms, which maps every surface word seen to
+// its stem for prefix lookups. A new table is filled from the first-seen
+// forms already stored in the stem column col of table terms.
+func createFormTable(db *sql.DB, terms, col string) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'term_forms'").Scan(&exists); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS term_forms (
+			form TEXT NOT NULL,
+			term TEXT NOT NULL,
+			PRIMARY KEY (form, term)
+		)`); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+	_, err := db.Exec("INSERT OR IGNORE INTO term_forms (form, term) SELECT form, " + col + " FROM " + terms + " WHERE form != ''")
+	return err
+}
 
-	// Create URL record first
-	result, err := idx.db.Exec("INSERT INTO urls (url, len) VALUES (?, 0)", doc)
+// addColumnIfMissing adds column to table unless it already exists.
+func addColumnIfMissing(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
 	if err != nil {
-		return
+		return err
 	}
-	urlID, err := result.LastInsertId()
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err
+}
+
+// SetLangStopwords sets the stopword list used for documents and queries in lang.
+func (idx *SQLiteIndex) SetLangStopwords(lang string, stop map[string]struct{}) {
+	idx.langStop[lang] = stop
+}
+
+// stopFor returns the stopword set for lang. English and unknown documents use
+// the default set; other languages have none unless configured.
+func (idx *SQLiteIndex) stopFor(lang string) map[string]struct{} {
+	if s, ok := idx.langStop[lang]; ok {
+		return s
+	}
+	if lang == "" || lang == "en" {
+		return idx.stop
+	}
+	return nil
+}
+
+// Stopword reports whether word is a stopword for lang.
+func (idx *SQLiteIndex) Stopword(word, lang string) bool {
+	_, bad := idx.stopFor(lang)[strings.ToLower(word)]
+	return bad
+}
+
+// Add indexes a single document. Pipeline: lower -> stop filter -> stem.
+func (idx *SQLiteIndex) Add(doc string, words []string) {
+	idx.AddLang(doc, "", words)
+}
+
+// AddLang indexes a single document with the stopwords and stemmer for lang.
+// A document that is already indexed is left as is; see ReplaceLang.
+func (idx *SQLiteIndex) AddLang(doc, lang string, words []string) {
+	_, _ = idx.write(doc, lang, words, false)
+}
+
+// ReplaceLang indexes doc like AddLang, replacing any earlier version (its
+// metadata and the anchor text of its links included) in the same
+// transaction, and reports whether there was one.
+func (idx *SQLiteIndex) ReplaceLang(doc, lang string, words []string) (bool, error) {
+	return idx.write(doc, lang, words, true)
+}
+
+// write indexes doc in one transaction, first deleting an earlier version
+// when replace is set. Writes are serialized so that two transactions never
+// wait on each other's locks.
+func (idx *SQLiteIndex) write(doc, lang string, words []string, replace bool) (replaced bool, err error) {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+	tx, err := idx.db.Begin()
 	if err != nil {
-		return
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if replace {
+		if replaced, err = sqlDeleteDoc(tx, doc); err != nil {
+			return false, err
+		}
+	} else if err := tx.QueryRow("SELECT id FROM urls WHERE url = ?", doc).Scan(new(int64)); err == nil {
+		return false, nil // already indexed
+	} else if err != sql.ErrNoRows {
+		return false, err
 	}
 
-	// Process words
+	stop := idx.stopFor(lang)
+	tf := make(map[string]int)
+	var stems []string               // in first-seen order
+	first := make(map[string]string) // stem -> first surface word
+	forms := make(map[string]string) // surface word -> stem
+	var kept int
 	for _, w := range words {
 		if w == "" {
 			continue
 		}
 		lw := strings.ToLower(w)
-		if _, bad := idx.stop[lw]; bad {
+		if _, bad := stop[lw]; bad {
 			continue
 		}
-		s := english.Stem(lw, true)
+		s := stemLang(lang, lw)
 		if s == "" {
 			continue
 		}
+		if tf[s] == 0 {
+			stems = append(stems, s)
+			first[s] = lw
+		}
+		tf[s]++
+		forms[lw] = s
 		kept++
+	}
 
-		// Get or create term
-		var termID int64
-		err = idx.db.QueryRow("SELECT id FROM terms WHERE word = ?", s).Scan(&termID)
-		if err == sql.ErrNoRows {
-			// Term doesn't exist, create it with df=1
-			result, err := idx.db.Exec("INSERT INTO terms (word, df) VALUES (?, 1)", s)
-			if err != nil {
-				continue
-			}
-			termID, err = result.LastInsertId()
-			if err != nil {
-				continue
-			}
-			seen[s] = true
-		} else if err != nil {
-			// Other database error
-			continue
-		} else {
-			// Term exists, increment document frequency if this is the first time we see this term in this document
-			if !seen[s] {
-				_, err := idx.db.Exec("UPDATE terms SET df = df + 1 WHERE word = ?", s)
-				if err != nil {
-					continue
-				}
-				seen[s] = true
-			}
+	result, err := tx.Exec("INSERT INTO urls (url, len, lang) VALUES (?, ?, ?)", doc, kept, lang)
+	if err != nil {
+		return false, err
+	}
+	urlID, err := result.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	for lw, s := range forms {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO term_forms (form, term) VALUES (?, ?)", lw, s); err != nil {
+			return false, err
 		}
-
-		// Create or update hit
-		var hitID int64
-		err = idx.db.QueryRow("SELECT id FROM hits WHERE term_id = ? AND url_id = ?", termID, urlID).Scan(&hitID)
-		if err == sql.ErrNoRows {
-			// Hit doesn't exist, create it
-			_, err := idx.db.Exec("INSERT INTO hits (term_id, url_id, count) VALUES (?, ?, 1)", termID, urlID)
-			if err != nil {
-				continue
-			}
-		} else if err == nil {
-			// Hit exists, increment count
-			_, err := idx.db.Exec("UPDATE hits SET count = count + 1 WHERE term_id = ? AND url_id = ?", termID, urlID)
-			if err != nil {
-				continue
-			}
+	}
+	for _, s := range stems {
+		if _, err := tx.Exec(`
+			INSERT INTO terms (word, df, form) VALUES (?, 1, ?)
+			ON CONFLICT(word) DO UPDATE SET df = df + 1`, s, first[s]); err != nil {
+			return false, err
 		}
+		if _, err := tx.Exec(`
+			INSERT INTO hits (term_id, url_id, count)
+			SELECT id, ?, ? FROM terms WHERE word = ?`, urlID, tf[s], s); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	if !replaced {
+		idx.n.Add(1)
 	}
+	idx.gen.Add(1)
+	return replaced, nil
+}
+
+// Has reports whether doc is indexed.
+func (idx *SQLiteIndex) Has(doc string) bool {
+	var id int64
+	return idx.db.QueryRow("SELECT id FROM urls WHERE url = ?", doc).Scan(&id) == nil
+}
 
-	// Update URL length
-	_, err = idx.db.Exec("UPDATE urls SET len = ? WHERE id = ?", kept, urlID)
+// Delete removes doc, its metadata and the anchor text of its links,
+// reporting whether it was indexed. Terms no other document uses are
+// dropped from the dictionary.
+func (idx *SQLiteIndex) Delete(doc string) (bool, error) {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+	tx, err := idx.db.Begin()
 	if err != nil {
-		return
+		return false, err
 	}
+	defer tx.Rollback()
+	ok, err := sqlDeleteDoc(tx, doc)
+	if !ok || err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	idx.n.Add(-1)
+	idx.gen.Add(1)
+	return true, nil
+}
 
-	// Update document count
-	idx.N++
+// sqlDeleteDoc removes doc from the urls/terms/hits schema in tx.
+func sqlDeleteDoc(tx *sql.Tx, doc string) (bool, error) {
+	var urlID int64
+	if err := tx.QueryRow("SELECT id FROM urls WHERE url = ?", doc).Scan(&urlID); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, stmt := range []string{
+		"UPDATE terms SET df = df - 1 WHERE id IN (SELECT term_id FROM hits WHERE url_id = ?)",
+		"DELETE FROM hits WHERE url_id = ?",
+		"DELETE FROM urls WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, urlID); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM term_forms WHERE term IN (SELECT word FROM terms WHERE df <= 0)"); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM terms WHERE df <= 0"); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM doc_meta WHERE url = ?", doc); err != nil {
+		return false, err
+	}
+	return true, sqlDeleteAnchors(tx, doc)
 }
 
-// GetN returns the total number of documents
+// GetN returns the total number of documents, safely under concurrent
+// writes.
 func (idx *SQLiteIndex) GetN() int {
 	// Refresh N from database to ensure consistency
 	var count int
-	err := idx.db.QueryRow("SELECT COUNT(*) FROM urls").Scan(&count)
-	if err != nil {
-		return idx.N
+	if err := idx.db.QueryRow("SELECT COUNT(*) FROM urls").Scan(&count); err == nil {
+		idx.n.Store(int64(count))
 	}
-	idx.N = count
-	return idx.N
+	return int(idx.n.Load())
 }
 
 // SearchTFIDF ranks a single-term query using TF-IDF.
 func (idx *SQLiteIndex) SearchTFIDF(term string) []Hit {
-	if term == "" || idx.N == 0 {
+	return idx.SearchTFIDFLang(term, "")
+}
+
+// SearchTFIDFLang ranks a single-term query within documents in lang.
+// An empty lang searches every document with the default pipeline.
+func (idx *SQLiteIndex) SearchTFIDFLang(term, lang string) []Hit {
+	if term == "" || idx.n.Load() == 0 {
 		return nil
 	}
 	q := strings.ToLower(term)
-	if _, bad := idx.stop[q]; bad {
+	if _, bad := idx.stopFor(lang)[q]; bad {
+		return nil
+	}
+	return idx.SearchStem(stemLang(lang, q), lang)
+}
+
+// SearchStem ranks documents containing the already-stemmed term s in
+// their body or in the anchor text of links pointing at them.
+func (idx *SQLiteIndex) SearchStem(s, lang string) []Hit {
+	hits, _ := idx.SearchStemContext(context.Background(), s, lang)
+	return hits
+}
+
+// SearchStemContext is SearchStem with its queries bound to ctx.
+func (idx *SQLiteIndex) SearchStemContext(ctx context.Context, s, lang string) ([]Hit, error) {
+	var df int
+	idx.db.QueryRowContext(ctx, "SELECT df FROM terms WHERE word = ?", s).Scan(&df)
+	hits := mergeAnchorHits(idx.searchBody(ctx, s, lang), sqlAnchorHits(ctx, idx.db, "urls", int(idx.n.Load()), df, s, lang))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// searchBody scores the page body field for stem s.
+func (idx *SQLiteIndex) searchBody(ctx context.Context, s, lang string) []Hit {
+	if s == "" || idx.n.Load() == 0 {
 		return nil
 	}
-	s := english.Stem(q, true)
 
 	// Find the term
 	var termID int
 	var df int
-	err := idx.db.QueryRow("SELECT id, df FROM terms WHERE word = ?", s).Scan(&termID, &df)
+	err := idx.db.QueryRowContext(ctx, "SELECT id, df FROM terms WHERE word = ?", s).Scan(&termID, &df)
 	if err != nil {
 		return nil
 	}
 
 	// Calculate IDF
-	idf := math.Log(float64(idx.N) / float64(df))
+	idf := math.Log(float64(idx.n.Load()) / float64(df))
 
 	// Get hits for this term
-	rows, err := idx.db.Query(`
+	rows, err := idx.db.QueryContext(ctx, `
 		SELECT h.count, u.url, u.len 
 		FROM hits h 
 		JOIN urls u ON h.url_id = u.id 
-		WHERE h.term_id = ?`, termID)
+		WHERE h.term_id = ? AND (? = '' OR u.lang = ?)`, termID, lang, lang)
 	if err != nil {
 		return nil
 	}
@@ -241,6 +472,171 @@ func (idx *SQLiteIndex) SearchTFIDF(term string) []Hit {
 	return hits
 }
 
+// TermCounts returns the number of distinct terms and the sum of their
+// document frequencies.
+func (idx *SQLiteIndex) TermCounts() (terms, postings int) {
+	_ = idx.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(df), 0) FROM terms").Scan(&terms, &postings)
+	return terms, postings
+}
+
+// Terms returns the term dictionary sorted by stem.
+func (idx *SQLiteIndex) Terms() []TermStat {
+	rows, err := idx.db.Query("SELECT word, form, df FROM terms ORDER BY word")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var out []TermStat
+	for rows.Next() {
+		var ts TermStat
+		if err := rows.Scan(&ts.Term, &ts.Form, &ts.DF); err != nil {
+			continue
+		}
+		out = append(out, ts)
+	}
+	return out
+}
+
+// PrefixTerms returns up to limit terms with a surface form starting with
+// prefix, most frequent first, each with its first matching form. The range
+// condition lets SQLite use the term_forms key the same way LIKE 'prefix%'
+// would with a case-sensitive collation.
+func (idx *SQLiteIndex) PrefixTerms(prefix string, limit int) []TermStat {
+	if limit <= 0 {
+		limit = -1
+	}
+	prefix = strings.ToLower(prefix)
+	rows, err := idx.db.Query(`
+		SELECT t.word, MIN(f.form), t.df
+		FROM term_forms f JOIN terms t ON t.word = f.term
+		WHERE f.form >= ? AND f.form < ?
+		GROUP BY t.word
+		ORDER BY t.df DESC, MIN(f.form) ASC
+		LIMIT ?`, prefix, prefixUpperBound(prefix), limit)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var out []TermStat
+	for rows.Next() {
+		var ts TermStat
+		if err := rows.Scan(&ts.Term, &ts.Form, &ts.DF); err != nil {
+			continue
+		}
+		out = append(out, ts)
+	}
+	return out
+}
+
+// prefixUpperBound returns a string greater than every string starting with prefix.
+func prefixUpperBound(prefix string) string {
+	return prefix + string(utf8.MaxRune)
+}
+
+// Explain breaks down how url scores for query with SearchQuery.
+func (idx *SQLiteIndex) Explain(query, url string) Explanation {
+	return idx.ExplainLang(query, url, "")
+}
+
+// ExplainLang is Explain for a search restricted to lang.
+func (idx *SQLiteIndex) ExplainLang(query, url, lang string) Explanation {
+	return explainStems(idx, url, lang, queryStems(idx, query, lang))
+}
+
+func (idx *SQLiteIndex) stemStats(s, url string) stemStats {
+	st := stemStats{N: int(idx.n.Load())}
+	var urlID int
+	err := idx.db.QueryRow("SELECT id, len, lang FROM urls WHERE url = ?", url).Scan(&urlID, &st.DocLen, &st.Lang)
+	if err != nil {
+		return st
+	}
+	st.Indexed = true
+	if s == "" {
+		return st
+	}
+	var termID int
+	if err := idx.db.QueryRow("SELECT id, df FROM terms WHERE word = ?", s).Scan(&termID, &st.DF); err == nil {
+		_ = idx.db.QueryRow("SELECT count FROM hits WHERE term_id = ? AND url_id = ?", termID, urlID).Scan(&st.TF)
+	}
+	st.ATF, st.AnchorLen, st.ADF = sqlAnchorStats(idx.db, "urls", s, url)
+	return st
+}
+
+// AddAnchor indexes anchor words of a link on source pointing at target.
+func (idx *SQLiteIndex) AddAnchor(source, target, lang string, words []string) {
+	sqlAddAnchor(idx.db, source, target, anchorStems(idx.stopFor(lang), lang, words))
+	idx.gen.Add(1)
+}
+
+// Generation returns a counter bumped by every AddLang, AddAnchor, SetMeta
+// and Delete made through this index.
+func (idx *SQLiteIndex) Generation() uint64 {
+	return idx.gen.Load()
+}
+
+// SetMeta replaces the metadata stored for url.
+func (idx *SQLiteIndex) SetMeta(url string, m Metadata) {
+	sqlSetMeta(idx.db, url, m)
+	idx.gen.Add(1)
+}
+
+// Meta returns the metadata stored for url.
+func (idx *SQLiteIndex) Meta(url string) (Metadata, bool) {
+	return sqlMeta(idx.db, url)
+}
+
+// MetaBatch returns the metadata stored for those of urls that have any.
+func (idx *SQLiteIndex) MetaBatch(urls []string) map[string]Metadata {
+	return sqlMetaBatch(idx.db, urls)
+}
+
+// AddEdge records a link; duplicates are ignored.
+func (idx *SQLiteIndex) AddEdge(e Edge) {
+	sqlAddEdge(idx.db, e)
+}
+
+// Edges returns every stored link.
+func (idx *SQLiteIndex) Edges() []Edge {
+	return sqlEdges(idx.db)
+}
+
+// SetPageRank replaces the stored PageRank scores.
+func (idx *SQLiteIndex) SetPageRank(ranks map[string]float64) {
+	sqlSetPageRank(idx.db, ranks)
+}
+
+// PageRanks returns the stored PageRank scores by URL.
+func (idx *SQLiteIndex) PageRanks() map[string]float64 {
+	return sqlPageRanks(idx.db)
+}
+
+// PageRank returns the stored scores of those of urls that have one.
+func (idx *SQLiteIndex) PageRank(urls []string) map[string]float64 {
+	return sqlPageRank(idx.db, urls)
+}
+
+// AddDedup stores a duplicate group record; a URL already stored is ignored.
+func (idx *SQLiteIndex) AddDedup(r DedupRecord) {
+	sqlAddDedup(idx.db, r)
+}
+
+// DedupRecords returns the stored duplicate group records in insertion order.
+func (idx *SQLiteIndex) DedupRecords() []DedupRecord {
+	return sqlDedupRecords(idx.db)
+}
+
+// DeleteDedup removes url from the stored duplicate groups.
+func (idx *SQLiteIndex) DeleteDedup(url string) {
+	sqlDeleteDedup(idx.db, url)
+}
+
+// Ping checks that the database answers queries.
+func (idx *SQLiteIndex) Ping() error {
+	return sqlPing(idx.db)
+}
+
 // Close closes the database connection
 func (idx *SQLiteIndex) Close() error {
 	return idx.db.Close()
@@ -1,20 +1,30 @@
 package project02
 
 import (
+	"context"
 	"database/sql"
 	"math"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	_ "github.com/glebarez/sqlite"
-	"github.com/kljensen/snowball/english"
 )
 
 // SQLiteIndexV2 是基于SQLite数据库的索引器实现的另一个版本
 type SQLiteIndexV2 struct {
 	db   *sql.DB
 	stop map[string]struct{}
-	N    int
+
+	// Deprecated: N 是打开索引时的文档总数，之后不再更新，因此不会与写入竞争；请使用 GetN
+	N int
+
+	n   atomic.Int64 // 文档总数，写入时也会被搜索读取
+	wmu sync.Mutex   // 串行化写事务
+
+	langStop map[string]map[string]struct{} // 语言 -> 停用词表
+	gen      atomic.Uint64                  // 改变搜索结果的写入次数
 }
 
 // NewSQLiteIndexV2 创建一个新的SQLite索引器V2版本
@@ -24,7 +34,7 @@ func NewSQLiteIndexV2(dbPath string, stop map[string]struct{}) (*SQLiteIndexV2,
 	}
 
 	// Open SQLite database
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath))
 	if err != nil {
 		return nil, err
 	}
@@ -70,9 +80,45 @@ func NewSQLiteIndexV2(dbPath string, stop map[string]struct{}) (*SQLiteIndexV2,
 		return nil, err
 	}
 
+	// Columns added after the first schema; older databases are migrated in place.
+	if err := addColumnIfMissing(db, "documents", "lang", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "vocabulary", "form", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createFormTable(db, "vocabulary", "term"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createGraphTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createAnchorTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createMetaTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createDedupTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_vocabulary_form ON vocabulary(form)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	idx := &SQLiteIndexV2{
 		db:   db,
 		stop: stop,
+
+		langStop: make(map[string]map[string]struct{}),
 	}
 
 	// Get the total number of documents
@@ -83,121 +129,226 @@ func NewSQLiteIndexV2(dbPath string, stop map[string]struct{}) (*SQLiteIndexV2,
 		return nil, err
 	}
 	idx.N = count
+	idx.n.Store(int64(count))
 
 	return idx, nil
 }
 
+// SetLangStopwords 设置指定语言的停用词表
+func (idx *SQLiteIndexV2) SetLangStopwords(lang string, stop map[string]struct{}) {
+	idx.langStop[lang] = stop
+}
+
+// stopFor 返回指定语言的停用词表；英文和未知语言使用默认词表
+func (idx *SQLiteIndexV2) stopFor(lang string) map[string]struct{} {
+	if s, ok := idx.langStop[lang]; ok {
+		return s
+	}
+	if lang == "" || lang == "en" {
+		return idx.stop
+	}
+	return nil
+}
+
+// Stopword 判断 word 是否为该语言的停用词
+func (idx *SQLiteIndexV2) Stopword(word, lang string) bool {
+	_, bad := idx.stopFor(lang)[strings.ToLower(word)]
+	return bad
+}
+
 // Add 将文档添加到索引中，使用不同的处理逻辑
 func (idx *SQLiteIndexV2) Add(doc string, words []string) {
-	// Start a transaction for better performance and consistency
-	tx, err := idx.db.Begin()
-	if err != nil {
-		return
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
+	idx.AddLang(doc, "", words)
+}
 
-	// Check if document already exists
-	var docID int64
-	err = tx.QueryRow("SELECT id FROM documents WHERE url = ?", doc).Scan(&docID)
-	if err == nil {
-		// Document already exists, nothing to do
-		return
-	}
+// AddLang 按文档语言选择停用词和词干提取器后添加文档；已在索引中的文档保持不变，替换见 ReplaceLang
+func (idx *SQLiteIndexV2) AddLang(doc, lang string, words []string) {
+	_, _ = idx.write(doc, lang, words, false)
+}
+
+// ReplaceLang 与 AddLang 相同，但在同一事务中替换文档的旧版本（包括其元数据和链接锚文本），返回是否存在旧版本
+func (idx *SQLiteIndexV2) ReplaceLang(doc, lang string, words []string) (bool, error) {
+	return idx.write(doc, lang, words, true)
+}
 
-	// Create document record
-	result, err := tx.Exec("INSERT INTO documents (url, word_count) VALUES (?, 0)", doc)
+// write 在一个事务中写入文档；replace 为真时先删除旧版本。写入串行执行，避免两个事务互相等待对方的锁
+func (idx *SQLiteIndexV2) write(doc, lang string, words []string, replace bool) (replaced bool, err error) {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+	tx, err := idx.db.Begin()
 	if err != nil {
-		return
+		return false, err
 	}
-	docID, err = result.LastInsertId()
-	if err != nil {
-		return
+	defer tx.Rollback()
+
+	if replace {
+		if replaced, err = sqlDeleteDocV2(tx, doc); err != nil {
+			return false, err
+		}
+	} else if err := tx.QueryRow("SELECT id FROM documents WHERE url = ?", doc).Scan(new(int64)); err == nil {
+		return false, nil // 已在索引中
+	} else if err != sql.ErrNoRows {
+		return false, err
 	}
 
-	// Process words with a different approach
+	stop := idx.stopFor(lang)
 	termFreq := make(map[string]int)
-	uniqueTerms := make(map[string]bool)
-
+	var terms []string                     // 按首次出现的顺序
+	uniqueTerms := make(map[string]string) // 词干 -> 首次出现的原词
+	forms := make(map[string]string)       // 原词 -> 词干
 	for _, w := range words {
 		if w == "" {
 			continue
 		}
 		lw := strings.ToLower(w)
-		if _, bad := idx.stop[lw]; bad {
+		if _, bad := stop[lw]; bad {
 			continue
 		}
-		s := english.Stem(lw, true)
+		s := stemLang(lang, lw)
 		if s == "" {
 			continue
 		}
+		if termFreq[s] == 0 {
+			terms = append(terms, s)
+			uniqueTerms[s] = lw
+		}
 		termFreq[s]++
-		uniqueTerms[s] = true
+		forms[lw] = s
 	}
 
-	// Update document word count
-	_, err = tx.Exec("UPDATE documents SET word_count = ? WHERE id = ?", len(words), docID)
+	result, err := tx.Exec("INSERT INTO documents (url, word_count, lang) VALUES (?, ?, ?)", doc, len(words), lang)
 	if err != nil {
-		return
-	}
-
-	// Process each unique term
-	for term := range uniqueTerms {
-		// Get or create term
-		var termID int64
-		err = tx.QueryRow("SELECT id FROM vocabulary WHERE term = ?", term).Scan(&termID)
-		if err == sql.ErrNoRows {
-			// Term doesn't exist, create it
-			result, err := tx.Exec("INSERT INTO vocabulary (term, document_frequency) VALUES (?, 1)", term)
-			if err != nil {
-				continue
-			}
-			termID, err = result.LastInsertId()
-			if err != nil {
-				continue
-			}
-		} else if err != nil {
-			continue
-		} else {
-			// Term exists, increment document frequency
-			_, err := tx.Exec("UPDATE vocabulary SET document_frequency = document_frequency + 1 WHERE term = ?", term)
-			if err != nil {
-				continue
-			}
+		return false, err
+	}
+	docID, err := result.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	for _, term := range terms {
+		if _, err := tx.Exec(`
+			INSERT INTO vocabulary (term, document_frequency, form) VALUES (?, 1, ?)
+			ON CONFLICT(term) DO UPDATE SET document_frequency = document_frequency + 1`, term, uniqueTerms[term]); err != nil {
+			return false, err
 		}
-
-		// Insert or update term frequency
-		_, err = tx.Exec(`
-			INSERT INTO term_frequencies (doc_id, term_id, frequency) 
-			VALUES (?, ?, ?)
-			ON CONFLICT(doc_id, term_id) 
-			DO UPDATE SET frequency = ?`,
-			docID, termID, termFreq[term], termFreq[term])
-		if err != nil {
-			continue
+		if _, err := tx.Exec(`
+			INSERT INTO term_frequencies (doc_id, term_id, frequency)
+			SELECT ?, id, ? FROM vocabulary WHERE term = ?`, docID, termFreq[term], term); err != nil {
+			return false, err
+		}
+	}
+	// 记录所有原词，前缀补全能匹配到每一种写法
+	for form, term := range forms {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO term_forms (form, term) VALUES (?, ?)", form, term); err != nil {
+			return false, err
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	// 提交之后再递增，缓存不会把旧结果记在新代号下
+	if !replaced {
+		idx.n.Add(1)
+	}
+	idx.gen.Add(1)
+	return replaced, nil
+}
+
+// Has 返回文档是否已在索引中
+func (idx *SQLiteIndexV2) Has(doc string) bool {
+	var id int64
+	return idx.db.QueryRow("SELECT id FROM documents WHERE url = ?", doc).Scan(&id) == nil
+}
 
-	// Update document count
-	idx.N++
+// Delete 删除文档、其元数据及其链接的锚文本，返回文档是否在索引中；不再被任何文档使用的词项一并删除
+func (idx *SQLiteIndexV2) Delete(doc string) (bool, error) {
+	idx.wmu.Lock()
+	defer idx.wmu.Unlock()
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	ok, err := sqlDeleteDocV2(tx, doc)
+	if !ok || err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	idx.n.Add(-1)
+	idx.gen.Add(1)
+	return true, nil
+}
+
+// sqlDeleteDocV2 在事务 tx 中从 documents/vocabulary/term_frequencies 中删除文档
+func sqlDeleteDocV2(tx *sql.Tx, doc string) (bool, error) {
+	var docID int64
+	if err := tx.QueryRow("SELECT id FROM documents WHERE url = ?", doc).Scan(&docID); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, stmt := range []string{
+		"UPDATE vocabulary SET document_frequency = document_frequency - 1 WHERE id IN (SELECT term_id FROM term_frequencies WHERE doc_id = ?)",
+		"DELETE FROM term_frequencies WHERE doc_id = ?",
+		"DELETE FROM documents WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, docID); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM term_forms WHERE term IN (SELECT term FROM vocabulary WHERE document_frequency <= 0)"); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM vocabulary WHERE document_frequency <= 0"); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM doc_meta WHERE url = ?", doc); err != nil {
+		return false, err
+	}
+	return true, sqlDeleteAnchors(tx, doc)
 }
 
 // SearchTFIDF 使用TF-IDF算法搜索文档，采用不同的查询方式
 func (idx *SQLiteIndexV2) SearchTFIDF(term string) []Hit {
-	if term == "" || idx.N == 0 {
+	return idx.SearchTFIDFLang(term, "")
+}
+
+// SearchTFIDFLang 在指定语言的文档中搜索；lang 为空时搜索全部文档
+func (idx *SQLiteIndexV2) SearchTFIDFLang(term, lang string) []Hit {
+	if term == "" || idx.n.Load() == 0 {
 		return nil
 	}
 
 	q := strings.ToLower(term)
-	if _, bad := idx.stop[q]; bad {
+	if _, bad := idx.stopFor(lang)[q]; bad {
+		return nil
+	}
+	return idx.SearchStem(stemLang(lang, q), lang)
+}
+
+// SearchStem 按已提取词干的词项检索正文和指向该文档的锚文本
+func (idx *SQLiteIndexV2) SearchStem(s, lang string) []Hit {
+	hits, _ := idx.SearchStemContext(context.Background(), s, lang)
+	return hits
+}
+
+// SearchStemContext 与 SearchStem 相同，但查询受 ctx 约束，ctx 结束时返回其错误
+func (idx *SQLiteIndexV2) SearchStemContext(ctx context.Context, s, lang string) ([]Hit, error) {
+	var df int
+	idx.db.QueryRowContext(ctx, "SELECT document_frequency FROM vocabulary WHERE term = ?", s).Scan(&df)
+	hits := mergeAnchorHits(idx.searchBody(ctx, s, lang), sqlAnchorHits(ctx, idx.db, "documents", int(idx.n.Load()), df, s, lang))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// searchBody 计算正文字段的得分
+func (idx *SQLiteIndexV2) searchBody(ctx context.Context, s, lang string) []Hit {
+	if s == "" || idx.n.Load() == 0 {
 		return nil
 	}
-	s := english.Stem(q, true)
 
 	// Use a single query to get all necessary data
 	query := `
@@ -205,9 +356,9 @@ func (idx *SQLiteIndexV2) SearchTFIDF(term string) []Hit {
 		FROM vocabulary v
 		JOIN term_frequencies tf ON v.id = tf.term_id
 		JOIN documents d ON tf.doc_id = d.id
-		WHERE v.term = ?`
+		WHERE v.term = ? AND (? = '' OR d.lang = ?)`
 
-	rows, err := idx.db.Query(query, s)
+	rows, err := idx.db.QueryContext(ctx, query, s, lang, lang)
 	if err != nil {
 		return nil
 	}
@@ -225,7 +376,7 @@ func (idx *SQLiteIndexV2) SearchTFIDF(term string) []Hit {
 		if wordCount > 0 && docFreq > 0 {
 			// Calculate TF-IDF
 			tf := float64(frequency) / float64(wordCount)
-			idf := math.Log(float64(idx.N) / float64(docFreq))
+			idf := math.Log(float64(idx.n.Load()) / float64(docFreq))
 			score := tf * idf
 			hits = append(hits, Hit{URL: url, Score: score})
 		}
@@ -244,9 +395,164 @@ func (idx *SQLiteIndexV2) SearchTFIDF(term string) []Hit {
 	return hits
 }
 
-// GetN 返回文档总数
+// TermCounts 返回不同词项的数量及其文档频率之和
+func (idx *SQLiteIndexV2) TermCounts() (terms, postings int) {
+	_ = idx.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(document_frequency), 0) FROM vocabulary").Scan(&terms, &postings)
+	return terms, postings
+}
+
+// Terms 返回按词干排序的词典
+func (idx *SQLiteIndexV2) Terms() []TermStat {
+	rows, err := idx.db.Query("SELECT term, form, document_frequency FROM vocabulary ORDER BY term")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var out []TermStat
+	for rows.Next() {
+		var ts TermStat
+		if err := rows.Scan(&ts.Term, &ts.Form, &ts.DF); err != nil {
+			continue
+		}
+		out = append(out, ts)
+	}
+	return out
+}
+
+// PrefixTerms 返回任一原词以 prefix 开头的词项，按文档频率降序；每个词项只返回一次，附带第一个匹配的原词
+func (idx *SQLiteIndexV2) PrefixTerms(prefix string, limit int) []TermStat {
+	if limit <= 0 {
+		limit = -1
+	}
+	prefix = strings.ToLower(prefix)
+	rows, err := idx.db.Query(`
+		SELECT v.term, MIN(f.form), v.document_frequency
+		FROM term_forms f JOIN vocabulary v ON v.term = f.term
+		WHERE f.form >= ? AND f.form < ?
+		GROUP BY v.term
+		ORDER BY v.document_frequency DESC, MIN(f.form) ASC
+		LIMIT ?`, prefix, prefixUpperBound(prefix), limit)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var out []TermStat
+	for rows.Next() {
+		var ts TermStat
+		if err := rows.Scan(&ts.Term, &ts.Form, &ts.DF); err != nil {
+			continue
+		}
+		out = append(out, ts)
+	}
+	return out
+}
+
+// Explain 按词项和字段分解 url 在 query 下的得分
+func (idx *SQLiteIndexV2) Explain(query, url string) Explanation {
+	return idx.ExplainLang(query, url, "")
+}
+
+// ExplainLang 同 Explain，但只在 lang 语言的文档中搜索
+func (idx *SQLiteIndexV2) ExplainLang(query, url, lang string) Explanation {
+	return explainStems(idx, url, lang, queryStems(idx, query, lang))
+}
+
+func (idx *SQLiteIndexV2) stemStats(s, url string) stemStats {
+	st := stemStats{N: int(idx.n.Load())}
+	var docID int
+	err := idx.db.QueryRow("SELECT id, word_count, lang FROM documents WHERE url = ?", url).Scan(&docID, &st.DocLen, &st.Lang)
+	if err != nil {
+		return st
+	}
+	st.Indexed = true
+	if s == "" {
+		return st
+	}
+	var termID int
+	if err := idx.db.QueryRow("SELECT id, document_frequency FROM vocabulary WHERE term = ?", s).Scan(&termID, &st.DF); err == nil {
+		_ = idx.db.QueryRow("SELECT frequency FROM term_frequencies WHERE term_id = ? AND doc_id = ?", termID, docID).Scan(&st.TF)
+	}
+	st.ATF, st.AnchorLen, st.ADF = sqlAnchorStats(idx.db, "documents", s, url)
+	return st
+}
+
+// AddAnchor 将 source 上指向 target 的链接锚文本加入索引
+func (idx *SQLiteIndexV2) AddAnchor(source, target, lang string, words []string) {
+	sqlAddAnchor(idx.db, source, target, anchorStems(idx.stopFor(lang), lang, words))
+	idx.gen.Add(1)
+}
+
+// Generation 返回通过本索引器执行的 AddLang、AddAnchor、SetMeta 和 Delete 次数
+func (idx *SQLiteIndexV2) Generation() uint64 {
+	return idx.gen.Load()
+}
+
+// SetMeta 替换 url 对应的文档元数据
+func (idx *SQLiteIndexV2) SetMeta(url string, m Metadata) {
+	sqlSetMeta(idx.db, url, m)
+	idx.gen.Add(1)
+}
+
+// Meta 返回 url 对应的文档元数据
+func (idx *SQLiteIndexV2) Meta(url string) (Metadata, bool) {
+	return sqlMeta(idx.db, url)
+}
+
+// MetaBatch 批量返回 urls 中已保存元数据的文档的元数据
+func (idx *SQLiteIndexV2) MetaBatch(urls []string) map[string]Metadata {
+	return sqlMetaBatch(idx.db, urls)
+}
+
+// AddEdge 记录一条链接，重复链接会被忽略
+func (idx *SQLiteIndexV2) AddEdge(e Edge) {
+	sqlAddEdge(idx.db, e)
+}
+
+// Edges 返回所有已记录的链接
+func (idx *SQLiteIndexV2) Edges() []Edge {
+	return sqlEdges(idx.db)
+}
+
+// SetPageRank 替换已保存的 PageRank 分数
+func (idx *SQLiteIndexV2) SetPageRank(ranks map[string]float64) {
+	sqlSetPageRank(idx.db, ranks)
+}
+
+// PageRanks 按 URL 返回 PageRank 分数
+func (idx *SQLiteIndexV2) PageRanks() map[string]float64 {
+	return sqlPageRanks(idx.db)
+}
+
+// PageRank 返回 urls 中已保存 PageRank 分数的文档的分数
+func (idx *SQLiteIndexV2) PageRank(urls []string) map[string]float64 {
+	return sqlPageRank(idx.db, urls)
+}
+
+// AddDedup 保存一条重复分组记录，已保存的 URL 会被忽略
+func (idx *SQLiteIndexV2) AddDedup(r DedupRecord) {
+	sqlAddDedup(idx.db, r)
+}
+
+// DedupRecords 按写入顺序返回已保存的重复分组记录
+func (idx *SQLiteIndexV2) DedupRecords() []DedupRecord {
+	return sqlDedupRecords(idx.db)
+}
+
+// DeleteDedup 从已保存的重复分组中删除 url
+func (idx *SQLiteIndexV2) DeleteDedup(url string) {
+	sqlDeleteDedup(idx.db, url)
+}
+
+// GetN 返回文档总数，并发写入时也可安全调用
 func (idx *SQLiteIndexV2) GetN() int {
-	return idx.N
+	return int(idx.n.Load())
+}
+
+// Ping 检查数据库能否正常查询
+func (idx *SQLiteIndexV2) Ping() error {
+	return sqlPing(idx.db)
 }
 
 // Close 关闭数据库连接